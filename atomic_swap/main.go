@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/types"
+)
+
+// atomic_swap trades coins on one chain for coins on another through the
+// HTTP API of a node on each, with hash time locked contracts:
+//
+//  1. Alice makes up a secret and locks amount-a on chain A to Bob, against
+//     its hash, refundable to her after 2*timeout.
+//  2. Bob checks that contract and locks amount-b on chain B to Alice,
+//     against the same hash, refundable to him after timeout.
+//  3. Alice claims on chain B, which puts the secret on chain B.
+//  4. Bob reads the secret from chain B and claims on chain A.
+//
+// Either both claims can happen or neither: until Alice reveals the secret
+// both can take their coins back, and once she has Bob still has at least
+// timeout to use it. The chains are told apart by their genesis data, so
+// two networks on one machine are just nodes started with different
+// -genesis values.
+
+func init() {
+	log.SetPrefix("Atomic Swap: ")
+}
+
+type chainAPI struct {
+	name string
+	url  string
+}
+
+type htlcContract struct {
+	Address      string `json:"address"`
+	RedeemScript string `json:"redeem_script"`
+}
+
+type htlcStatus struct {
+	Recipient string `json:"recipient"`
+	Sender    string `json:"sender"`
+	LockTime  int64  `json:"lock_time"`
+	Value     int    `json:"value"`
+	SpentBy   string `json:"spent_by"`
+	Secret    string `json:"secret"`
+}
+
+type txResponse struct {
+	ID string `json:"id"`
+}
+
+func (c chainAPI) call(method, path string, body interface{}, res interface{}) error {
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", c.name, path, bytes.TrimSpace(data))
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+func (c chainAPI) createHTLC(secretHash []byte, recipient, sender string, lockTime int64) (htlcContract, error) {
+	var contract htlcContract
+
+	err := c.call(http.MethodPost, "/htlc/create", types.HTLCCreateReq{
+		SecretHash: hex.EncodeToString(secretHash),
+		Recipient:  recipient,
+		Sender:     sender,
+		LockTime:   lockTime,
+	}, &contract)
+
+	return contract, err
+}
+
+func (c chainAPI) fund(from string, contract htlcContract, amount int, mine bool) (string, error) {
+	var tx txResponse
+
+	err := c.call(http.MethodPost, "/addtxn", types.NewTxnReq{
+		From:    from,
+		To:      contract.Address,
+		Amount:  amount,
+		MineNow: mine,
+	}, &tx)
+
+	return tx.ID, err
+}
+
+func (c chainAPI) claim(contract htlcContract, fundingID string, secret []byte, mine bool) (string, error) {
+	var tx txResponse
+
+	err := c.call(http.MethodPost, "/htlc/claim", types.HTLCSpendReq{
+		RedeemScript: contract.RedeemScript,
+		TxID:         fundingID,
+		Secret:       hex.EncodeToString(secret),
+		MineNow:      mine,
+	}, &tx)
+
+	return tx.ID, err
+}
+
+func (c chainAPI) status(contract htlcContract, fundingID string) (htlcStatus, error) {
+	var status htlcStatus
+
+	query := url.Values{}
+	query.Set("redeem_script", contract.RedeemScript)
+	query.Set("txid", fundingID)
+
+	err := c.call(http.MethodGet, "/htlc/status?"+query.Encode(), nil, &status)
+
+	return status, err
+}
+
+// waitFor polls the contract's status until done accepts it or the
+// deadline passes.
+func (c chainAPI) waitFor(contract htlcContract, fundingID string, deadline time.Time, poll time.Duration, done func(htlcStatus) bool) (htlcStatus, error) {
+	for {
+		status, err := c.status(contract, fundingID)
+		if err == nil && done(status) {
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("%s: gave up waiting on contract %s", c.name, contract.Address)
+			}
+			return status, err
+		}
+
+		time.Sleep(poll)
+	}
+}
+
+// -------------------------------------------------------------
+
+func main() {
+
+	chainA := flag.String("chain-a", "http://localhost:5000", "HTTP API of a node on chain A")
+	chainB := flag.String("chain-b", "http://localhost:6000", "HTTP API of a node on chain B")
+	aliceA := flag.String("alice-a", "", "Alice's address on chain A, which pays amount-a")
+	aliceB := flag.String("alice-b", "", "Alice's address on chain B, which receives amount-b")
+	bobA := flag.String("bob-a", "", "Bob's address on chain A, which receives amount-a")
+	bobB := flag.String("bob-b", "", "Bob's address on chain B, which pays amount-b")
+	amountA := flag.Int("amount-a", 0, "Amount Alice pays on chain A")
+	amountB := flag.Int("amount-b", 0, "Amount Bob pays on chain B")
+	timeout := flag.Duration("timeout", time.Hour, "How long Bob's contract runs; Alice's runs twice as long")
+	mine := flag.Bool("mine", true, "Mine every transaction right away, for networks without miners")
+	poll := flag.Duration("poll", 5*time.Second, "How often to check on the other chain")
+	flag.Parse()
+
+	if *aliceA == "" || *aliceB == "" || *bobA == "" || *bobB == "" || *amountA <= 0 || *amountB <= 0 {
+		flag.Usage()
+		log.Fatal("all four addresses and both amounts are required")
+	}
+
+	a := chainAPI{"chain A", *chainA}
+	b := chainAPI{"chain B", *chainB}
+
+	now := time.Now()
+	lockA := now.Add(2 * *timeout).Unix()
+	lockB := now.Add(*timeout).Unix()
+
+	// 1. ----------------------------------------------------------
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	secretHash := sha256.Sum256(secret)
+
+	contractA, err := a.createHTLC(secretHash[:], *bobA, *aliceA, lockA)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fundingA, err := a.fund(*aliceA, contractA, *amountA, *mine)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Alice locked %d on chain A in %s (tx %s), refundable after %s\n",
+		*amountA, contractA.Address, fundingA, time.Unix(lockA, 0))
+
+	refundA := func() {
+		fmt.Printf("Alice can refund on chain A after %s: POST %s/htlc/refund {\"redeem_script\": %q, \"txid\": %q}\n",
+			time.Unix(lockA, 0), a.url, contractA.RedeemScript, fundingA)
+	}
+
+	// 2. ----------------------------------------------------------
+	statusA, err := a.waitFor(contractA, fundingA, time.Unix(lockB, 0), *poll, func(s htlcStatus) bool {
+		return s.Value >= *amountA
+	})
+	if err != nil {
+		refundA()
+		log.Fatal(err)
+	}
+
+	if statusA.Recipient != *bobA || statusA.LockTime < lockB {
+		refundA()
+		log.Fatal("Bob: the contract on chain A does not pay him, or expires too early")
+	}
+
+	contractB, err := b.createHTLC(secretHash[:], *aliceB, *bobB, lockB)
+	if err != nil {
+		refundA()
+		log.Fatal(err)
+	}
+
+	fundingB, err := b.fund(*bobB, contractB, *amountB, *mine)
+	if err != nil {
+		refundA()
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Bob locked %d on chain B in %s (tx %s), refundable after %s\n",
+		*amountB, contractB.Address, fundingB, time.Unix(lockB, 0))
+
+	refundB := func() {
+		fmt.Printf("Bob can refund on chain B after %s: POST %s/htlc/refund {\"redeem_script\": %q, \"txid\": %q}\n",
+			time.Unix(lockB, 0), b.url, contractB.RedeemScript, fundingB)
+	}
+
+	// 3. ----------------------------------------------------------
+	statusB, err := b.waitFor(contractB, fundingB, time.Unix(lockB, 0), *poll, func(s htlcStatus) bool {
+		return s.Value >= *amountB
+	})
+	if err != nil || statusB.Recipient != *aliceB {
+		refundA()
+		refundB()
+		log.Fatalf("Alice: the contract on chain B is not funded as agreed: %v", err)
+	}
+
+	claimB, err := b.claim(contractB, fundingB, secret, *mine)
+	if err != nil {
+		refundA()
+		refundB()
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Alice claimed %d on chain B (tx %s)\n", *amountB, claimB)
+
+	// 4. ----------------------------------------------------------
+	// Bob only knows the hash, and learns the secret from Alice's claim
+	statusB, err = b.waitFor(contractB, fundingB, time.Unix(lockA, 0), *poll, func(s htlcStatus) bool {
+		return s.Secret != ""
+	})
+	if err != nil {
+		refundA()
+		log.Fatal(err)
+	}
+
+	revealed, err := hex.DecodeString(statusB.Secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	claimA, err := a.claim(contractA, fundingA, revealed, *mine)
+	if err != nil {
+		fmt.Printf("Bob can still claim on chain A before %s with secret %s\n", time.Unix(lockA, 0), statusB.Secret)
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Bob claimed %d on chain A (tx %s)\n", *amountA, claimA)
+	fmt.Println("Swap complete")
+}
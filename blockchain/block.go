@@ -1,13 +1,10 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"time"
 )
 
 type Block struct {
@@ -85,39 +82,43 @@ func (b *Block) MarshalJSON() ([]byte, error) {
 // 	return nil
 // }
 
+// Serialize returns the canonical encoding described in encoding.go.
 func (b *Block) Serialize() []byte {
 
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+	var e encoder
+	b.encode(&e)
 
-	if err := encoder.Encode(b); err != nil {
-		return nil
-	}
-
-	return res.Bytes()
+	return e.buf
 }
 
+// HashTransactions is the merkle root over the block's transactions, see
+// merkle.go.
 func (b *Block) HashTransactions() []byte {
 
-	var txHashes [][]byte
+	var leaves [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		leaves = append(leaves, TxLeaf(tx))
 	}
 
-	tree := NewMerkleTree(txHashes)
+	tree := NewMerkleTree(leaves)
 
 	return tree.RootNode.Data
 }
 
+// Genesis is mined at GENESIS_TIMESTAMP rather than the current time, so
+// that every node builds the same genesis block from the same data.
 func Genesis(coinbase *Transaction) (*Block, error) {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, GENESIS_TIMESTAMP)
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) (*Block, error) {
+// CreateBlock mines a block stamped with timestamp, in Unix nanoseconds.
+// The caller picks the time so that nodes on a simulated clock mine the
+// same blocks every run.
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, timestamp int64) (*Block, error) {
 
 	block := &Block{
-		Timestamp:    time.Now().UnixNano(),
+		Timestamp:    timestamp,
 		Height:       height,
 		Nonce:        0,
 		PrevHash:     prevHash,
@@ -137,10 +138,12 @@ func CreateBlock(txs []*Transaction, prevHash []byte, height int) (*Block, error
 func DeserializeBlock(data []byte) (*Block, error) {
 
 	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
 
-	if err := decoder.Decode(&block); err != nil {
-		return nil, fmt.Errorf("failed to decode and deserialize bytes in to Block")
+	d := decoder{buf: data}
+	block.decode(&d)
+
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("failed to decode and deserialize bytes in to Block: %w", err)
 	}
 
 	return &block, nil
@@ -13,15 +13,24 @@ import (
 
 	"github.com/dgraph-io/badger"
 	"github.com/i101dev/blockchain-Tensor/util"
-	"github.com/i101dev/blockchain-Tensor/wallet"
 )
 
 const (
 	DB_PATH       = "../tmp/blocks_%d"
 	LAST_HASH_KEY = "lastHash"
 	GENESIS_DATA  = "GENESIS"
+
+	GENESIS_TIMESTAMP = 0
 )
 
+// ErrOrphanBlock is returned by AddBlock for a block whose parent is not
+// in the database yet.
+var ErrOrphanBlock = errors.New("parent block is not known")
+
+// ErrOldStore is returned when loading a store whose blocks this version
+// cannot decode, such as one written with gob or an older block version.
+var ErrOldStore = errors.New("block store was written by an older version")
+
 type NullLogger struct{}
 
 func (l *NullLogger) Errorf(string, ...interface{})   {}
@@ -114,18 +123,26 @@ func (chain *Blockchain) PostBlockToDB(lastHash []byte, newBlock *Block, db *bad
 //		return newBlock, err
 //	}
 
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
+func (chain *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	return chain.MineBlockAt(transactions, time.Now())
+}
+
+// MineBlockAt mines transactions on top of the tip as of now. The block is
+// stamped with now, or just after the tip's median time past if now is not
+// later than that. Nothing is mined if a transaction is invalid or not yet
+// final.
+func (chain *Blockchain) MineBlockAt(transactions []*Transaction, now time.Time) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
 
 	for _, tx := range transactions {
 		if !chain.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
+			return nil, fmt.Errorf("transaction %x is invalid", tx.ID)
 		}
 	}
 
 	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
+		item, err := txn.Get([]byte(LAST_HASH_KEY))
 		util.Handle(err, "MineBlock 1")
 		lastHash, _ = item.ValueCopy(nil)
 
@@ -133,21 +150,33 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 		util.Handle(err, "MineBlock 2")
 		lastBlockData, _ := item.ValueCopy(nil)
 
-		lastBlock, _ := DeserializeBlock(lastBlockData)
+		lastBlock, err := DeserializeBlock(lastBlockData)
+		if err != nil {
+			return err
+		}
 
 		lastHeight = lastBlock.Height
 
-		return err
+		return nil
 	})
 
 	util.Handle(err, "MineBlock 3")
 
-	newBlock, _ := CreateBlock(transactions, lastHash, lastHeight+1)
+	for _, tx := range transactions {
+		if err := chain.CheckTxLocks(tx); err != nil {
+			return nil, fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+	}
+
+	timestamp, err := chain.nextBlockTime(lastHash, now)
+	util.Handle(err, "MineBlock 6")
+
+	newBlock, _ := CreateBlock(transactions, lastHash, lastHeight+1, timestamp)
 
 	err = chain.Database.Update(func(txn *badger.Txn) error {
 		err := txn.Set(newBlock.Hash, newBlock.Serialize())
 		util.Handle(err, "MineBlock 4")
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+		err = txn.Set([]byte(LAST_HASH_KEY), newBlock.Hash)
 
 		chain.LastHash = newBlock.Hash
 
@@ -155,23 +184,69 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	})
 	util.Handle(err, "MineBlock 5")
 
-	return newBlock
+	return newBlock, nil
 }
 
 func (chain *Blockchain) AddBlock(block *Block) (*Block, error) {
+	return chain.AddBlockAt(block, time.Now())
+}
+
+// AddBlockAt stores block, and makes it the tip if it is higher than the
+// current one. A block whose parent is known must be stamped after the
+// parent's median time past and no more than MAX_FUTURE_BLOCK_TIME after
+// now, and its transactions must pass their lock and script checks.
+func (chain *Blockchain) AddBlockAt(block *Block, now time.Time) (*Block, error) {
 
 	var b Block
 
+	for _, tx := range block.Transactions {
+		if err := tx.CheckDataOutputs(); err != nil {
+			return nil, fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+	}
+
+	if len(block.PrevHash) > 0 && chain.HasBlock(block.PrevHash) {
+		if err := chain.checkBlockTime(block, now); err != nil {
+			return nil, err
+		}
+
+		if err := chain.checkBlockLocks(block); err != nil {
+			return nil, err
+		}
+
+		if err := chain.checkBlockScripts(block); err != nil {
+			return nil, err
+		}
+	}
+
 	err := chain.Database.Update(func(txn *badger.Txn) error {
 		if _, err := txn.Get(block.Hash); err == nil {
 			return nil
 		}
 
+		// Only genesis may come without a parent we already store
+		if len(block.PrevHash) > 0 {
+			item, err := txn.Get(block.PrevHash)
+			if err != nil {
+				return ErrOrphanBlock
+			}
+
+			parentData, _ := item.ValueCopy(nil)
+			parent, err := DeserializeBlock(parentData)
+			if err != nil {
+				return err
+			}
+
+			if block.Height != parent.Height+1 {
+				return fmt.Errorf("block height %d does not follow parent height %d", block.Height, parent.Height)
+			}
+		}
+
 		blockData := block.Serialize()
 		err := txn.Set(block.Hash, blockData)
 		util.Handle(err, "AddBlock 1")
 
-		item, err := txn.Get([]byte("lh"))
+		item, err := txn.Get([]byte(LAST_HASH_KEY))
 		util.Handle(err, "AddBlock 2")
 		lastHash, _ := item.ValueCopy(nil)
 
@@ -179,10 +254,13 @@ func (chain *Blockchain) AddBlock(block *Block) (*Block, error) {
 		util.Handle(err, "AddBlock 3")
 		lastBlockData, _ := item.ValueCopy(nil)
 
-		lastBlock, _ := DeserializeBlock(lastBlockData)
+		lastBlock, err := DeserializeBlock(lastBlockData)
+		if err != nil {
+			return err
+		}
 
 		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
+			err = txn.Set([]byte(LAST_HASH_KEY), block.Hash)
 			util.Handle(err, "AddBlock 4")
 			chain.LastHash = block.Hash
 		}
@@ -192,9 +270,166 @@ func (chain *Blockchain) AddBlock(block *Block) (*Block, error) {
 		return nil
 	})
 
-	util.Handle(err, "AddBlock 5")
+	if err != nil {
+		return nil, err
+	}
 
-	return &b, err
+	return &b, nil
+}
+
+// ErrBadCoinbase is returned for a block without exactly one coinbase, or
+// whose coinbase pays out more than COINBASE_SUBSIDY and the fees.
+var ErrBadCoinbase = errors.New("invalid coinbase")
+
+// checkBlockScripts checks that every transaction in block matches its ID
+// and runs its unlocking scripts against the outputs they spend, which can
+// be earlier in the same block or anywhere on the block's own branch. The
+// proof of work commits to the scripts; this checks they are valid. Each
+// output may be spent once on the branch, and the block's one coinbase may
+// claim the subsidy and the fees and no more.
+func (chain *Blockchain) checkBlockScripts(block *Block) error {
+
+	spent := make(map[string][]byte)
+
+	var coinbase *Transaction
+	fees := 0
+
+	for i, tx := range block.Transactions {
+
+		if !bytes.Equal(tx.ComputeID(), tx.ID) {
+			return fmt.Errorf("transaction %x does not match its ID", tx.ID)
+		}
+
+		if tx.IsCoinbase() {
+			if coinbase != nil {
+				return fmt.Errorf("%w: block has more than one", ErrBadCoinbase)
+			}
+			coinbase = tx
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			if spender, ok := spent[in.OutpointKey()]; ok {
+				return fmt.Errorf("transaction %x: %w: %s is already spent by %x", tx.ID, ErrDuplicateInput, in.OutpointKey(), spender)
+			}
+			spent[in.OutpointKey()] = tx.ID
+		}
+
+		prevTXs := make(map[string]Transaction)
+
+		for _, in := range tx.Inputs {
+			prevTX, err := chain.findBranchTransaction(block, i, in.ID)
+			if err != nil {
+				return fmt.Errorf("transaction %x: input spends unknown transaction %x", tx.ID, in.ID)
+			}
+			prevTXs[hex.EncodeToString(prevTX.ID)] = *prevTX
+		}
+
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("transaction %x does not verify", tx.ID)
+		}
+
+		// Verify has checked every input spends an existing output
+		for _, in := range tx.Inputs {
+			fees += prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out].Value
+		}
+		for _, out := range tx.Outputs {
+			fees -= out.Value
+		}
+	}
+
+	if coinbase == nil {
+		return fmt.Errorf("%w: block has none", ErrBadCoinbase)
+	}
+
+	paid := 0
+	for _, out := range coinbase.Outputs {
+		if out.Value < 0 {
+			return fmt.Errorf("%w: negative output", ErrBadCoinbase)
+		}
+		paid += out.Value
+	}
+
+	if paid > COINBASE_SUBSIDY+fees {
+		return fmt.Errorf("%w: pays %d, more than the subsidy %d and fees %d", ErrBadCoinbase, paid, COINBASE_SUBSIDY, fees)
+	}
+
+	if outpoint, spender, ok := chain.spentOnBranch(block.PrevHash, spent); ok {
+		return fmt.Errorf("transaction %x: %w: %s is already spent by %x", spent[outpoint], ErrDuplicateInput, outpoint, spender)
+	}
+
+	return nil
+}
+
+// spentOnBranch looks for a transaction on the branch ending at tip that
+// spends one of the outpoints, keyed by TxInput.OutpointKey. It returns
+// the first it finds with its spender.
+func (chain *Blockchain) spentOnBranch(tip []byte, outpoints map[string][]byte) (string, []byte, bool) {
+
+	iter := &BlockchainIterator{
+		CurrentHash: tip,
+		Database:    chain.Database,
+		Chain:       chain,
+	}
+
+	for {
+		block, err := iter.IterateNext()
+		if err != nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+
+			for _, in := range tx.Inputs {
+				if _, ok := outpoints[in.OutpointKey()]; ok {
+					return in.OutpointKey(), tx.ID, true
+				}
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return "", nil, false
+}
+
+// findBranchTransaction finds the transaction with the given ID among the
+// first before transactions of block, or on the branch block builds on.
+func (chain *Blockchain) findBranchTransaction(block *Block, before int, ID []byte) (*Transaction, error) {
+
+	for _, tx := range block.Transactions[:before] {
+		if bytes.Equal(tx.ID, ID) {
+			return tx, nil
+		}
+	}
+
+	prevBlock, err := chain.findTransactionBlockFrom(block.PrevHash, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range prevBlock.Transactions {
+		if bytes.Equal(tx.ID, ID) {
+			return tx, nil
+		}
+	}
+
+	return nil, errors.New("Transaction does not exist")
+}
+
+func (chain *Blockchain) HasBlock(blockHash []byte) bool {
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockHash)
+		return err
+	})
+
+	return err == nil
 }
 
 func (chain *Blockchain) GetBlock(blockHash []byte) (*Block, error) {
@@ -304,9 +539,9 @@ func (chain *Blockchain) GetBestHeight() int {
 		util.Handle(err, "GetBestHeight 2")
 		lastBlockData, _ := item.ValueCopy(nil)
 
-		lastBlock, _ = DeserializeBlock(lastBlockData)
+		lastBlock, err = DeserializeBlock(lastBlockData)
 
-		return nil
+		return err
 	})
 
 	util.Handle(err, "GetBestHeight 3")
@@ -314,6 +549,29 @@ func (chain *Blockchain) GetBestHeight() int {
 	return lastBlock.Height
 }
 
+// OnBestChain reports whether the block with the given hash is the tip or
+// one of its ancestors.
+func (chain *Blockchain) OnBestChain(hash []byte) bool {
+
+	target, err := chain.GetBlock(hash)
+	if err != nil {
+		return false
+	}
+
+	iter := chain.NewIterator()
+
+	for {
+		block, err := iter.IterateNext()
+		if err != nil || block.Height < target.Height {
+			return false
+		}
+
+		if block.Height == target.Height {
+			return bytes.Equal(block.Hash, target.Hash)
+		}
+	}
+}
+
 func (chain *Blockchain) GetUnspentOutputs(db *badger.DB, address string) ([]*TxOutput, error) {
 
 	var utxoSet []*TxOutput
@@ -331,7 +589,7 @@ func (chain *Blockchain) GetUnspentOutputs(db *badger.DB, address string) ([]*Tx
 
 			for _, out := range tx.Outputs {
 
-				if wallet.PubKeyHashToAddr(out.PubKeyHash) == address {
+				if out.Address() == address {
 					utxoSet = append(utxoSet, &out)
 				}
 			}
@@ -365,6 +623,97 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction does not exist")
 }
 
+// FindTransactionBlock returns the block the transaction with the given
+// ID was confirmed in.
+func (chain *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
+	return chain.findTransactionBlockFrom(chain.LastHash, ID)
+}
+
+// findTransactionBlockFrom is FindTransactionBlock on the branch ending at
+// the block with hash tip, which need not be the main chain.
+func (chain *Blockchain) findTransactionBlockFrom(tip []byte, ID []byte) (*Block, error) {
+
+	iter := &BlockchainIterator{
+		CurrentHash: tip,
+		Database:    chain.Database,
+		Chain:       chain,
+	}
+
+	for {
+		block, err := iter.IterateNext()
+		if err != nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, nil
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil, errors.New("Transaction does not exist")
+}
+
+// FindSpendingTransaction returns the confirmed transaction that spends
+// output out of the transaction with the given ID.
+func (chain *Blockchain) FindSpendingTransaction(ID []byte, out int) (Transaction, error) {
+
+	iter := chain.NewIterator()
+
+	for {
+		block, err := iter.IterateNext()
+		if err != nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			for _, in := range tx.Inputs {
+				if in.Out == out && bytes.Equal(in.ID, ID) {
+					return *tx, nil
+				}
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return Transaction{}, errors.New("Output is not spent")
+}
+
+// MissingParents returns the IDs of the transactions tx spends from that
+// are not in the chain.
+func (bc *Blockchain) MissingParents(tx *Transaction) [][]byte {
+
+	var missing [][]byte
+
+	if tx.IsCoinbase() {
+		return missing
+	}
+
+	seen := make(map[string]bool)
+
+	for _, in := range tx.Inputs {
+		id := hex.EncodeToString(in.ID)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if _, err := bc.FindTransaction(in.ID); err != nil {
+			missing = append(missing, in.ID)
+		}
+	}
+
+	return missing
+}
+
 func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
 
 	prevTXs := make(map[string]Transaction)
@@ -381,8 +730,32 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 	tx.Sign(privKey, prevTXs)
 }
 
+// PreviousTransactions finds the transactions whose outputs tx spends,
+// keyed by hex ID as Sign and Verify expect.
+func (bc *Blockchain) PreviousTransactions(tx *Transaction) (map[string]Transaction, error) {
+
+	prevTXs := make(map[string]Transaction)
+
+	for _, in := range tx.Inputs {
+
+		prevTX, err := bc.FindTransaction(in.ID)
+		if err != nil {
+			return nil, fmt.Errorf("input spends unknown transaction %x", in.ID)
+		}
+
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	return prevTXs, nil
+}
+
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 
+	if err := tx.CheckDataOutputs(); err != nil {
+		fmt.Printf("transaction %x: %s\n", tx.ID, err)
+		return false
+	}
+
 	if tx.IsCoinbase() {
 		return true
 	}
@@ -401,6 +774,61 @@ func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	return tx.Verify(prevTXs)
 }
 
+// ErrOutputSpent is returned for a transaction spending an output a block
+// on the main chain already spends.
+var ErrOutputSpent = errors.New("output already spent")
+
+// CheckPoolTransaction checks that tx may go into the memory pool: it
+// matches its ID, spends outputs of transactions in the chain or in the
+// pool, as pooled finds them, none of them spent on the main chain, and
+// its scripts and values verify. Conflicts with other pooled transactions
+// are the pool's to settle.
+func (bc *Blockchain) CheckPoolTransaction(tx *Transaction, pooled func(ID []byte) (Transaction, bool)) error {
+
+	if !bytes.Equal(tx.ComputeID(), tx.ID) {
+		return fmt.Errorf("transaction %x does not match its ID", tx.ID)
+	}
+
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: transaction %x is not in a block", ErrBadCoinbase, tx.ID)
+	}
+
+	if err := tx.CheckDataOutputs(); err != nil {
+		return fmt.Errorf("transaction %x: %w", tx.ID, err)
+	}
+
+	if err := tx.CheckDuplicateInputs(); err != nil {
+		return fmt.Errorf("transaction %x: %w", tx.ID, err)
+	}
+
+	prevTXs := make(map[string]Transaction)
+	outpoints := make(map[string][]byte)
+
+	for _, in := range tx.Inputs {
+
+		prevTX, err := bc.FindTransaction(in.ID)
+		if err != nil {
+			var ok bool
+			if prevTX, ok = pooled(in.ID); !ok {
+				return fmt.Errorf("transaction %x: input spends unknown transaction %x", tx.ID, in.ID)
+			}
+		}
+
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		outpoints[in.OutpointKey()] = tx.ID
+	}
+
+	if outpoint, spender, ok := bc.spentOnBranch(bc.LastHash, outpoints); ok {
+		return fmt.Errorf("transaction %x: %w: %s is spent by %x", tx.ID, ErrOutputSpent, outpoint, spender)
+	}
+
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("transaction %x does not verify", tx.ID)
+	}
+
+	return nil
+}
+
 // -----------------------------------------------------------------------
 func OpenDB(chain *Blockchain) *badger.DB {
 
@@ -428,8 +856,19 @@ func NewChain(nodeID uint16) *Blockchain {
 }
 
 func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
+	return LoadBlockchainAt(fmt.Sprintf(DB_PATH, nodeID), address)
+}
 
-	path := fmt.Sprintf(DB_PATH, nodeID)
+// LoadBlockchainAt opens the chain stored in path, creating the genesis
+// block paying address if the store is empty.
+func LoadBlockchainAt(path, address string) (*Blockchain, error) {
+	return LoadBlockchainWithGenesis(path, address, GENESIS_DATA)
+}
+
+// LoadBlockchainWithGenesis is LoadBlockchainAt for a chain whose genesis
+// coinbase carries genesisData instead of GENESIS_DATA. Chains with
+// different genesis data share no blocks, so they are separate networks.
+func LoadBlockchainWithGenesis(path, address, genesisData string) (*Blockchain, error) {
 
 	// Ensure the directory exists ---------------------------
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
@@ -450,7 +889,7 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 		if _, err := dbTXN.Get([]byte(LAST_HASH_KEY)); err == badger.ErrKeyNotFound {
 
 			// ----------------------------------------------------------
-			cbtx := CoinbaseTX(address, GENESIS_DATA)
+			cbtx := CoinbaseTX(address, genesisData)
 			genesis, err := Genesis(cbtx)
 			if err != nil {
 				return err
@@ -474,18 +913,37 @@ func LoadBlockchain(address string, nodeID uint16) (*Blockchain, error) {
 		}
 
 		last, err := newChain.GetLastHash(db)
+		if err != nil {
+			return err
+		}
 
 		lastHash = last
 
-		return err
+		// Catch a store from an older version here, with a way out,
+		// rather than on the first block read
+		item, err := dbTXN.Get(lastHash)
+		if err != nil {
+			return err
+		}
+
+		lastBlockData, _ := item.ValueCopy(nil)
+		if _, err := DeserializeBlock(lastBlockData); err != nil {
+			return fmt.Errorf("%w: delete %s and restart to resync (%v)", ErrOldStore, path, err)
+		}
+
+		return nil
 	})
 
+	if err != nil {
+		return nil, err
+	}
+
 	newChain.LastHash = lastHash
 
 	UTXOSet := UTXOSet{newChain}
 	UTXOSet.Reindex()
 
-	return newChain, err
+	return newChain, nil
 }
 
 func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
@@ -516,8 +974,10 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 				}
 
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				outs.add(outIdx, out)
+				if len(outs.Outputs) > 0 {
+					UTXO[txID] = outs
+				}
 			}
 
 			if !tx.IsCoinbase() {
@@ -0,0 +1,147 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A data output carries up to MAX_DATA_SIZE bytes of arbitrary data, such
+// as a document hash, in a locking script nothing can satisfy:
+//
+//	OP_RETURN <data>
+//
+// Since it can never be spent it holds no value and is left out of the
+// UTXO set. A transaction may have one, and it is otherwise an ordinary
+// transaction, so its inclusion in a block is proven the same way.
+const MAX_DATA_SIZE = 80
+
+var ErrBadDataOutput = errors.New("invalid data output")
+
+// DataScript is the locking script of a data output carrying data.
+func DataScript(data []byte) ([]byte, error) {
+	if len(data) > MAX_DATA_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes is over the limit of %d", ErrBadDataOutput, len(data), MAX_DATA_SIZE)
+	}
+
+	builder := NewScriptBuilder().AddOp(OP_RETURN)
+	if len(data) > 0 {
+		builder.AddData(data)
+	}
+
+	return builder.Script(), nil
+}
+
+// ExtractData returns the data a data output's locking script carries.
+func ExtractData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil, false
+	}
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) > 2 {
+		return nil, false
+	}
+
+	var data []byte
+	if len(ops) == 2 {
+		if !ops[1].isPush() {
+			return nil, false
+		}
+		data = ops[1].Data
+	}
+
+	// Only the shortest encoding, so the same data has one script
+	if rebuilt, err := DataScript(data); err != nil || !bytes.Equal(rebuilt, script) {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// NewDataOutput is a zero value output carrying data.
+func NewDataOutput(data []byte) (*TxOutput, error) {
+	script, err := DataScript(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxOutput{Value: 0, LockScript: script}, nil
+}
+
+// IsUnspendable reports whether no input can ever spend the output, which
+// keeps it out of the UTXO set.
+func (out *TxOutput) IsUnspendable() bool {
+	return (len(out.LockScript) > 0 && out.LockScript[0] == OP_RETURN) || len(out.LockScript) > MAX_SCRIPT_SIZE
+}
+
+// Data returns what the transaction's data output carries, if it has one.
+func (t *Transaction) Data() ([]byte, bool) {
+	for _, out := range t.Outputs {
+		if data, ok := ExtractData(out.LockScript); ok {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// FindAnchor returns the earliest transaction on the main chain with a
+// data output carrying data, and the block it is in.
+func (chain *Blockchain) FindAnchor(data []byte) (*Transaction, *Block, error) {
+
+	var anchor *Transaction
+	var anchorBlock *Block
+
+	iter := chain.NewIterator()
+
+	for {
+		block, err := iter.IterateNext()
+		if err != nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			if txData, ok := tx.Data(); ok && bytes.Equal(txData, data) {
+				anchor, anchorBlock = tx, block
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	if anchor == nil {
+		return nil, nil, errors.New("Data is not anchored")
+	}
+
+	return anchor, anchorBlock, nil
+}
+
+// CheckDataOutputs checks that the transaction has at most one data
+// output, within the size limit and without value. Value paid to an
+// OP_RETURN script would be lost.
+func (t *Transaction) CheckDataOutputs() error {
+	found := false
+
+	for outIdx, out := range t.Outputs {
+		if !out.IsUnspendable() {
+			continue
+		}
+
+		if _, ok := ExtractData(out.LockScript); !ok {
+			return fmt.Errorf("%w: output %d is unspendable but not a data output of at most %d bytes", ErrBadDataOutput, outIdx, MAX_DATA_SIZE)
+		}
+
+		if out.Value != 0 {
+			return fmt.Errorf("%w: output %d burns %d", ErrBadDataOutput, outIdx, out.Value)
+		}
+
+		if found {
+			return fmt.Errorf("%w: more than one data output", ErrBadDataOutput)
+		}
+		found = true
+	}
+
+	return nil
+}
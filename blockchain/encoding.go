@@ -0,0 +1,259 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Transactions and blocks are hashed, stored and relayed in one canonical
+// binary format, so they can be reproduced without Go:
+//
+//	uvarint  unsigned LEB128, as encoding/binary's PutUvarint
+//	varint   signed, zigzag encoded then written as a uvarint
+//	bytes    uvarint length followed by that many bytes
+//
+//	transaction = uvarint version (3)
+//	              bytes   id
+//	              uvarint input count,  then per input:
+//	                  bytes id, varint out, bytes unlocking script,
+//	                  uvarint sequence
+//	              uvarint output count, then per output:
+//	                  varint value, bytes locking script
+//	              varint  lock time
+//
+//	block       = uvarint version (2)
+//	              varint  timestamp, varint height, varint nonce
+//	              bytes   prev hash, bytes hash
+//	              uvarint transaction count, then per transaction:
+//	                  bytes transaction
+//
+// Fields are always written in this order. Varints must be minimally
+// encoded and nothing may follow the last field, so every value has
+// exactly one encoding. Empty byte strings decode as nil. Version 2 blocks
+// are laid out like version 1 but hashed over the merkle root in merkle.go,
+// which covers unlocking scripts.
+const (
+	TX_VERSION    = 3
+	BLOCK_VERSION = 2
+)
+
+var ErrBadEncoding = errors.New("malformed encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder reads what encoder wrote. The first failure sticks, so callers
+// read every field and check err once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+	d.buf = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("truncated or overflowing varint")
+		return 0
+	}
+
+	if n != len(binary.AppendUvarint(nil, v)) {
+		d.fail("varint is not minimally encoded")
+		return 0
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	u := d.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// int reads a varint into a Go int, refusing values that don't fit.
+func (d *decoder) int() int {
+	v := d.varint()
+	if int64(int(v)) != v {
+		d.fail("value %d out of range", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) uint32() uint32 {
+	v := d.uvarint()
+	if v > math.MaxUint32 {
+		d.fail("value %d out of range", v)
+		return 0
+	}
+	return uint32(v)
+}
+
+// count reads the length of a list whose elements take at least min
+// bytes each, so a forged count can't make us allocate more than the
+// input could possibly hold.
+func (d *decoder) count(min int) int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)/min) {
+		d.fail("count %d exceeds the remaining input", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail("length %d exceeds the remaining input", n)
+		return nil
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	b := append([]byte(nil), d.buf[:n]...)
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) version(want uint64, what string) {
+	if v := d.uvarint(); d.err == nil && v != want {
+		d.fail("unknown %s version %d", what, v)
+	}
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("%d trailing bytes", len(d.buf))
+	}
+	return d.err
+}
+
+// -------------------------------------------------------------
+
+func (t *Transaction) encode(e *encoder) {
+	e.uvarint(TX_VERSION)
+	e.bytes(t.ID)
+
+	e.uvarint(uint64(len(t.Inputs)))
+	for _, in := range t.Inputs {
+		e.bytes(in.ID)
+		e.varint(int64(in.Out))
+		e.bytes(in.UnlockScript)
+		e.uvarint(uint64(in.Sequence))
+	}
+
+	e.uvarint(uint64(len(t.Outputs)))
+	for _, out := range t.Outputs {
+		e.varint(int64(out.Value))
+		e.bytes(out.LockScript)
+	}
+
+	e.varint(t.LockTime)
+}
+
+func (t *Transaction) decode(d *decoder) {
+	d.version(TX_VERSION, "transaction")
+	t.ID = d.bytes()
+
+	// An input is at least four one byte fields, an output two
+	t.Inputs = nil
+	if n := d.count(4); n > 0 {
+		t.Inputs = make([]TxInput, n)
+		for i := range t.Inputs {
+			t.Inputs[i].ID = d.bytes()
+			t.Inputs[i].Out = d.int()
+			t.Inputs[i].UnlockScript = d.bytes()
+			t.Inputs[i].Sequence = d.uint32()
+		}
+	}
+
+	t.Outputs = nil
+	if n := d.count(2); n > 0 {
+		t.Outputs = make([]TxOutput, n)
+		for i := range t.Outputs {
+			t.Outputs[i].Value = d.int()
+			t.Outputs[i].LockScript = d.bytes()
+		}
+	}
+
+	t.LockTime = d.varint()
+}
+
+// DecodeTransaction parses a transaction from its canonical encoding.
+// Use it for anything that came from outside the node.
+func DecodeTransaction(data []byte) (Transaction, error) {
+	var tx Transaction
+
+	d := decoder{buf: data}
+	tx.decode(&d)
+
+	if err := d.finish(); err != nil {
+		return Transaction{}, err
+	}
+
+	return tx, nil
+}
+
+func (b *Block) encode(e *encoder) {
+	e.uvarint(BLOCK_VERSION)
+	e.varint(b.Timestamp)
+	e.varint(int64(b.Height))
+	e.varint(int64(b.Nonce))
+	e.bytes(b.PrevHash)
+	e.bytes(b.Hash)
+
+	e.uvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.bytes(tx.Serialize())
+	}
+}
+
+func (b *Block) decode(d *decoder) {
+	d.version(BLOCK_VERSION, "block")
+	b.Timestamp = d.varint()
+	b.Height = d.int()
+	b.Nonce = d.int()
+	b.PrevHash = d.bytes()
+	b.Hash = d.bytes()
+
+	b.Transactions = nil
+	if n := d.count(1); n > 0 {
+		b.Transactions = make([]*Transaction, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			tx, err := DecodeTransaction(d.bytes())
+			if err != nil && d.err == nil {
+				d.err, d.buf = fmt.Errorf("transaction %d: %w", i, err), nil
+			}
+			b.Transactions = append(b.Transactions, &tx)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+const testAddress = "1CdnbM5PaWJRWMcMghkCoNPQaURHRsxFtj"
+
+// seedBlocks are real blocks to start the fuzzers from: genesis and a
+// mined block spending its coinbase.
+func seedBlocks(t testing.TB) []*Block {
+	t.Helper()
+
+	genesis, err := Genesis(CoinbaseTX(testAddress, GENESIS_DATA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := genesis.Transactions[0]
+	spend := &Transaction{
+		Inputs: []TxInput{{ID: cb.ID, Out: 0, UnlockScript: P2PKHUnlockScript(bytes.Repeat([]byte{0x30}, 70), bytes.Repeat([]byte{0x02}, 33)), Sequence: 7}},
+		Outputs: []TxOutput{
+			*NewTXOutput(15, testAddress),
+			{Value: 5, LockScript: TimeLockScript(1700000000, cb.Outputs[0].LockScript)},
+		},
+		LockTime: 42,
+	}
+	spend.ID = spend.ComputeID()
+
+	block, err := CreateBlock([]*Transaction{CoinbaseTX(testAddress, "seed"), spend}, genesis.Hash, 1, 1700000000000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*Block{genesis, block}
+}
+
+func FuzzDecodeTransaction(f *testing.F) {
+	for _, b := range seedBlocks(f) {
+		for _, tx := range b.Transactions {
+			f.Add(tx.Serialize())
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tx, err := DecodeTransaction(data)
+		if err != nil {
+			return
+		}
+
+		// One encoding per value, so whatever decodes encodes back the same
+		if !bytes.Equal(tx.Serialize(), data) {
+			t.Fatalf("%x decodes but encodes as %x", data, tx.Serialize())
+		}
+	})
+}
+
+func FuzzDeserializeBlock(f *testing.F) {
+	for _, b := range seedBlocks(f) {
+		f.Add(b.Serialize())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := DeserializeBlock(data)
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal(block.Serialize(), data) {
+			t.Fatalf("%x decodes but encodes as %x", data, block.Serialize())
+		}
+
+		// Hashing a decoded block must not panic either
+		NewProof(block).Verify()
+	})
+}
+
+func TestLoadOldStore(t *testing.T) {
+	path := t.TempDir()
+
+	genesis := seedBlocks(t)[0]
+
+	// The same block as a version 1 store wrote it
+	old := genesis.Serialize()
+	old[0] = 1
+
+	opts := badger.DefaultOptions(path)
+	opts.Logger = &NullLogger{}
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(genesis.Hash, old); err != nil {
+			return err
+		}
+		return txn.Set([]byte(LAST_HASH_KEY), genesis.Hash)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadBlockchainAt(path, testAddress); !errors.Is(err, ErrOldStore) {
+		t.Fatalf("loading a version 1 store: %v, want ErrOldStore", err)
+	}
+}
@@ -0,0 +1,181 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// A hash time locked contract pays whoever shows the secret behind a hash
+// before a deadline, and can be taken back by its sender after it:
+//
+//	OP_IF
+//	    OP_SIZE <32> OP_EQUALVERIFY OP_SHA256 <secret hash> OP_EQUALVERIFY
+//	    OP_DUP OP_HASH160 <recipient key hash>
+//	OP_ELSE
+//	    <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP
+//	    OP_DUP OP_HASH160 <sender key hash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+//
+// It is paid to as a P2SH redeem script. The recipient claims with
+// <sig> <pubkey> <secret> OP_1 <redeem script>, the sender refunds with
+// <sig> <pubkey> OP_0 <redeem script> in a transaction whose lock time has
+// reached the contract's.
+//
+// Claiming puts the secret on chain, which is what makes a swap atomic:
+// two contracts locked to the same hash, the one the secret's owner claims
+// with the shorter deadline, so the other side has time to use the secret
+// once it shows up.
+
+const HTLC_SECRET_SIZE = 32
+
+var ErrBadHTLC = errors.New("invalid HTLC")
+
+type HTLC struct {
+	SecretHash []byte
+	Recipient  []byte // key hash that can claim with the secret
+	Sender     []byte // key hash that can refund after LockTime
+	LockTime   int64
+}
+
+// Script is the contract's redeem script.
+func (h *HTLC) Script() ([]byte, error) {
+	if len(h.SecretHash) != sha256.Size || len(h.Recipient) != 20 || len(h.Sender) != 20 {
+		return nil, fmt.Errorf("%w: bad hash or key hash", ErrBadHTLC)
+	}
+
+	if h.LockTime <= 0 {
+		return nil, fmt.Errorf("%w: lock time %d", ErrBadHTLC, h.LockTime)
+	}
+
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(HTLC_SECRET_SIZE).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(h.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.Recipient).
+		AddOp(OP_ELSE).
+		AddInt(h.LockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(h.Sender).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script(), nil
+}
+
+// ExtractHTLC reads the contract back out of a redeem script.
+func ExtractHTLC(script []byte) (*HTLC, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return nil, false
+	}
+
+	var lockTime int64
+	switch {
+	case ops[11].Code >= OP_1 && ops[11].Code <= OP_16:
+		lockTime = int64(ops[11].Code-OP_1) + 1
+	case ops[11].Data != nil:
+		if lockTime, err = decodeScriptNum(ops[11].Data, 5); err != nil {
+			return nil, false
+		}
+	}
+
+	h := &HTLC{
+		SecretHash: ops[5].Data,
+		Recipient:  ops[9].Data,
+		Sender:     ops[16].Data,
+		LockTime:   lockTime,
+	}
+
+	// Anything that doesn't rebuild to the same bytes isn't one of ours
+	if rebuilt, err := h.Script(); err != nil || !bytes.Equal(rebuilt, script) {
+		return nil, false
+	}
+
+	return h, true
+}
+
+// NewHTLCSpend builds a transaction moving every output of fundingTX paid
+// to the contract in redeemScript to address to. With the secret it is
+// the recipient's claim, without it the sender's refund, and privKey has
+// to be theirs.
+func NewHTLCSpend(redeemScript []byte, fundingTX *Transaction, to string, secret []byte, privKey ecdsa.PrivateKey) (*Transaction, error) {
+
+	h, ok := ExtractHTLC(redeemScript)
+	if !ok {
+		return nil, ErrBadHTLC
+	}
+
+	claim := secret != nil
+	var pubKey []byte
+
+	if claim {
+		if hash := sha256.Sum256(secret); !bytes.Equal(hash[:], h.SecretHash) {
+			return nil, fmt.Errorf("%w: secret does not match the hash", ErrBadHTLC)
+		}
+		if pubKey = pubKeyFor(&privKey, h.Recipient); pubKey == nil {
+			return nil, fmt.Errorf("%w: key is not the recipient's", ErrBadHTLC)
+		}
+	} else if pubKey = pubKeyFor(&privKey, h.Sender); pubKey == nil {
+		return nil, fmt.Errorf("%w: key is not the sender's", ErrBadHTLC)
+	}
+
+	if err := CheckRedeemScript(redeemScript); err != nil {
+		return nil, err
+	}
+
+	lockScript := P2SHScript(ScriptHash(redeemScript))
+
+	var inputs []TxInput
+	value := 0
+
+	for outIdx, out := range fundingTX.Outputs {
+		if bytes.Equal(out.LockScript, lockScript) {
+			inputs = append(inputs, TxInput{outIdx, fundingTX.ID, nil, 0})
+			value += out.Value
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%w: transaction %x doesn't pay the contract", ErrBadHTLC, fundingTX.ID)
+	}
+
+	tx := Transaction{nil, inputs, []TxOutput{*NewTXOutput(value, to)}, 0}
+	if !claim {
+		tx.LockTime = h.LockTime
+	}
+	tx.ID = tx.ComputeID()
+
+	for inId := range tx.Inputs {
+		sig, err := tx.signInput(&privKey, inId, redeemScript, SIGHASH_ALL)
+		if err != nil {
+			return nil, err
+		}
+
+		builder := NewScriptBuilder().AddData(sig).AddData(pubKey)
+
+		if claim {
+			builder.AddData(secret).AddInt(1)
+		} else {
+			builder.AddInt(0)
+		}
+
+		tx.Inputs[inId].UnlockScript = builder.AddData(redeemScript).Script()
+	}
+
+	return &tx, nil
+}
+
+// ExtractHTLCSecret returns the secret behind secretHash if one of tx's
+// inputs reveals it, nil otherwise.
+func ExtractHTLCSecret(tx *Transaction, secretHash []byte) []byte {
+	for _, in := range tx.Inputs {
+		for _, push := range ScriptPushes(in.UnlockScript) {
+			if hash := sha256.Sum256(push); bytes.Equal(hash[:], secretHash) {
+				return push
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+var ErrScriptFailed = errors.New("script failed")
+
+// scriptEngine runs the scripts of one transaction input.
+type scriptEngine struct {
+	tx     *Transaction
+	index  int
+	stack  [][]byte
+	numOps int
+}
+
+// VerifyScript checks that unlock satisfies lock for input index of tx.
+// The unlocking script may only push data, so nothing in it can change
+// what the locking script goes on to check. For a P2SH lock, the last
+// thing pushed is the redeem script: once its hash has matched, it runs
+// on the rest of the pushed data and has to succeed as well.
+func VerifyScript(unlock, lock []byte, tx *Transaction, index int) error {
+
+	unlockOps, err := parseScript(unlock)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range unlockOps {
+		if !op.isPush() {
+			return fmt.Errorf("%w: unlocking script may only push data", ErrScriptFailed)
+		}
+	}
+
+	lockOps, err := parseScript(lock)
+	if err != nil {
+		return err
+	}
+
+	e := &scriptEngine{tx: tx, index: index}
+
+	if err := e.run(unlockOps, unlock); err != nil {
+		return err
+	}
+
+	pushed := append([][]byte(nil), e.stack...)
+
+	if err := e.run(lockOps, lock); err != nil {
+		return err
+	}
+
+	if err := e.checkResult(); err != nil {
+		return err
+	}
+
+	if _, ok := ExtractScriptHash(lock); !ok {
+		return nil
+	}
+
+	if len(pushed) == 0 {
+		return e.fail("no redeem script")
+	}
+
+	redeem := pushed[len(pushed)-1]
+
+	redeemOps, err := parseScript(redeem)
+	if err != nil {
+		return err
+	}
+
+	e.stack = pushed[:len(pushed)-1]
+
+	if err := e.run(redeemOps, redeem); err != nil {
+		return err
+	}
+
+	return e.checkResult()
+}
+
+func (e *scriptEngine) checkResult() error {
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return e.fail("finished without a true value on the stack")
+	}
+	return nil
+}
+
+func (e *scriptEngine) fail(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrScriptFailed, fmt.Sprintf(format, args...))
+}
+
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, e.fail("stack is empty")
+	}
+
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+
+	return top, nil
+}
+
+func (e *scriptEngine) popNum() (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, 4)
+}
+
+// peekLock reads the lock a timelock opcode checks, which stays on the
+// stack. Lock times may need five bytes.
+func (e *scriptEngine) peekLock() (int64, error) {
+	if len(e.stack) == 0 {
+		return 0, e.fail("stack is empty")
+	}
+
+	lock, err := decodeScriptNum(e.stack[len(e.stack)-1], 5)
+	if err != nil {
+		return 0, err
+	}
+
+	if lock < 0 {
+		return 0, e.fail("negative lock %d", lock)
+	}
+
+	return lock, nil
+}
+
+// run executes one script. script is the raw form of ops, which is what
+// signatures checked by it commit to.
+func (e *scriptEngine) run(ops []scriptOp, script []byte) error {
+
+	// One entry per open OP_IF, true while its branch is being executed
+	var cond []bool
+
+	e.numOps = 0
+
+	executing := func() bool {
+		for _, c := range cond {
+			if !c {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+
+		if len(op.Data) > MAX_SCRIPT_ELEMENT_SIZE {
+			return e.fail("push of %d bytes is over the limit", len(op.Data))
+		}
+
+		if !op.isPush() {
+			e.numOps++
+			if e.numOps > MAX_SCRIPT_OPS {
+				return e.fail("more than %d operations", MAX_SCRIPT_OPS)
+			}
+		}
+
+		switch op.Code {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing() {
+				top, err := e.pop()
+				if err != nil {
+					return err
+				}
+				branch = castToBool(top) == (op.Code == OP_IF)
+			}
+			cond = append(cond, branch)
+			continue
+
+		case OP_ELSE:
+			if len(cond) == 0 {
+				return e.fail("OP_ELSE without OP_IF")
+			}
+			cond[len(cond)-1] = !cond[len(cond)-1]
+			continue
+
+		case OP_ENDIF:
+			if len(cond) == 0 {
+				return e.fail("OP_ENDIF without OP_IF")
+			}
+			cond = cond[:len(cond)-1]
+			continue
+		}
+
+		if !executing() {
+			continue
+		}
+
+		if err := e.step(op, script); err != nil {
+			return err
+		}
+
+		if len(e.stack) > MAX_STACK_SIZE {
+			return e.fail("stack holds more than %d items", MAX_STACK_SIZE)
+		}
+	}
+
+	if len(cond) != 0 {
+		return e.fail("OP_IF without OP_ENDIF")
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) step(op scriptOp, script []byte) error {
+
+	switch {
+	case op.Data != nil:
+		e.push(op.Data)
+		return nil
+	case op.Code == OP_0:
+		e.push(nil)
+		return nil
+	case op.Code == OP_1NEGATE:
+		e.push(encodeScriptNum(-1))
+		return nil
+	case op.Code >= OP_1 && op.Code <= OP_16:
+		e.push(encodeScriptNum(int64(op.Code - OP_1 + 1)))
+		return nil
+	}
+
+	switch op.Code {
+	case OP_VERIFY:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(top) {
+			return e.fail("OP_VERIFY failed")
+		}
+
+	case OP_RETURN:
+		return e.fail("OP_RETURN")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(top)
+		e.push(top)
+
+	case OP_SWAP:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(a)
+		e.push(b)
+
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return e.fail("stack is empty")
+		}
+		e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+
+		equal := bytes.Equal(a, b)
+		if op.Code == OP_EQUALVERIFY {
+			if !equal {
+				return e.fail("OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		e.pushBool(equal)
+
+	case OP_SHA256:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		e.push(hash[:])
+
+	case OP_HASH160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(wallet.PublicKeyHash(top))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+
+		if err := checkSigEncoding(sig); err != nil {
+			return e.fail("%s", err)
+		}
+		if _, err := wallet.ParsePublicKey(pubKey); err != nil {
+			return e.fail("%s", err)
+		}
+
+		ok := e.tx.checkInputSig(pubKey, sig, e.index, script)
+		if op.Code == OP_CHECKSIGVERIFY {
+			if !ok {
+				return e.fail("OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		e.pushBool(ok)
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultisig(script)
+		if err != nil {
+			return err
+		}
+		if op.Code == OP_CHECKMULTISIGVERIFY {
+			if !ok {
+				return e.fail("OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		e.pushBool(ok)
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		lock, err := e.peekLock()
+		if err != nil {
+			return err
+		}
+		return e.checkLockTime(lock)
+
+	case OP_CHECKSEQUENCEVERIFY:
+		lock, err := e.peekLock()
+		if err != nil {
+			return err
+		}
+		return e.checkSequence(lock)
+
+	default:
+		return e.fail("opcode 0x%02x can't be executed", op.Code)
+	}
+
+	return nil
+}
+
+func (e *scriptEngine) pushBool(b bool) {
+	if b {
+		e.push([]byte{1})
+	} else {
+		e.push(nil)
+	}
+}
+
+// checkMultisig is OP_CHECKMULTISIG:
+//
+//	<sig 1> ... <sig m> <m> <key 1> ... <key n> <n> OP_CHECKMULTISIG
+//
+// Signatures must be in the same order as the keys they belong to, so
+// each key is tried at most once.
+func (e *scriptEngine) checkMultisig(script []byte) (bool, error) {
+
+	n, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MAX_MULTISIG_KEYS {
+		return false, e.fail("%d keys is out of range", n)
+	}
+
+	e.numOps += int(n)
+	if e.numOps > MAX_SCRIPT_OPS {
+		return false, e.fail("more than %d operations", MAX_SCRIPT_OPS)
+	}
+
+	keys := make([][]byte, n)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, e.fail("%d signatures of %d keys is out of range", m, n)
+	}
+
+	sigs := make([][]byte, m)
+	for i := len(sigs) - 1; i >= 0; i-- {
+		if sigs[i], err = e.pop(); err != nil {
+			return false, err
+		}
+		if err := checkSigEncoding(sigs[i]); err != nil {
+			return false, e.fail("%s", err)
+		}
+	}
+
+	// Keys are only checked once they are tried
+	k := 0
+	for _, sig := range sigs {
+		for k < len(keys) {
+			if _, err := wallet.ParsePublicKey(keys[k]); err != nil {
+				return false, e.fail("%s", err)
+			}
+			if e.tx.checkInputSig(keys[k], sig, e.index, script) {
+				break
+			}
+			k++
+		}
+		if k == len(keys) {
+			return false, nil
+		}
+		k++
+	}
+
+	return true, nil
+}
+
+// checkLockTime is OP_CHECKLOCKTIMEVERIFY: the transaction's lock time
+// must be of the same kind as lock, a height or a time, and at least as
+// late. Blocks only take the transaction once its lock time has passed.
+func (e *scriptEngine) checkLockTime(lock int64) error {
+	txLock := e.tx.LockTime
+
+	if isTimeLock(lock) != isTimeLock(txLock) {
+		return e.fail("lock time %d and transaction lock time %d are of different kinds", lock, txLock)
+	}
+
+	if lock > txLock {
+		return e.fail("lock time %d is not reached", lock)
+	}
+
+	return nil
+}
+
+// checkSequence is OP_CHECKSEQUENCEVERIFY: the input's relative lock must
+// be of the same kind as lock, blocks or time, and at least as long.
+func (e *scriptEngine) checkSequence(lock int64) error {
+	sequence := int64(e.tx.Inputs[e.index].Sequence)
+
+	if lock&SEQUENCE_TYPE_FLAG != sequence&SEQUENCE_TYPE_FLAG {
+		return e.fail("relative lock %d and sequence %d are of different kinds", lock, sequence)
+	}
+
+	if lock&SEQUENCE_LOCK_MASK > sequence&SEQUENCE_LOCK_MASK {
+		return e.fail("relative lock %d is not reached", lock)
+	}
+
+	return nil
+}
@@ -1,9 +1,35 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
 
-// Used to obtain transaction hashes
-// Saved inside a block's header
+// Blocks commit to their transactions through a merkle tree built the way
+// RFC 6962 (certificate transparency) builds them:
+//
+//	leaf   = SHA-256(0x00 || txid || SHA-256(tx))
+//	parent = SHA-256(0x01 || left || right)
+//
+// where tx is the transaction's canonical encoding with the ID left empty,
+// see Transaction.Hash. The ID leaves unlocking scripts out so it stays
+// put while a transaction is signed; the second hash puts them back in,
+// so a block's proof of work commits to its signatures, HTLC secrets and
+// redeem scripts too, and no one can swap them for others spending the
+// same way.
+//
+// A node left without a sibling moves up a level unchanged instead of
+// being paired with a copy of itself. Together with the prefixes that
+// means no two different transaction lists share a root: duplicating
+// trailing transactions changes it, and an inner node can't be passed off
+// as a leaf. Reference roots are in testdata/merkle_vectors.json.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -15,17 +41,29 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+func merkleLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return hash[:]
+}
+
+func merkleParent(left, right []byte) []byte {
+	buf := make([]byte, 0, 1+len(left)+len(right))
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left...)
+	buf = append(buf, right...)
+
+	hash := sha256.Sum256(buf)
+	return hash[:]
+}
+
 func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode {
 
 	node := MerkleNode{}
 
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		node.Data = hash[:]
+		node.Data = merkleLeaf(data)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		node.Data = hash[:]
+		node.Data = merkleParent(left.Data, right.Data)
 	}
 
 	node.Left = left
@@ -34,30 +72,440 @@ func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode
 	return &node
 }
 
+// NewMerkleTree builds the tree over data, one leaf per element. The
+// empty tree's root is the hash of nothing.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 
-	var nodes []MerkleNode
-
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		hash := sha256.Sum256(nil)
+		return &MerkleTree{&MerkleNode{Data: hash[:]}}
 	}
 
+	var nodes []*MerkleNode
+
 	for _, dat := range data {
-		node := NewMerkleNode(nil, nil, dat)
-		nodes = append(nodes, *node)
+		nodes = append(nodes, NewMerkleNode(nil, nil, dat))
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	for len(nodes) > 1 {
 
-		var level []MerkleNode
+		var level []*MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			level = append(level, *node)
+			if j+1 == len(nodes) {
+				level = append(level, nodes[j])
+				continue
+			}
+
+			level = append(level, NewMerkleNode(nodes[j], nodes[j+1], nil))
 		}
 
 		nodes = level
 	}
 
-	return &MerkleTree{&nodes[0]}
+	return &MerkleTree{nodes[0]}
+}
+
+// -------------------------------------------------------------
+
+var ErrBadPartialTree = errors.New("malformed partial merkle tree")
+
+// PartialMerkleTree proves that some of a block's transactions are in it
+// without sending the others. It is a depth-first walk of the tree: a set
+// flag means "descend, a match is below", a clear flag means "here is the
+// hash of this whole subtree". Flags are packed eight to a byte, lowest bit
+// first.
+type PartialMerkleTree struct {
+	Total  int
+	Hashes [][]byte
+	Flags  []byte
+}
+
+// treeWidth is the number of nodes at height h of a tree over total leaves.
+func treeWidth(total, height int) int {
+	return (total + (1 << height) - 1) >> height
+}
+
+// treeHeight is the height of the root, zero for a lone leaf.
+func treeHeight(total int) int {
+	height := 0
+	for treeWidth(total, height) > 1 {
+		height++
+	}
+	return height
+}
+
+// NewPartialMerkleTree builds the proof for the leaves marked in matches.
+// Leaves are TxLeaf values, as for NewMerkleTree.
+func NewPartialMerkleTree(leaves [][]byte, matches []bool) *PartialMerkleTree {
+	hashes := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		hashes[i] = merkleLeaf(leaf)
+	}
+
+	pmt := &PartialMerkleTree{Total: len(leaves)}
+
+	var bits []bool
+	var calcHash func(height, pos int) []byte
+	var build func(height, pos int)
+
+	calcHash = func(height, pos int) []byte {
+		if height == 0 {
+			return hashes[pos]
+		}
+
+		left := calcHash(height-1, pos*2)
+		if pos*2+1 >= treeWidth(pmt.Total, height-1) {
+			return left
+		}
+
+		return merkleParent(left, calcHash(height-1, pos*2+1))
+	}
+
+	build = func(height, pos int) {
+		parentOfMatch := false
+		for i := pos << height; i < (pos+1)<<height && i < pmt.Total; i++ {
+			parentOfMatch = parentOfMatch || matches[i]
+		}
+
+		bits = append(bits, parentOfMatch)
+
+		if height == 0 || !parentOfMatch {
+			pmt.Hashes = append(pmt.Hashes, calcHash(height, pos))
+			return
+		}
+
+		build(height-1, pos*2)
+		if pos*2+1 < treeWidth(pmt.Total, height-1) {
+			build(height-1, pos*2+1)
+		}
+	}
+
+	build(treeHeight(pmt.Total), 0)
+
+	pmt.Flags = make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			pmt.Flags[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	return pmt
+}
+
+// ExtractMatches walks the proof back up to the root. It returns the root
+// together with the leaf hashes that were matched and their positions in
+// the block. The root is only meaningful once checked against a header.
+func (pmt *PartialMerkleTree) ExtractMatches() ([]byte, [][]byte, []int, error) {
+
+	if pmt.Total <= 0 || len(pmt.Hashes) == 0 || len(pmt.Hashes) > pmt.Total {
+		return nil, nil, nil, ErrBadPartialTree
+	}
+
+	if len(pmt.Flags)*8 < len(pmt.Hashes) {
+		return nil, nil, nil, ErrBadPartialTree
+	}
+
+	var matched [][]byte
+	var indexes []int
+	bitsUsed, hashesUsed := 0, 0
+	failed := false
+
+	var extract func(height, pos int) []byte
+
+	extract = func(height, pos int) []byte {
+		if failed || bitsUsed >= len(pmt.Flags)*8 {
+			failed = true
+			return nil
+		}
+
+		parentOfMatch := pmt.Flags[bitsUsed/8]&(1<<(bitsUsed%8)) != 0
+		bitsUsed++
+
+		if height == 0 || !parentOfMatch {
+			if hashesUsed >= len(pmt.Hashes) {
+				failed = true
+				return nil
+			}
+
+			hash := pmt.Hashes[hashesUsed]
+			hashesUsed++
+
+			if height == 0 && parentOfMatch {
+				matched = append(matched, hash)
+				indexes = append(indexes, pos)
+			}
+
+			return hash
+		}
+
+		left := extract(height-1, pos*2)
+		if pos*2+1 >= treeWidth(pmt.Total, height-1) {
+			return left
+		}
+
+		right := extract(height-1, pos*2+1)
+
+		// A block never holds the same transaction twice
+		if failed || bytes.Equal(left, right) {
+			failed = true
+			return nil
+		}
+
+		return merkleParent(left, right)
+	}
+
+	root := extract(treeHeight(pmt.Total), 0)
+
+	// Every hash must be used, and every flag up to the byte padding
+	if failed || hashesUsed != len(pmt.Hashes) || (bitsUsed+7)/8 != len(pmt.Flags) {
+		return nil, nil, nil, ErrBadPartialTree
+	}
+
+	return root, matched, indexes, nil
+}
+
+// TxLeaf is the leaf data a transaction has in its block's tree: its ID
+// followed by the hash of all of it.
+func TxLeaf(tx *Transaction) []byte {
+	return append(append([]byte{}, tx.ID...), tx.Hash()...)
+}
+
+// TxLeafHash is the leaf hash a transaction has in its block's tree.
+func TxLeafHash(tx *Transaction) []byte {
+	return merkleLeaf(TxLeaf(tx))
+}
+
+// -------------------------------------------------------------
+
+var ErrTxNotInBlock = errors.New("transaction is not in the block")
+
+// MerkleStep is one level of an inclusion proof: the sibling hash and
+// whether it sits to the left of the running hash.
+type MerkleStep struct {
+	Hash []byte
+	Left bool
+}
+
+// MerkleProof is the path from one leaf up to the root. Index and Leaves,
+// the leaf's place and the size of the tree, fix which side each sibling
+// is on and at which levels there is none, and the steps have to agree.
+// The root doesn't commit to the tree's size, so Index is only as good as
+// the Leaves the prover gives.
+type MerkleProof struct {
+	Index  int
+	Leaves int
+	Steps  []MerkleStep
+}
+
+func (p *MerkleProof) MarshalJSON() ([]byte, error) {
+	type step struct {
+		Hash     string `json:"hash"`
+		Position string `json:"position"`
+	}
+
+	steps := make([]step, len(p.Steps))
+	for i, s := range p.Steps {
+		steps[i] = step{hex.EncodeToString(s.Hash), "right"}
+		if s.Left {
+			steps[i].Position = "left"
+		}
+	}
+
+	return json.Marshal(struct {
+		Index  int    `json:"index"`
+		Leaves int    `json:"leaves"`
+		Steps  []step `json:"siblings"`
+	}{p.Index, p.Leaves, steps})
+}
+
+// merkleLevels hashes the tree level by level, leaves first and root
+// last, moving the last node of an odd level up unchanged.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+
+	levels := [][][]byte{level}
+
+	for height := 0; height < treeHeight(len(leaves)); height++ {
+		var next [][]byte
+
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleParent(level[i], level[i+1]))
+		}
+
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// NewMerkleProof builds the inclusion proof for leaves[index]. Leaves are
+// TxLeaf values, as for NewMerkleTree. Levels where the node moves up
+// without a sibling add no step.
+func NewMerkleProof(leaves [][]byte, index int) (*MerkleProof, error) {
+
+	if index < 0 || index >= len(leaves) {
+		return nil, ErrTxNotInBlock
+	}
+
+	proof := &MerkleProof{Index: index, Leaves: len(leaves)}
+	levels := merkleLevels(leaves)
+
+	pos := index
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := pos ^ 1; sibling < len(level) {
+			proof.Steps = append(proof.Steps, MerkleStep{level[sibling], pos%2 == 1})
+		}
+		pos /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof reports whether proof leads from leaf to root, with
+// a step exactly where the leaf's place in the tree has a sibling and on
+// the side its place says.
+func VerifyMerkleProof(leaf []byte, proof *MerkleProof, root []byte) bool {
+	if proof.Index < 0 || proof.Index >= proof.Leaves {
+		return false
+	}
+
+	hash := merkleLeaf(leaf)
+	steps := proof.Steps
+
+	for pos, size := proof.Index, proof.Leaves; size > 1; pos, size = pos/2, (size+1)/2 {
+		if pos^1 >= size {
+			continue
+		}
+
+		if len(steps) == 0 || steps[0].Left != (pos%2 == 1) {
+			return false
+		}
+
+		if steps[0].Left {
+			hash = merkleParent(steps[0].Hash, hash)
+		} else {
+			hash = merkleParent(hash, steps[0].Hash)
+		}
+		steps = steps[1:]
+	}
+
+	return len(steps) == 0 && bytes.Equal(hash, root)
+}
+
+// TxProof is everything an outsider needs to check that a transaction is
+// in a block: the transaction, its merkle path and the block header the
+// root is committed to by proof of work. The block hash doesn't cover the
+// height, so Height is only as trusted as the header chain the block is
+// found on, see VerifyInChain.
+type TxProof struct {
+	Tx         *Transaction
+	BlockHash  []byte
+	PrevHash   []byte
+	Height     int
+	Timestamp  int64
+	Nonce      int
+	MerkleRoot []byte
+	Proof      *MerkleProof
+}
+
+// NewTxProof proves that the transaction with the given ID is in b.
+func NewTxProof(b *Block, id []byte) (*TxProof, error) {
+
+	leaves := make([][]byte, len(b.Transactions))
+	index := -1
+
+	for i, tx := range b.Transactions {
+		leaves[i] = TxLeaf(tx)
+		if bytes.Equal(tx.ID, id) {
+			index = i
+		}
+	}
+
+	if index < 0 {
+		return nil, ErrTxNotInBlock
+	}
+
+	proof, err := NewMerkleProof(leaves, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxProof{
+		Tx:         b.Transactions[index],
+		BlockHash:  b.Hash,
+		PrevHash:   b.PrevHash,
+		Height:     b.Height,
+		Timestamp:  b.Timestamp,
+		Nonce:      b.Nonce,
+		MerkleRoot: b.HashTransactions(),
+		Proof:      proof,
+	}, nil
+}
+
+// Verify checks the transaction against its ID, the merkle path against
+// the root and the root against the header's proof of work. That only
+// shows the transaction is in some block with a valid proof of work, not
+// that the block is part of the chain: difficulty is fixed and low, so a
+// header around a made-up transaction takes moments to mine. Use
+// VerifyInChain to also check the header against a chain you trust.
+func (p *TxProof) Verify() bool {
+	if !bytes.Equal(p.Tx.ComputeID(), p.Tx.ID) {
+		return false
+	}
+
+	if !VerifyMerkleProof(TxLeaf(p.Tx), p.Proof, p.MerkleRoot) {
+		return false
+	}
+
+	header := &Block{Timestamp: p.Timestamp, PrevHash: p.PrevHash, Nonce: p.Nonce, Hash: p.BlockHash}
+
+	return NewProof(header).VerifyRoot(p.MerkleRoot)
+}
+
+// VerifyInChain is Verify plus a check that the proof's block is on the
+// best chain, as told by onBestChain: Blockchain.OnBestChain for a full
+// node, or the header chain of a light client.
+func (p *TxProof) VerifyInChain(onBestChain func(hash []byte) bool) bool {
+	return p.Verify() && onBestChain(p.BlockHash)
+}
+
+func (p *TxProof) MarshalJSON() ([]byte, error) {
+	type header struct {
+		Hash       string `json:"hash"`
+		PrevHash   string `json:"prev_hash"`
+		Height     int    `json:"height"`
+		Timestamp  int64  `json:"timestamp"`
+		Nonce      int    `json:"nonce"`
+		Difficulty int    `json:"difficulty"`
+		MerkleRoot string `json:"merkle_root"`
+	}
+
+	return json.Marshal(struct {
+		TxID   string       `json:"txid"`
+		Tx     *Transaction `json:"transaction"`
+		Proof  *MerkleProof `json:"proof"`
+		Header header       `json:"header"`
+	}{
+		TxID:  hex.EncodeToString(p.Tx.ID),
+		Tx:    p.Tx,
+		Proof: p.Proof,
+		Header: header{
+			Hash:       hex.EncodeToString(p.BlockHash),
+			PrevHash:   hex.EncodeToString(p.PrevHash),
+			Height:     p.Height,
+			Timestamp:  p.Timestamp,
+			Nonce:      p.Nonce,
+			Difficulty: Difficulty,
+			MerkleRoot: hex.EncodeToString(p.MerkleRoot),
+		},
+	})
 }
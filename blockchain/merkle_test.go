@@ -0,0 +1,282 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+type merkleVector struct {
+	Leaves [][]byte
+	Root   []byte
+}
+
+// loadMerkleVectors reads testdata/merkle_vectors.json.
+func loadMerkleVectors(t *testing.T) []merkleVector {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/merkle_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file struct {
+		Vectors []struct {
+			Leaves []string `json:"leaves"`
+			Root   string   `json:"root"`
+		} `json:"vectors"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(file.Vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	vectors := make([]merkleVector, len(file.Vectors))
+	for i, v := range file.Vectors {
+		for _, leaf := range v.Leaves {
+			vectors[i].Leaves = append(vectors[i].Leaves, unhex(leaf))
+		}
+		vectors[i].Root = unhex(v.Root)
+	}
+
+	return vectors
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	return NewMerkleTree(leaves).RootNode.Data
+}
+
+func TestMerkleRootVectors(t *testing.T) {
+	for _, v := range loadMerkleVectors(t) {
+		if root := merkleRoot(v.Leaves); !bytes.Equal(root, v.Root) {
+			t.Errorf("%d leaves: root %x, want %x", len(v.Leaves), root, v.Root)
+		}
+	}
+}
+
+func TestMerkleSingleLeaf(t *testing.T) {
+	leaf := []byte("tx0")
+
+	if root := merkleRoot([][]byte{leaf}); !bytes.Equal(root, merkleLeaf(leaf)) {
+		t.Fatalf("root of one leaf is %x, want its leaf hash %x", root, merkleLeaf(leaf))
+	}
+
+	proof, err := NewMerkleProof([][]byte{leaf}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(proof.Steps) != 0 {
+		t.Fatalf("proof for a lone leaf has %d steps", len(proof.Steps))
+	}
+
+	if !VerifyMerkleProof(leaf, proof, merkleLeaf(leaf)) {
+		t.Fatal("proof for a lone leaf does not verify")
+	}
+}
+
+// Every leaf of every vector, odd counts included, has a proof that leads
+// to the vector's root.
+func TestMerkleProofVectors(t *testing.T) {
+	for _, v := range loadMerkleVectors(t) {
+		for i, leaf := range v.Leaves {
+			proof, err := NewMerkleProof(v.Leaves, i)
+			if err != nil {
+				t.Fatalf("%d leaves, index %d: %s", len(v.Leaves), i, err)
+			}
+
+			if !VerifyMerkleProof(leaf, proof, v.Root) {
+				t.Errorf("%d leaves: proof for index %d does not verify", len(v.Leaves), i)
+			}
+		}
+
+		if _, err := NewMerkleProof(v.Leaves, len(v.Leaves)); err == nil {
+			t.Errorf("%d leaves: proof for a leaf past the end", len(v.Leaves))
+		}
+	}
+}
+
+// Repeating trailing leaves, which gave Bitcoin's tree the same root
+// (CVE-2012-2459), changes the root here.
+func TestMerkleDuplicateLeaves(t *testing.T) {
+	for _, v := range loadMerkleVectors(t) {
+		n := len(v.Leaves)
+		if n == 0 {
+			continue
+		}
+
+		variants := [][][]byte{
+			append(append([][]byte{}, v.Leaves...), v.Leaves[n-1]),
+		}
+		if n >= 2 {
+			variants = append(variants, append(append([][]byte{}, v.Leaves...), v.Leaves[n-2:]...))
+		}
+
+		for _, leaves := range variants {
+			if bytes.Equal(merkleRoot(leaves), v.Root) {
+				t.Errorf("%d leaves and %d leaves with duplicates share a root", n, len(leaves))
+			}
+		}
+	}
+}
+
+// A partial tree that sends the same subtree on both sides is the same
+// trick, and is refused.
+func TestPartialMerkleTreeDuplicate(t *testing.T) {
+	leaves := [][]byte{[]byte("tx0"), []byte("tx1"), []byte("tx2"), []byte("tx2")}
+
+	pmt := NewPartialMerkleTree(leaves, []bool{false, false, true, false})
+
+	if _, _, _, err := pmt.ExtractMatches(); err == nil {
+		t.Fatal("partial tree with a duplicated leaf was accepted")
+	}
+}
+
+func TestPartialMerkleTreeVectors(t *testing.T) {
+	for _, v := range loadMerkleVectors(t) {
+		if len(v.Leaves) == 0 {
+			continue
+		}
+
+		matches := make([]bool, len(v.Leaves))
+		for i := range matches {
+			matches[i] = i%3 == 0
+		}
+
+		root, matched, indexes, err := NewPartialMerkleTree(v.Leaves, matches).ExtractMatches()
+		if err != nil {
+			t.Fatalf("%d leaves: %s", len(v.Leaves), err)
+		}
+
+		if !bytes.Equal(root, v.Root) {
+			t.Errorf("%d leaves: partial tree root %x, want %x", len(v.Leaves), root, v.Root)
+		}
+
+		for i, index := range indexes {
+			if index%3 != 0 || !bytes.Equal(matched[i], merkleLeaf(v.Leaves[index])) {
+				t.Errorf("%d leaves: unexpected match at %d", len(v.Leaves), index)
+			}
+		}
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	var v merkleVector
+	for _, vec := range loadMerkleVectors(t) {
+		if len(vec.Leaves) == 7 {
+			v = vec
+		}
+	}
+
+	index := 2
+	leaf := v.Leaves[index]
+
+	fresh := func() *MerkleProof {
+		proof, err := NewMerkleProof(v.Leaves, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	}
+
+	tampered := map[string]func(p *MerkleProof) ([]byte, []byte){
+		"flipped sibling byte": func(p *MerkleProof) ([]byte, []byte) {
+			p.Steps[0].Hash = append([]byte{}, p.Steps[0].Hash...)
+			p.Steps[0].Hash[0] ^= 1
+			return leaf, v.Root
+		},
+		"swapped position": func(p *MerkleProof) ([]byte, []byte) {
+			p.Steps[1].Left = !p.Steps[1].Left
+			return leaf, v.Root
+		},
+		"dropped step": func(p *MerkleProof) ([]byte, []byte) {
+			p.Steps = p.Steps[:len(p.Steps)-1]
+			return leaf, v.Root
+		},
+		"extra step": func(p *MerkleProof) ([]byte, []byte) {
+			p.Steps = append(p.Steps, p.Steps[0])
+			return leaf, v.Root
+		},
+		"other index": func(p *MerkleProof) ([]byte, []byte) {
+			p.Index++
+			return leaf, v.Root
+		},
+		"other leaf count": func(p *MerkleProof) ([]byte, []byte) {
+			p.Leaves = 3
+			return leaf, v.Root
+		},
+		"other leaf": func(p *MerkleProof) ([]byte, []byte) {
+			return v.Leaves[index+1], v.Root
+		},
+		"other root": func(p *MerkleProof) ([]byte, []byte) {
+			return leaf, merkleRoot(v.Leaves[:6])
+		},
+		// An inner node passed off as a leaf: its two children as the
+		// leaf data and the rest of the path as the proof
+		"inner node as leaf": func(p *MerkleProof) ([]byte, []byte) {
+			levels := merkleLevels(v.Leaves)
+			inner := append(append([]byte{}, levels[0][2]...), levels[0][3]...)
+			p.Steps = p.Steps[1:]
+			return inner, v.Root
+		},
+	}
+
+	if !VerifyMerkleProof(leaf, fresh(), v.Root) {
+		t.Fatal("untampered proof does not verify")
+	}
+
+	for name, tamper := range tampered {
+		proof := fresh()
+		leaf, root := tamper(proof)
+
+		if VerifyMerkleProof(leaf, proof, root) {
+			t.Errorf("%s: tampered proof verifies", name)
+		}
+	}
+}
+
+// The root commits to unlocking scripts, which the IDs leave out.
+func TestMerkleCommitsToUnlockScripts(t *testing.T) {
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: bytes.Repeat([]byte{1}, 32), Out: 0, UnlockScript: []byte{0x01, 0xaa}}},
+		Outputs: []TxOutput{{Value: 5, LockScript: []byte{0x51}}},
+	}
+	tx.ID = tx.ComputeID()
+
+	swapped := *tx
+	swapped.Inputs = []TxInput{tx.Inputs[0]}
+	swapped.Inputs[0].UnlockScript = []byte{0x01, 0xbb}
+
+	if !bytes.Equal(swapped.ComputeID(), tx.ID) {
+		t.Fatal("unlocking script changed the ID")
+	}
+
+	a := &Block{Transactions: []*Transaction{tx}}
+	b := &Block{Transactions: []*Transaction{&swapped}}
+
+	if bytes.Equal(a.HashTransactions(), b.HashTransactions()) {
+		t.Fatal("blocks differing only in an unlocking script share a merkle root")
+	}
+
+	proof, err := NewTxProof(&Block{Transactions: []*Transaction{tx}}, tx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !VerifyMerkleProof(TxLeaf(tx), proof.Proof, proof.MerkleRoot) || VerifyMerkleProof(TxLeaf(&swapped), proof.Proof, proof.MerkleRoot) {
+		t.Fatal("transaction proof does not tell the scripts apart")
+	}
+}
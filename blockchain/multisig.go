@@ -0,0 +1,341 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// M-of-N multisig outputs are locked with
+//
+//	<m> <key 1> ... <key n> <n> OP_CHECKMULTISIG
+//
+// and spent with <sig> ... <sig>, one signature for each of m of the keys,
+// in key order. Keys are sorted so the same participants always give the
+// same script, and so the same address.
+//
+// The same script can also be used as a P2SH redeem script, and is then
+// pushed after the signatures.
+//
+// While holders are still signing, a spending input carries one push per
+// key, empty until that key's holder has signed, followed by the redeem
+// script for P2SH. FinalizeMultisig then keeps the first m signatures.
+
+var (
+	ErrBadMultisig      = errors.New("invalid multisig policy")
+	ErrNotMultisig      = errors.New("output is not a multisig output")
+	ErrMissingSignature = errors.New("not enough signatures")
+)
+
+// MultisigScript builds the locking script for m of pubKeys.
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+
+	if n == 0 || n > MAX_MULTISIG_KEYS || m < 1 || m > n {
+		return nil, fmt.Errorf("%w: %d of %d keys", ErrBadMultisig, m, n)
+	}
+
+	keys := make([][]byte, n)
+	copy(keys, pubKeys)
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	builder := NewScriptBuilder().AddInt(int64(m))
+
+	for i, key := range keys {
+		if _, err := wallet.ParsePublicKey(key); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadMultisig, err)
+		}
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			return nil, fmt.Errorf("%w: duplicate key %x", ErrBadMultisig, key)
+		}
+		builder.AddData(key)
+	}
+
+	return builder.AddInt(int64(n)).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// ExtractMultisig returns the policy of a multisig locking script.
+func ExtractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Code != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	// Counts above 16 don't have their own opcode and are pushed as numbers
+	smallInt := func(op scriptOp) int {
+		if op.Code >= OP_1 && op.Code <= OP_16 {
+			return int(op.Code-OP_1) + 1
+		}
+		if n, err := decodeScriptNum(op.Data, 4); err == nil && n > 16 && n <= MAX_MULTISIG_KEYS {
+			return int(n)
+		}
+		return -1
+	}
+
+	m := smallInt(ops[0])
+	n := smallInt(ops[len(ops)-2])
+	keyOps := ops[1 : len(ops)-2]
+
+	if m < 1 || n != len(keyOps) || m > n {
+		return 0, nil, false
+	}
+
+	keys := make([][]byte, n)
+	for i, op := range keyOps {
+		if len(op.Data) == 0 {
+			return 0, nil, false
+		}
+		keys[i] = op.Data
+	}
+
+	return m, keys, true
+}
+
+// MultisigAddress is the address for a multisig locking script. It holds
+// the script itself, so anyone can pay to it.
+func MultisigAddress(script []byte) string {
+	return wallet.EncodeAddress(wallet.MultisigVersion, script)
+}
+
+// multisigSpend is what an input spending a multisig output has to
+// provide. script is what its signatures commit to: the spent output's
+// locking script, or for P2SH the redeem script.
+type multisigSpend struct {
+	m      int
+	keys   [][]byte
+	script []byte
+	redeem []byte
+}
+
+// multisigInput works out the multisig policy in spends, or returns nil if
+// it doesn't spend a multisig output. For P2SH the redeem script is taken
+// from the input's last push.
+func multisigInput(in TxInput, prevTXs map[string]Transaction) (*multisigSpend, error) {
+
+	lockScript, err := spentLockScript(in, prevTXs)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &multisigSpend{script: lockScript}
+
+	if scriptHash, ok := ExtractScriptHash(lockScript); ok {
+		pushes := ScriptPushes(in.UnlockScript)
+		if len(pushes) == 0 || !bytes.Equal(ScriptHash(pushes[len(pushes)-1]), scriptHash) {
+			return nil, nil
+		}
+
+		ms.redeem = pushes[len(pushes)-1]
+		ms.script = ms.redeem
+	}
+
+	var ok bool
+	if ms.m, ms.keys, ok = ExtractMultisig(ms.script); !ok {
+		return nil, nil
+	}
+
+	return ms, nil
+}
+
+// slots reads the signatures collected so far for an input, one per key.
+func (ms *multisigSpend) slots(unlock []byte) [][]byte {
+	slots := make([][]byte, len(ms.keys))
+
+	ops, err := parseScript(unlock)
+	if ms.redeem != nil && err == nil && len(ops) > 0 {
+		ops = ops[:len(ops)-1]
+	}
+
+	if err != nil || len(ops) != len(slots) {
+		return slots
+	}
+
+	for i, op := range ops {
+		slots[i] = op.Data
+	}
+
+	return slots
+}
+
+func (ms *multisigSpend) unlockScript(sigs [][]byte) []byte {
+	builder := NewScriptBuilder()
+	for _, sig := range sigs {
+		builder.AddData(sig)
+	}
+	if ms.redeem != nil {
+		builder.AddData(ms.redeem)
+	}
+	return builder.Script()
+}
+
+// -------------------------------------------------------------
+
+// NewMultisigTransaction builds an unsigned transaction paying amount from
+// the outputs locked with lockScript, with change going back to it. For a
+// P2SH lockScript, redeemScript is the multisig script it hashes. A
+// lockTime other than zero keeps the transaction out of blocks until then,
+// so the holders can sign a refund ahead of time.
+func NewMultisigTransaction(lockScript, redeemScript []byte, to string, amount int, lockTime int64, UTXO *UTXOSet) (*Transaction, error) {
+
+	ms := &multisigSpend{script: lockScript}
+
+	if redeemScript != nil {
+		if err := CheckRedeemScript(redeemScript); err != nil {
+			return nil, err
+		}
+
+		scriptHash, ok := ExtractScriptHash(lockScript)
+		if !ok || !bytes.Equal(ScriptHash(redeemScript), scriptHash) {
+			return nil, fmt.Errorf("%w: redeem script does not match the address", ErrBadMultisig)
+		}
+
+		ms.script, ms.redeem = redeemScript, redeemScript
+	}
+
+	var ok bool
+	if ms.m, ms.keys, ok = ExtractMultisig(ms.script); !ok {
+		return nil, ErrNotMultisig
+	}
+
+	acc, validOutputs := UTXO.FindSpendableScriptOutputs(lockScript, amount)
+	if acc < amount {
+		return nil, fmt.Errorf("not enough funds: have %d, need %d", acc, amount)
+	}
+
+	var inputs []TxInput
+
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, out := range outs {
+			inputs = append(inputs, TxInput{out, txID, ms.unlockScript(make([][]byte, len(ms.keys))), 0})
+		}
+	}
+
+	outputs := []TxOutput{*NewTXOutput(amount, to)}
+
+	if acc > amount {
+		outputs = append(outputs, TxOutput{acc - amount, lockScript})
+	}
+
+	tx := Transaction{nil, inputs, outputs, lockTime}
+	tx.ID = tx.ComputeID()
+
+	return &tx, nil
+}
+
+// SignMultisig adds privKey's signature with the given hash type to every
+// input spending a multisig output that includes its key, and returns how
+// many it signed.
+func (t *Transaction) SignMultisig(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType byte) (int, error) {
+
+	signed := 0
+
+	for inId, in := range t.Inputs {
+
+		ms, err := multisigInput(in, prevTXs)
+		if err != nil {
+			return signed, err
+		}
+		if ms == nil {
+			continue
+		}
+
+		slots := ms.slots(in.UnlockScript)
+		pubKey := pubKeyAmong(&privKey, ms.keys)
+
+		for k, key := range ms.keys {
+			if bytes.Equal(key, pubKey) {
+				sig, err := t.signInput(&privKey, inId, ms.script, hashType)
+				if err != nil {
+					return signed, err
+				}
+				slots[k] = sig
+				signed++
+			}
+		}
+
+		t.Inputs[inId].UnlockScript = ms.unlockScript(slots)
+	}
+
+	return signed, nil
+}
+
+// MultisigProgress reports, per input spending a multisig output, how many
+// signatures have been collected and how many are needed.
+func (t *Transaction) MultisigProgress(prevTXs map[string]Transaction) ([][2]int, error) {
+
+	var progress [][2]int
+
+	for _, in := range t.Inputs {
+
+		ms, err := multisigInput(in, prevTXs)
+		if err != nil {
+			return nil, err
+		}
+		if ms == nil {
+			continue
+		}
+
+		have := 0
+		for _, slot := range ms.slots(in.UnlockScript) {
+			if len(slot) > 0 {
+				have++
+			}
+		}
+
+		progress = append(progress, [2]int{have, ms.m})
+	}
+
+	return progress, nil
+}
+
+// FinalizeMultisig turns the collected signatures of every multisig input
+// into its final unlocking script.
+func (t *Transaction) FinalizeMultisig(prevTXs map[string]Transaction) error {
+
+	for inId, in := range t.Inputs {
+
+		ms, err := multisigInput(in, prevTXs)
+		if err != nil {
+			return err
+		}
+		if ms == nil {
+			continue
+		}
+
+		var sigs [][]byte
+		for _, slot := range ms.slots(in.UnlockScript) {
+			if len(slot) > 0 && len(sigs) < ms.m {
+				sigs = append(sigs, slot)
+			}
+		}
+
+		if len(sigs) < ms.m {
+			return fmt.Errorf("%w: input %d has %d of %d", ErrMissingSignature, inId, len(sigs), ms.m)
+		}
+
+		t.Inputs[inId].UnlockScript = ms.unlockScript(sigs)
+	}
+
+	return nil
+}
+
+func spentLockScript(in TxInput, prevTXs map[string]Transaction) ([]byte, error) {
+	prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+	if !ok || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+		return nil, fmt.Errorf("previous output %x:%d is not known", in.ID, in.Out)
+	}
+
+	return prevTX.Outputs[in.Out].LockScript, nil
+}
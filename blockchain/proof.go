@@ -35,6 +35,10 @@ func NewProof(b *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) InitData(nonce int) ([]byte, error) {
+	return pow.initData(pow.Block.HashTransactions(), nonce)
+}
+
+func (pow *ProofOfWork) initData(merkleRoot []byte, nonce int) ([]byte, error) {
 
 	non, err := ToHex(int64(nonce))
 	if err != nil {
@@ -46,10 +50,17 @@ func (pow *ProofOfWork) InitData(nonce int) ([]byte, error) {
 		return nil, fmt.Errorf("failed to write [difficulty] ToHex")
 	}
 
+	// The timestamp is committed to so a block proves when it was mined
+	timestamp, err := ToHex(pow.Block.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write [timestamp] ToHex")
+	}
+
 	data := bytes.Join(
 		[][]byte{
 			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			merkleRoot,
+			timestamp,
 			non,
 			diff,
 			// ToHex(int64(nonce)),
@@ -104,3 +115,51 @@ func (pow *ProofOfWork) Run() (int, []byte, error) {
 
 	return nonce, hash[:], nil
 }
+
+// Verify is Validate for blocks received from elsewhere: on top of meeting
+// the target, the hash the block claims must be the one its data produces.
+// Merkle leaves take each transaction's ID as given, so it must also be
+// the one the transaction's contents produce.
+func (pow *ProofOfWork) Verify() (bool, error) {
+
+	for _, tx := range pow.Block.Transactions {
+		if !bytes.Equal(tx.ComputeID(), tx.ID) {
+			return false, nil
+		}
+	}
+
+	data, err := pow.InitData(pow.Block.Nonce)
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha256.Sum256(data)
+
+	if !bytes.Equal(hash[:], pow.Block.Hash) {
+		return false, nil
+	}
+
+	return pow.Validate()
+}
+
+// VerifyRoot checks a block we only have the header and merkle root of,
+// as light clients do. The hash must both be the one the header and root
+// produce and meet the target.
+func (pow *ProofOfWork) VerifyRoot(merkleRoot []byte) bool {
+
+	data, err := pow.initData(merkleRoot, pow.Block.Nonce)
+	if err != nil {
+		return false
+	}
+
+	hash := sha256.Sum256(data)
+
+	if !bytes.Equal(hash[:], pow.Block.Hash) {
+		return false
+	}
+
+	var intHash big.Int
+	intHash.SetBytes(hash[:])
+
+	return intHash.Cmp(pow.Target) == -1
+}
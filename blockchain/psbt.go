@@ -0,0 +1,605 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// A PSBT (partially signed transaction, after BIP 174) carries a
+// transaction between the parties building it, so that keys never have to
+// be on a machine with the chain. It holds the unsigned transaction, the
+// output each input spends, so a signer can see what it signs and needs
+// no chain, the signatures collected so far and free-form metadata:
+//
+//	create    a node with the chain picks the outputs to spend
+//	sign      each key holder adds signatures, offline if need be
+//	combine   signatures made on separate copies are merged
+//	finalize  the signatures become unlocking scripts, checked by running them
+//	broadcast the finished transaction is extracted and sent
+//
+// It is encoded like transactions (see encoding.go), after the magic bytes
+// "psbt", and travels base64 encoded:
+//
+//	psbt  = uvarint version (1)
+//	        bytes   unsigned transaction
+//	        uvarint input count, as many as the transaction has, per input:
+//	            varint value, bytes locking script    (the spent output)
+//	            bytes redeem script                   (P2SH only)
+//	            uvarint sighash type
+//	            uvarint signature count, per signature:
+//	                bytes public key, bytes signature (sorted by key)
+//	            bytes final unlocking script          (once finalized)
+//	        uvarint metadata count, per entry:
+//	            bytes key, bytes value                (sorted by key)
+const PSBT_VERSION = 1
+
+var (
+	ErrBadPSBT = errors.New("invalid PSBT")
+	psbtMagic  = []byte("psbt")
+)
+
+type PSBT struct {
+	Tx       Transaction // without unlocking scripts
+	Inputs   []PSBTInput
+	Metadata map[string]string
+}
+
+type PSBTInput struct {
+	PrevOut      TxOutput
+	RedeemScript []byte
+	SigHash      byte
+	Signatures   map[string][]byte // by hex public key
+	FinalScript  []byte
+}
+
+// NewPSBT wraps an unsigned transaction. prevTXs must hold every
+// transaction it spends from, and redeemScripts the redeem script of each
+// P2SH output it spends, by locking script. Inputs are signed with
+// hashType.
+func NewPSBT(tx *Transaction, prevTXs map[string]Transaction, redeemScripts [][]byte, hashType byte) (*PSBT, error) {
+
+	if !validSigHashType(hashType) {
+		return nil, ErrBadSigHashType
+	}
+
+	p := &PSBT{
+		Tx:       tx.TrimmedCopy(),
+		Inputs:   make([]PSBTInput, len(tx.Inputs)),
+		Metadata: make(map[string]string),
+	}
+	p.Tx.ID = p.Tx.ComputeID()
+
+	for inId, in := range tx.Inputs {
+
+		lockScript, err := spentLockScript(in, prevTXs)
+		if err != nil {
+			return nil, err
+		}
+
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+
+		p.Inputs[inId] = PSBTInput{
+			PrevOut:    TxOutput{prevOut.Value, lockScript},
+			SigHash:    hashType,
+			Signatures: make(map[string][]byte),
+		}
+
+		if scriptHash, ok := ExtractScriptHash(lockScript); ok {
+			for _, redeem := range redeemScripts {
+				if bytes.Equal(ScriptHash(redeem), scriptHash) {
+					p.Inputs[inId].RedeemScript = redeem
+				}
+			}
+
+			if p.Inputs[inId].RedeemScript == nil {
+				return nil, fmt.Errorf("%w: no redeem script for input %d", ErrBadPSBT, inId)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// NewPaymentPSBT is NewTimeLockedTransaction as a PSBT, which needs only
+// the sender's address.
+func NewPaymentPSBT(from, to string, amount int, notBefore int64, hashType byte, UTXO *UTXOSet) (*PSBT, error) {
+
+	lockScript, err := AddressScript(from)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyHash, ok := ExtractPubKeyHash(lockScript)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a key address", from)
+	}
+
+	toScript, err := AddressScript(to)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := TxOutput{amount, toScript}
+	if notBefore != 0 {
+		payment.LockScript = TimeLockScript(notBefore, payment.LockScript)
+	}
+
+	tx, err := newUnsignedTransaction(pubKeyHash, amount, []TxOutput{payment}, UTXO)
+	if err != nil {
+		return nil, err
+	}
+
+	prevTXs, err := UTXO.Blockchain.PreviousTransactions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPSBT(tx, prevTXs, nil, hashType)
+}
+
+// -------------------------------------------------------------
+
+// signingScript is what signatures for input inId commit to: the spent
+// output's locking script, or for P2SH its redeem script.
+func (p *PSBT) signingScript(inId int) []byte {
+	in := &p.Inputs[inId]
+	if in.RedeemScript != nil {
+		return in.RedeemScript
+	}
+	return in.PrevOut.LockScript
+}
+
+// Sign adds privKey's signature to every input not yet finalized that
+// spends an output locked to it, on its own or as one of a multisig
+// output's keys, and returns how many it signed.
+func (p *PSBT) Sign(privKey ecdsa.PrivateKey) (int, error) {
+
+	signed := 0
+
+	for inId := range p.Inputs {
+
+		in := &p.Inputs[inId]
+		if in.FinalScript != nil {
+			continue
+		}
+
+		script := p.signingScript(inId)
+
+		pubKey := pubKeyFor(&privKey, in.PrevOut.PubKeyHash())
+		if _, keys, ok := ExtractMultisig(script); ok {
+			pubKey = pubKeyAmong(&privKey, keys)
+		}
+
+		if pubKey == nil {
+			continue
+		}
+
+		sig, err := p.Tx.signInput(&privKey, inId, script, in.SigHash)
+		if err != nil {
+			return signed, err
+		}
+
+		in.Signatures[hex.EncodeToString(pubKey)] = sig
+		signed++
+	}
+
+	return signed, nil
+}
+
+// checkSig reports whether sig is a valid signature for input inId by the
+// key it is filed under, which must be one the input's script asks for.
+func (p *PSBT) checkSig(inId int, key string, sig []byte) bool {
+	in := &p.Inputs[inId]
+	script := p.signingScript(inId)
+
+	pubKey, err := hex.DecodeString(key)
+	if err != nil {
+		return false
+	}
+
+	if _, keys, ok := ExtractMultisig(script); ok {
+		found := false
+		for _, k := range keys {
+			found = found || bytes.Equal(k, pubKey)
+		}
+		if !found {
+			return false
+		}
+	} else if pubKeyHash := in.PrevOut.PubKeyHash(); pubKeyHash == nil || !bytes.Equal(wallet.PublicKeyHash(pubKey), pubKeyHash) {
+		return false
+	}
+
+	return checkSigEncoding(sig) == nil && p.Tx.checkInputSig(pubKey, sig, inId, script)
+}
+
+// Combine merges the signatures and metadata of other, a copy of the same
+// PSBT signed elsewhere. Signatures that don't check out are left behind.
+func (p *PSBT) Combine(other *PSBT) error {
+
+	if !bytes.Equal(p.Tx.Serialize(), other.Tx.Serialize()) || len(p.Inputs) != len(other.Inputs) {
+		return fmt.Errorf("%w: not the same transaction", ErrBadPSBT)
+	}
+
+	for inId := range p.Inputs {
+		in, theirs := &p.Inputs[inId], &other.Inputs[inId]
+
+		if !bytes.Equal(in.PrevOut.LockScript, theirs.PrevOut.LockScript) || in.PrevOut.Value != theirs.PrevOut.Value ||
+			!bytes.Equal(in.RedeemScript, theirs.RedeemScript) || in.SigHash != theirs.SigHash {
+			return fmt.Errorf("%w: input %d differs", ErrBadPSBT, inId)
+		}
+
+		for key, sig := range theirs.Signatures {
+			if !p.checkSig(inId, key, sig) {
+				fmt.Printf("Dropped bad signature by %s on input %d\n", key, inId)
+				continue
+			}
+			in.Signatures[key] = sig
+		}
+
+		if in.FinalScript == nil && theirs.FinalScript != nil {
+			tx := p.Tx
+			if err := VerifyScript(theirs.FinalScript, in.PrevOut.LockScript, &tx, inId); err != nil {
+				fmt.Printf("Dropped bad unlocking script for input %d: %s\n", inId, err)
+				continue
+			}
+			in.FinalScript = theirs.FinalScript
+		}
+	}
+
+	for key, value := range other.Metadata {
+		if _, ok := p.Metadata[key]; !ok {
+			p.Metadata[key] = value
+		}
+	}
+
+	return nil
+}
+
+// Finalize turns the signatures of every input it can complete into its
+// unlocking script, and reports whether all inputs are now complete. Bad
+// signatures are dropped first, so they can't take the place of good ones.
+// An unlocking script is only kept if it runs successfully.
+func (p *PSBT) Finalize() (bool, error) {
+
+	tx := p.Tx
+	complete := true
+
+	for inId := range p.Inputs {
+
+		in := &p.Inputs[inId]
+		if in.FinalScript != nil {
+			continue
+		}
+
+		for key, sig := range in.Signatures {
+			if !p.checkSig(inId, key, sig) {
+				fmt.Printf("Dropped bad signature by %s on input %d\n", key, inId)
+				delete(in.Signatures, key)
+			}
+		}
+
+		unlock, ok := p.unlockScript(inId)
+		if !ok {
+			complete = false
+			continue
+		}
+
+		if err := VerifyScript(unlock, in.PrevOut.LockScript, &tx, inId); err != nil {
+			return false, fmt.Errorf("%w: input %d: %s", ErrBadPSBT, inId, err)
+		}
+
+		in.FinalScript = unlock
+	}
+
+	return complete, nil
+}
+
+// unlockScript builds input inId's unlocking script from its signatures,
+// if there are enough.
+func (p *PSBT) unlockScript(inId int) ([]byte, bool) {
+
+	in := &p.Inputs[inId]
+	script := p.signingScript(inId)
+
+	builder := NewScriptBuilder()
+
+	if m, keys, ok := ExtractMultisig(script); ok {
+		// One signature for each of m keys, in key order
+		var sigs [][]byte
+		for _, key := range keys {
+			if sig, ok := in.Signatures[hex.EncodeToString(key)]; ok && len(sigs) < m {
+				sigs = append(sigs, sig)
+			}
+		}
+
+		if len(sigs) < m {
+			return nil, false
+		}
+
+		for _, sig := range sigs {
+			builder.AddData(sig)
+		}
+
+	} else if pubKeyHash := in.PrevOut.PubKeyHash(); pubKeyHash != nil {
+		found := false
+
+		for key, sig := range in.Signatures {
+			pubKey, _ := hex.DecodeString(key)
+			if bytes.Equal(wallet.PublicKeyHash(pubKey), pubKeyHash) {
+				builder.AddData(sig).AddData(pubKey)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, false
+		}
+
+	} else {
+		return nil, false
+	}
+
+	if in.RedeemScript != nil {
+		builder.AddData(in.RedeemScript)
+	}
+
+	return builder.Script(), true
+}
+
+// Extract returns the finished transaction once every input is finalized.
+func (p *PSBT) Extract() (*Transaction, error) {
+
+	tx := p.Tx.TrimmedCopy()
+
+	for inId, in := range p.Inputs {
+		if in.FinalScript == nil {
+			return nil, fmt.Errorf("%w: input %d is not finalized", ErrMissingSignature, inId)
+		}
+		tx.Inputs[inId].UnlockScript = in.FinalScript
+	}
+
+	tx.ID = tx.ComputeID()
+
+	return &tx, nil
+}
+
+// PrevTXs stands in for the transactions p spends from, holding only the
+// outputs its inputs spend, which is all Transaction.Verify looks at.
+func (p *PSBT) PrevTXs() map[string]Transaction {
+
+	prevTXs := make(map[string]Transaction)
+
+	for inId, in := range p.Tx.Inputs {
+		key := hex.EncodeToString(in.ID)
+
+		prevTX := prevTXs[key]
+		prevTX.ID = in.ID
+
+		for len(prevTX.Outputs) <= in.Out {
+			prevTX.Outputs = append(prevTX.Outputs, TxOutput{})
+		}
+		prevTX.Outputs[in.Out] = p.Inputs[inId].PrevOut
+
+		prevTXs[key] = prevTX
+	}
+
+	return prevTXs
+}
+
+// -------------------------------------------------------------
+
+func (p *PSBT) Serialize() []byte {
+
+	e := encoder{buf: append([]byte(nil), psbtMagic...)}
+	e.uvarint(PSBT_VERSION)
+	e.bytes(p.Tx.Serialize())
+
+	e.uvarint(uint64(len(p.Inputs)))
+	for _, in := range p.Inputs {
+		e.varint(int64(in.PrevOut.Value))
+		e.bytes(in.PrevOut.LockScript)
+		e.bytes(in.RedeemScript)
+		e.uvarint(uint64(in.SigHash))
+
+		keys := sortedKeys(in.Signatures)
+		e.uvarint(uint64(len(keys)))
+		for _, key := range keys {
+			pubKey, _ := hex.DecodeString(key)
+			e.bytes(pubKey)
+			e.bytes(in.Signatures[key])
+		}
+
+		e.bytes(in.FinalScript)
+	}
+
+	keys := make([]string, 0, len(p.Metadata))
+	for key := range p.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	e.uvarint(uint64(len(keys)))
+	for _, key := range keys {
+		e.bytes([]byte(key))
+		e.bytes([]byte(p.Metadata[key]))
+	}
+
+	return e.buf
+}
+
+func sortedKeys(sigs map[string][]byte) []string {
+	keys := make([]string, 0, len(sigs))
+	for key := range sigs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DecodePSBT parses a PSBT from its binary encoding.
+func DecodePSBT(data []byte) (*PSBT, error) {
+
+	if !bytes.HasPrefix(data, psbtMagic) {
+		return nil, fmt.Errorf("%w: missing magic bytes", ErrBadPSBT)
+	}
+
+	d := decoder{buf: data[len(psbtMagic):]}
+	d.version(PSBT_VERSION, "PSBT")
+
+	tx, err := DecodeTransaction(d.bytes())
+	if d.err == nil && err != nil {
+		return nil, err
+	}
+
+	p := &PSBT{Tx: tx, Metadata: make(map[string]string)}
+
+	if n := d.count(5); n > 0 {
+		p.Inputs = make([]PSBTInput, n)
+
+		for i := 0; i < n && d.err == nil; i++ {
+			in := &p.Inputs[i]
+			in.PrevOut.Value = d.int()
+			in.PrevOut.LockScript = d.bytes()
+			in.RedeemScript = d.bytes()
+
+			if sigHash := d.uvarint(); sigHash > 0xff {
+				d.fail("sighash type %d out of range", sigHash)
+			} else {
+				in.SigHash = byte(sigHash)
+			}
+
+			in.Signatures = make(map[string][]byte)
+			for j, count := 0, d.count(2); j < count && d.err == nil; j++ {
+				in.Signatures[hex.EncodeToString(d.bytes())] = d.bytes()
+			}
+
+			in.FinalScript = d.bytes()
+		}
+	}
+
+	for i, count := 0, d.count(2); i < count && d.err == nil; i++ {
+		key := string(d.bytes())
+		p.Metadata[key] = string(d.bytes())
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	if len(p.Inputs) != len(p.Tx.Inputs) {
+		return nil, fmt.Errorf("%w: %d inputs described for %d", ErrBadPSBT, len(p.Inputs), len(p.Tx.Inputs))
+	}
+
+	for i, in := range p.Tx.Inputs {
+		if in.UnlockScript != nil {
+			return nil, fmt.Errorf("%w: input %d of the transaction is signed", ErrBadPSBT, i)
+		}
+		if !validSigHashType(p.Inputs[i].SigHash) {
+			return nil, fmt.Errorf("%w: input %d", ErrBadSigHashType, i)
+		}
+	}
+
+	if !bytes.Equal(p.Tx.ComputeID(), p.Tx.ID) {
+		return nil, fmt.Errorf("%w: transaction ID does not match", ErrBadPSBT)
+	}
+
+	return p, nil
+}
+
+// String is the base64 form PSBTs are passed around in.
+func (p *PSBT) String() string {
+	return base64.StdEncoding.EncodeToString(p.Serialize())
+}
+
+// ParsePSBT reads the base64 form.
+func ParsePSBT(s string) (*PSBT, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadPSBT, err)
+	}
+	return DecodePSBT(data)
+}
+
+func (p *PSBT) MarshalJSON() ([]byte, error) {
+	type input struct {
+		ID           string   `json:"id"`
+		Out          int      `json:"out"`
+		Value        int      `json:"value"`
+		Address      string   `json:"address,omitempty"`
+		LockAsm      string   `json:"lock_asm"`
+		RedeemAsm    string   `json:"redeem_asm,omitempty"`
+		SigHash      string   `json:"sighash"`
+		SignedBy     []string `json:"signed_by"`
+		Finalized    bool     `json:"finalized"`
+		FinalScript  string   `json:"final_script,omitempty"`
+		FinalAsm     string   `json:"final_asm,omitempty"`
+		RequiredSigs int      `json:"required_signatures"`
+	}
+
+	inputs := make([]input, len(p.Inputs))
+	valueIn, valueOut := 0, 0
+	complete := true
+
+	for inId, in := range p.Inputs {
+		required := 1
+		if m, _, ok := ExtractMultisig(p.signingScript(inId)); ok {
+			required = m
+		}
+
+		inputs[inId] = input{
+			ID:           hex.EncodeToString(p.Tx.Inputs[inId].ID),
+			Out:          p.Tx.Inputs[inId].Out,
+			Value:        in.PrevOut.Value,
+			Address:      in.PrevOut.Address(),
+			LockAsm:      DisasmScript(in.PrevOut.LockScript),
+			SigHash:      SigHashTypeString(in.SigHash),
+			SignedBy:     sortedKeys(in.Signatures),
+			Finalized:    in.FinalScript != nil,
+			FinalScript:  hex.EncodeToString(in.FinalScript),
+			RequiredSigs: required,
+		}
+
+		if in.RedeemScript != nil {
+			inputs[inId].RedeemAsm = DisasmScript(in.RedeemScript)
+		}
+		if in.FinalScript != nil {
+			inputs[inId].FinalAsm = DisasmScript(in.FinalScript)
+		}
+
+		valueIn += in.PrevOut.Value
+		complete = complete && in.FinalScript != nil
+	}
+
+	for _, out := range p.Tx.Outputs {
+		valueOut += out.Value
+	}
+
+	return json.Marshal(struct {
+		TxID     string            `json:"txid"`
+		Inputs   []input           `json:"inputs"`
+		Outputs  []TxOutput        `json:"outputs"`
+		LockTime int64             `json:"lock_time"`
+		ValueIn  int               `json:"value_in"`
+		ValueOut int               `json:"value_out"`
+		Complete bool              `json:"complete"`
+		Metadata map[string]string `json:"metadata"`
+	}{
+		TxID:     hex.EncodeToString(p.Tx.ID),
+		Inputs:   inputs,
+		Outputs:  p.Tx.Outputs,
+		LockTime: p.Tx.LockTime,
+		ValueIn:  valueIn,
+		ValueOut: valueOut,
+		Complete: complete,
+		Metadata: p.Metadata,
+	})
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// A cosigner sending a bad signature must not stop the others from
+// completing a 2-of-3 spend.
+func TestPSBTBadCosigner(t *testing.T) {
+	a, b, c := wallet.MakeAccount(), wallet.MakeAccount(), wallet.MakeAccount()
+
+	script, err := MultisigScript(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	funding := &Transaction{
+		Inputs:  []TxInput{{ID: []byte{}, Out: -1}},
+		Outputs: []TxOutput{{Value: 10, LockScript: script}},
+	}
+	funding.ID = funding.ComputeID()
+	prevTXs := map[string]Transaction{hex.EncodeToString(funding.ID): *funding}
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: funding.ID, Out: 0}},
+		Outputs: []TxOutput{*NewTXOutput(10, string(wallet.MakeAccount().Address()))},
+	}
+
+	copyFor := func(signer *wallet.Account) *PSBT {
+		p, err := NewPSBT(tx, prevTXs, nil, SIGHASH_ALL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := p.Sign(signer.PrivateKey); err != nil || n != 1 {
+			t.Fatalf("Sign: %d, %v", n, err)
+		}
+		return p
+	}
+
+	p, bad, good := copyFor(a), copyFor(b), copyFor(c)
+
+	// b's signature is spoiled on the way, and comes before c's in key order
+	sig := bad.Inputs[0].Signatures[hex.EncodeToString(b.PublicKey)]
+	sig[10] ^= 0xff
+
+	for _, other := range []*PSBT{bad, good} {
+		if err := p.Combine(other); err != nil {
+			t.Fatalf("Combine: %s", err)
+		}
+	}
+
+	if _, ok := p.Inputs[0].Signatures[hex.EncodeToString(b.PublicKey)]; ok {
+		t.Fatal("bad signature combined")
+	}
+
+	// A bad signature that got in some other way is dropped on finalizing
+	p.Inputs[0].Signatures[hex.EncodeToString(b.PublicKey)] = sig
+
+	complete, err := p.Finalize()
+	if err != nil || !complete {
+		t.Fatalf("Finalize: %v, %v", complete, err)
+	}
+
+	signed, err := p.Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !signed.Verify(prevTXs) {
+		t.Fatal("finalized transaction does not verify")
+	}
+}
@@ -0,0 +1,435 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// Outputs are locked with a script and inputs unlock them with another.
+// To spend an output, the input's unlocking script runs first and the
+// output's locking script then runs on the stack it left behind; the
+// spend is valid if that finishes with a true value on top.
+//
+// The opcodes are a subset of Bitcoin's, with the same byte values, and
+// the interpreter in interpreter.go is bounded by the limits below.
+const (
+	OP_0         = byte(0x00)
+	OP_PUSHDATA1 = byte(0x4c)
+	OP_PUSHDATA2 = byte(0x4d)
+	OP_1NEGATE   = byte(0x4f)
+	OP_1         = byte(0x51)
+	OP_16        = byte(0x60)
+
+	OP_IF     = byte(0x63)
+	OP_NOTIF  = byte(0x64)
+	OP_ELSE   = byte(0x67)
+	OP_ENDIF  = byte(0x68)
+	OP_VERIFY = byte(0x69)
+	OP_RETURN = byte(0x6a)
+
+	OP_DROP = byte(0x75)
+	OP_DUP  = byte(0x76)
+	OP_SWAP = byte(0x7c)
+	OP_SIZE = byte(0x82)
+
+	OP_EQUAL       = byte(0x87)
+	OP_EQUALVERIFY = byte(0x88)
+
+	OP_SHA256  = byte(0xa8)
+	OP_HASH160 = byte(0xa9)
+
+	OP_CHECKSIG            = byte(0xac)
+	OP_CHECKSIGVERIFY      = byte(0xad)
+	OP_CHECKMULTISIG       = byte(0xae)
+	OP_CHECKMULTISIGVERIFY = byte(0xaf)
+
+	OP_CHECKLOCKTIMEVERIFY = byte(0xb1)
+	OP_CHECKSEQUENCEVERIFY = byte(0xb2)
+)
+
+const (
+	MAX_SCRIPT_SIZE         = 10000
+	MAX_SCRIPT_ELEMENT_SIZE = 520
+	MAX_SCRIPT_OPS          = 201
+	MAX_STACK_SIZE          = 1000
+	MAX_MULTISIG_KEYS       = 20
+)
+
+var opNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+var ErrBadScript = errors.New("malformed script")
+
+// scriptOp is one parsed instruction. Data is set for pushes only.
+type scriptOp struct {
+	Code byte
+	Data []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.Code <= OP_16
+}
+
+// parseScript splits a script into its instructions, rejecting unknown
+// opcodes and pushes that run past the end.
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes is over the limit", ErrBadScript, len(script))
+	}
+
+	var ops []scriptOp
+
+	for i := 0; i < len(script); {
+		code := script[i]
+		i++
+
+		size := -1
+
+		switch {
+		case code > OP_0 && code < OP_PUSHDATA1:
+			size = int(code)
+		case code == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrBadScript)
+			}
+			size = int(script[i])
+			i++
+		case code == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrBadScript)
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case code == OP_0 || (code >= OP_1 && code <= OP_16):
+		default:
+			if _, ok := opNames[code]; !ok {
+				return nil, fmt.Errorf("%w: unknown opcode 0x%02x", ErrBadScript, code)
+			}
+		}
+
+		op := scriptOp{Code: code}
+
+		if size >= 0 {
+			if i+size > len(script) {
+				return nil, fmt.Errorf("%w: push of %d bytes runs past the end", ErrBadScript, size)
+			}
+			op.Data = script[i : i+size]
+			i += size
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// ScriptPushes returns the data a script pushes, or nil if it doesn't
+// parse.
+func ScriptPushes(script []byte) [][]byte {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil
+	}
+
+	var pushes [][]byte
+	for _, op := range ops {
+		if op.Data != nil {
+			pushes = append(pushes, op.Data)
+		}
+	}
+
+	return pushes
+}
+
+// DisasmScript renders a script the way Bitcoin tools do: opcode names
+// and hex for pushed data.
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "[error: " + err.Error() + "]"
+	}
+
+	parts := make([]string, len(ops))
+
+	for i, op := range ops {
+		switch {
+		case op.Data != nil:
+			parts[i] = hex.EncodeToString(op.Data)
+		case op.Code >= OP_1 && op.Code <= OP_16:
+			parts[i] = fmt.Sprintf("OP_%d", op.Code-OP_1+1)
+		default:
+			parts[i] = opNames[op.Code]
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// -------------------------------------------------------------
+
+// ScriptBuilder assembles scripts, always choosing the shortest push.
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(ops ...byte) *ScriptBuilder {
+	b.script = append(b.script, ops...)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	size := len(data)
+
+	switch {
+	case size == 0:
+		b.script = append(b.script, OP_0)
+	case size < int(OP_PUSHDATA1):
+		b.script = append(b.script, byte(size))
+	case size <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(size))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(size), byte(size>>8))
+	}
+
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt pushes a number, using OP_1NEGATE and OP_1 to OP_16 where it can.
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(OP_1 + byte(n-1))
+	}
+
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// -------------------------------------------------------------
+
+// P2PKHScript locks an output to the key whose hash is pubKeyHash:
+//
+//	OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func P2PKHScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_DUP, OP_HASH160).
+		AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY, OP_CHECKSIG).
+		Script()
+}
+
+// P2PKHUnlockScript spends a P2PKH output: <signature> <pubKey>.
+func P2PKHUnlockScript(signature, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+// ExtractPubKeyHash returns the key hash a P2PKH locking script pays to.
+func ExtractPubKeyHash(script []byte) ([]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 5 {
+		return nil, false
+	}
+
+	if ops[0].Code != OP_DUP || ops[1].Code != OP_HASH160 || len(ops[2].Data) != 20 ||
+		ops[3].Code != OP_EQUALVERIFY || ops[4].Code != OP_CHECKSIG {
+		return nil, false
+	}
+
+	return ops[2].Data, true
+}
+
+// P2SHScript locks an output to the redeem script whose HASH160 is
+// scriptHash:
+//
+//	OP_HASH160 <scriptHash> OP_EQUAL
+//
+// It is spent by pushing the data the redeem script needs followed by the
+// redeem script itself, which then runs on that data.
+func P2SHScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_HASH160).
+		AddData(scriptHash).
+		AddOp(OP_EQUAL).
+		Script()
+}
+
+// ExtractScriptHash returns the redeem script hash a P2SH locking script
+// commits to.
+func ExtractScriptHash(script []byte) ([]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 3 {
+		return nil, false
+	}
+
+	if ops[0].Code != OP_HASH160 || len(ops[1].Data) != 20 || ops[2].Code != OP_EQUAL {
+		return nil, false
+	}
+
+	return ops[1].Data, true
+}
+
+// ScriptHash is the HASH160 a P2SH output commits to.
+func ScriptHash(redeemScript []byte) []byte {
+	return wallet.PublicKeyHash(redeemScript)
+}
+
+// ErrRedeemScriptSize is returned for a redeem script too large for the
+// single push a P2SH spend reveals it with.
+var ErrRedeemScriptSize = errors.New("redeem script too large")
+
+// CheckRedeemScript checks that an output paying to redeemScript's hash
+// can be spent at all. Coins sent to the P2SH address of a larger script
+// are lost.
+func CheckRedeemScript(redeemScript []byte) error {
+	if len(redeemScript) > MAX_SCRIPT_ELEMENT_SIZE {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrRedeemScriptSize, len(redeemScript), MAX_SCRIPT_ELEMENT_SIZE)
+	}
+	return nil
+}
+
+// P2SHAddress is the address paying to redeemScript.
+func P2SHAddress(redeemScript []byte) string {
+	return wallet.EncodeAddress(wallet.ScriptHashVersion, ScriptHash(redeemScript))
+}
+
+// AddressScript is the locking script that pays to address. Addresses of
+// a version it doesn't know, or with a hash that isn't 20 bytes, are
+// refused rather than paid to a script nobody can spend.
+func AddressScript(address string) ([]byte, error) {
+	version, payload, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case wallet.MultisigVersion:
+		if _, _, ok := ExtractMultisig(payload); !ok {
+			return nil, ErrBadMultisig
+		}
+		return payload, nil
+	case wallet.ScriptHashVersion:
+		if len(payload) != 20 {
+			return nil, fmt.Errorf("%w: script hash is %d bytes", wallet.ErrBadAddress, len(payload))
+		}
+		return P2SHScript(payload), nil
+	case wallet.PubKeyHashVersion:
+		if len(payload) != 20 {
+			return nil, fmt.Errorf("%w: public key hash is %d bytes", wallet.ErrBadAddress, len(payload))
+		}
+		return P2PKHScript(payload), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown version 0x%02x", wallet.ErrBadAddress, version)
+}
+
+// -------------------------------------------------------------
+
+// Numbers on the stack are little-endian with the sign in the top bit of
+// the last byte, and must use as few bytes as possible.
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var out []byte
+	for abs > 0 {
+		out = append(out, byte(abs))
+		abs >>= 8
+	}
+
+	if out[len(out)-1]&0x80 != 0 {
+		extra := byte(0)
+		if negative {
+			extra = 0x80
+		}
+		out = append(out, extra)
+	} else if negative {
+		out[len(out)-1] |= 0x80
+	}
+
+	return out
+}
+
+func decodeScriptNum(data []byte, maxSize int) (int64, error) {
+	if len(data) > maxSize {
+		return 0, fmt.Errorf("%w: number of %d bytes is too long", ErrBadScript, len(data))
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	last := data[len(data)-1]
+	if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("%w: number is not minimally encoded", ErrBadScript)
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << (8 * i)
+	}
+
+	if last&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(data) - 1))
+		n = -n
+	}
+
+	return n, nil
+}
+
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// Negative zero is false
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestAddressScript(t *testing.T) {
+	owner, cosigner := wallet.MakeAccount(), wallet.MakeAccount()
+
+	pubKeyHash := wallet.PublicKeyHash(owner.PublicKey)
+
+	multisig, err := MultisigScript(1, [][]byte{owner.PublicKey, cosigner.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		script  []byte
+		err     error
+	}{
+		{"p2pkh", string(owner.Address()), P2PKHScript(pubKeyHash), nil},
+		{"p2pkh short hash", wallet.EncodeAddress(wallet.PubKeyHashVersion, pubKeyHash[:19]), nil, wallet.ErrBadAddress},
+		{"p2pkh long hash", wallet.EncodeAddress(wallet.PubKeyHashVersion, append(pubKeyHash, 0)), nil, wallet.ErrBadAddress},
+		{"p2sh", P2SHAddress(multisig), P2SHScript(ScriptHash(multisig)), nil},
+		{"p2sh short hash", wallet.EncodeAddress(wallet.ScriptHashVersion, pubKeyHash[:10]), nil, wallet.ErrBadAddress},
+		{"multisig", MultisigAddress(multisig), multisig, nil},
+		{"multisig bad script", wallet.EncodeAddress(wallet.MultisigVersion, pubKeyHash), nil, ErrBadMultisig},
+		{"unknown version", wallet.EncodeAddress(0x6f, pubKeyHash), nil, wallet.ErrBadAddress},
+	}
+
+	for _, test := range tests {
+		script, err := AddressScript(test.address)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+			continue
+		}
+
+		if !bytes.Equal(script, test.script) {
+			t.Errorf("%s: script %x, want %x", test.name, script, test.script)
+		}
+	}
+}
+
+// A P2SH spend pushes its redeem script, so one larger than a stack
+// element could never be spent.
+func TestCheckRedeemScript(t *testing.T) {
+	var pubKeys [][]byte
+	for i := 0; i < 8; i++ {
+		_, pubKey := wallet.NewKeyPair(false)
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	small, err := MultisigScript(2, pubKeys[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckRedeemScript(small); err != nil {
+		t.Fatalf("2-of-3 redeem script: %s", err)
+	}
+
+	large, err := MultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckRedeemScript(large); !errors.Is(err, ErrRedeemScriptSize) {
+		t.Fatalf("%d byte redeem script: %v, want ErrRedeemScriptSize", len(large), err)
+	}
+}
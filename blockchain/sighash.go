@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Every signature ends in a hash type byte saying which parts of the
+// transaction it commits to, as in Bitcoin:
+//
+//	SIGHASH_ALL     every input and every output
+//	SIGHASH_NONE    every input but no outputs, which anyone may change
+//	SIGHASH_SINGLE  every input, and only the output at the signed input's
+//	                index; there must be one
+//
+// With SIGHASH_ANYONECANPAY added, only the signed input is committed to,
+// so others can add inputs of their own. ALL|ANYONECANPAY is a pledge to a
+// crowdfunding transaction that is only valid once the inputs add up, and
+// SINGLE|ANYONECANPAY offers one input for one output. Except with ALL,
+// the sequence numbers of other inputs are not committed to either.
+const (
+	SIGHASH_ALL          = byte(0x01)
+	SIGHASH_NONE         = byte(0x02)
+	SIGHASH_SINGLE       = byte(0x03)
+	SIGHASH_ANYONECANPAY = byte(0x80)
+)
+
+var ErrBadSigHashType = errors.New("invalid sighash type")
+
+var sigHashNames = map[byte]string{
+	SIGHASH_ALL:    "ALL",
+	SIGHASH_NONE:   "NONE",
+	SIGHASH_SINGLE: "SINGLE",
+}
+
+func validSigHashType(hashType byte) bool {
+	_, ok := sigHashNames[hashType&^SIGHASH_ANYONECANPAY]
+	return ok
+}
+
+// SigHashTypeString names a hash type the way ParseSigHashType reads it,
+// such as "ALL" or "SINGLE|ANYONECANPAY".
+func SigHashTypeString(hashType byte) string {
+	name, ok := sigHashNames[hashType&^SIGHASH_ANYONECANPAY]
+	if !ok {
+		return fmt.Sprintf("0x%02x", hashType)
+	}
+
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		name += "|ANYONECANPAY"
+	}
+
+	return name
+}
+
+// ParseSigHashType reads a hash type such as "ALL" or
+// "NONE|ANYONECANPAY". An empty string is SIGHASH_ALL.
+func ParseSigHashType(s string) (byte, error) {
+	if s == "" {
+		return SIGHASH_ALL, nil
+	}
+
+	var hashType byte
+
+	for _, part := range strings.Split(strings.ToUpper(s), "|") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "SIGHASH_")
+
+		if part == "ANYONECANPAY" {
+			hashType |= SIGHASH_ANYONECANPAY
+			continue
+		}
+
+		found := false
+		for base, name := range sigHashNames {
+			if part == name && hashType&^SIGHASH_ANYONECANPAY == 0 {
+				hashType |= base
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("%w: %q", ErrBadSigHashType, s)
+		}
+	}
+
+	if !validSigHashType(hashType) {
+		return 0, fmt.Errorf("%w: %q", ErrBadSigHashType, s)
+	}
+
+	return hashType, nil
+}
+
+// SigHash is the hash input index signs with hashType: the transaction
+// with every unlocking script removed, the locking script of the output
+// it spends in place of its own, and whatever the hash type leaves out
+// removed, followed by the hash type. It is nil for an invalid hash type
+// and for SIGHASH_SINGLE without a matching output.
+func (t *Transaction) SigHash(index int, lockScript []byte, hashType byte) []byte {
+
+	if index < 0 || index >= len(t.Inputs) || !validSigHashType(hashType) {
+		return nil
+	}
+
+	txCopy := t.TrimmedCopy()
+	txCopy.Inputs[index].UnlockScript = lockScript
+
+	switch hashType &^ SIGHASH_ANYONECANPAY {
+	case SIGHASH_NONE:
+		txCopy.Outputs = nil
+		txCopy.clearOtherSequences(index)
+
+	case SIGHASH_SINGLE:
+		if index >= len(txCopy.Outputs) {
+			return nil
+		}
+
+		// Outputs before the signed one only keep their place
+		txCopy.Outputs = txCopy.Outputs[:index+1]
+		for i := 0; i < index; i++ {
+			txCopy.Outputs[i] = TxOutput{Value: -1}
+		}
+		txCopy.clearOtherSequences(index)
+	}
+
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		txCopy.Inputs = txCopy.Inputs[index : index+1]
+	}
+
+	txCopy.ID = []byte{}
+	hash := sha256.Sum256(append(txCopy.Serialize(), hashType))
+
+	return hash[:]
+}
+
+func (t *Transaction) clearOtherSequences(index int) {
+	for i := range t.Inputs {
+		if i != index {
+			t.Inputs[i].Sequence = 0
+		}
+	}
+}
+
+// signInput signs input index, which spends an output locked with
+// lockScript, and returns the signature with hashType appended.
+func (t *Transaction) signInput(privKey *ecdsa.PrivateKey, index int, lockScript []byte, hashType byte) ([]byte, error) {
+
+	hash := t.SigHash(index, lockScript, hashType)
+	if hash == nil {
+		return nil, fmt.Errorf("%w: %s can't sign input %d", ErrBadSigHashType, SigHashTypeString(hashType), index)
+	}
+
+	return append(signHash(privKey, hash), hashType), nil
+}
+
+// checkInputSig checks a signature made by signInput for input index.
+func (t *Transaction) checkInputSig(pubKey, sig []byte, index int, lockScript []byte) bool {
+	if len(sig) < 2 {
+		return false
+	}
+
+	hash := t.SigHash(index, lockScript, sig[len(sig)-1])
+
+	return hash != nil && verifySignature(pubKey, sig[:len(sig)-1], hash)
+}
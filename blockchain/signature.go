@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/i101dev/blockchain-Tensor/util"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// Signatures are DER encoded, as in Bitcoin after BIP 66, and followed by
+// their hash type (see sighash.go):
+//
+//	0x30 <length> 0x02 <length of r> <r> 0x02 <length of s> <s> <hash type>
+//
+// r and s are big-endian in as few bytes as they fit, with a zero byte in
+// front when the top bit is set, so they never read as negative. Anyone
+// can turn a signature with s into one with N-s that verifies just as
+// well, which would change the unlocking script; only the low one, s at
+// most N/2, is valid. So every signature has a single encoding, and
+// scripts fail on any other rather than treating it as a wrong signature.
+const MAX_SIG_SIZE = 72
+
+var ErrBadSignature = errors.New("non-canonical signature")
+
+var curveHalfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// signHash signs hash with privKey, in the encoding above without the
+// hash type.
+func signHash(privKey *ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, hash)
+	util.Handle(err, "Sign Transaction")
+
+	if s.Cmp(curveHalfOrder) > 0 {
+		s.Sub(privKey.Params().N, s)
+	}
+
+	return encodeDER(r, s)
+}
+
+// verifySignature checks a signature made by signHash, which has to be
+// canonical, as does the public key.
+func verifySignature(pubKey, signature, hash []byte) bool {
+
+	r, s, err := parseDER(signature)
+	if err != nil {
+		return false
+	}
+
+	pub, err := wallet.ParsePublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	return ecdsa.Verify(pub, hash, r, s)
+}
+
+func encodeDER(r, s *big.Int) []byte {
+	rb, sb := derInt(r), derInt(s)
+
+	sig := []byte{0x30, byte(4 + len(rb) + len(sb)), 0x02, byte(len(rb))}
+	sig = append(sig, rb...)
+	sig = append(sig, 0x02, byte(len(sb)))
+
+	return append(sig, sb...)
+}
+
+func derInt(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// parseDER reads r and s from a signature without its hash type, refusing
+// anything but the one encoding encodeDER gives a low s signature.
+func parseDER(sig []byte) (*big.Int, *big.Int, error) {
+
+	if len(sig) < 8 || len(sig) > MAX_SIG_SIZE-1 {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrBadSignature, len(sig))
+	}
+
+	if sig[0] != 0x30 || int(sig[1]) != len(sig)-2 {
+		return nil, nil, fmt.Errorf("%w: not a DER sequence", ErrBadSignature)
+	}
+
+	r, rest, err := parseDERInt(sig[2:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, rest, err := parseDERInt(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("%w: trailing bytes", ErrBadSignature)
+	}
+
+	if r.Sign() == 0 || s.Sign() == 0 || r.Cmp(elliptic.P256().Params().N) >= 0 {
+		return nil, nil, fmt.Errorf("%w: r or s out of range", ErrBadSignature)
+	}
+
+	if s.Cmp(curveHalfOrder) > 0 {
+		return nil, nil, fmt.Errorf("%w: high s", ErrBadSignature)
+	}
+
+	return r, s, nil
+}
+
+func parseDERInt(data []byte) (*big.Int, []byte, error) {
+
+	if len(data) < 2 || data[0] != 0x02 {
+		return nil, nil, fmt.Errorf("%w: not a DER integer", ErrBadSignature)
+	}
+
+	n := int(data[1])
+	if n == 0 || n > len(data)-2 {
+		return nil, nil, fmt.Errorf("%w: bad integer length", ErrBadSignature)
+	}
+
+	b := data[2 : 2+n]
+
+	if b[0]&0x80 != 0 {
+		return nil, nil, fmt.Errorf("%w: negative integer", ErrBadSignature)
+	}
+
+	if n > 1 && b[0] == 0 && b[1]&0x80 == 0 {
+		return nil, nil, fmt.Errorf("%w: integer is not minimally encoded", ErrBadSignature)
+	}
+
+	return new(big.Int).SetBytes(b), data[2+n:], nil
+}
+
+// checkSigEncoding checks that a signature as found in a script, with its
+// hash type, is canonical. An empty one is a signature that is simply
+// wrong, such as the ones a multisig input starts out with.
+func checkSigEncoding(sig []byte) error {
+	if len(sig) == 0 {
+		return nil
+	}
+
+	if !validSigHashType(sig[len(sig)-1]) {
+		return fmt.Errorf("%w: hash type 0x%02x", ErrBadSigHashType, sig[len(sig)-1])
+	}
+
+	_, _, err := parseDER(sig[:len(sig)-1])
+	return err
+}
+
+// pubKeyFor returns the form of privKey's public key, see wallet, that
+// hashes to pubKeyHash, nil if neither does.
+func pubKeyFor(privKey *ecdsa.PrivateKey, pubKeyHash []byte) []byte {
+	for _, pubKey := range wallet.PublicKeyEncodings(&privKey.PublicKey) {
+		if bytes.Equal(wallet.PublicKeyHash(pubKey), pubKeyHash) {
+			return pubKey
+		}
+	}
+	return nil
+}
+
+// pubKeyAmong returns the form of privKey's public key found in keys, nil
+// if neither is.
+func pubKeyAmong(privKey *ecdsa.PrivateKey, keys [][]byte) []byte {
+	for _, pubKey := range wallet.PublicKeyEncodings(&privKey.PublicKey) {
+		for _, key := range keys {
+			if bytes.Equal(key, pubKey) {
+				return pubKey
+			}
+		}
+	}
+	return nil
+}
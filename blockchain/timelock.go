@@ -0,0 +1,303 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A transaction's LockTime is the first block it may be confirmed in: a
+// block height below LOCKTIME_THRESHOLD, a Unix time in seconds at or
+// above it, and zero for no lock.
+//
+// An input's Sequence is a lock relative to the block that confirmed the
+// output it spends, as in BIP 68: the low 16 bits count blocks, or units
+// of 512 seconds when SEQUENCE_TYPE_FLAG is set. Zero is no lock.
+//
+// OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY let a locking script
+// demand a minimum for either, which is how outputs are made unspendable
+// before a given time.
+//
+// Time locks are judged against the median time past of the chain a block
+// builds on, as in BIP 113, not against the block's own timestamp, which
+// its miner picks. A block must be stamped after that median and no more
+// than MAX_FUTURE_BLOCK_TIME ahead of the clock of the node checking it.
+const (
+	LOCKTIME_THRESHOLD   = 500000000
+	SEQUENCE_TYPE_FLAG   = 1 << 22
+	SEQUENCE_LOCK_MASK   = 0x0000ffff
+	SEQUENCE_GRANULARITY = 9
+
+	MEDIAN_TIME_SPAN      = 11
+	MAX_FUTURE_BLOCK_TIME = 2 * time.Hour
+)
+
+var (
+	ErrLocked       = errors.New("transaction is not final")
+	ErrBadTimestamp = errors.New("invalid block timestamp")
+)
+
+// isTimeLock reports whether an absolute lock is a Unix time rather than
+// a block height.
+func isTimeLock(lock int64) bool {
+	return lock >= LOCKTIME_THRESHOLD
+}
+
+// lockReached reports whether an absolute lock is met by a block at height
+// with the given time.
+func lockReached(lock int64, height int, timestamp int64) bool {
+	if isTimeLock(lock) {
+		return timestamp >= lock
+	}
+	return int64(height) >= lock
+}
+
+// UnixTime is the block's timestamp in seconds, the unit lock times use.
+func (b *Block) UnixTime() int64 {
+	return b.Timestamp / int64(time.Second)
+}
+
+// MedianTimePast is the median UnixTime of the block with the given hash
+// and up to MEDIAN_TIME_SPAN-1 of its ancestors. It is the time locks are
+// judged against for a block built on that one.
+func (chain *Blockchain) MedianTimePast(hash []byte) (int64, error) {
+
+	var times []int64
+
+	for len(times) < MEDIAN_TIME_SPAN {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return 0, err
+		}
+
+		times = append(times, block.UnixTime())
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		hash = block.PrevHash
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	return times[len(times)/2], nil
+}
+
+// lockStart is the time relative locks on outputs confirmed in block count
+// from: the median time past before it, as in BIP 68. Genesis has none and
+// counts from its own time.
+func (chain *Blockchain) lockStart(block *Block) (int64, error) {
+	if len(block.PrevHash) == 0 {
+		return block.UnixTime(), nil
+	}
+	return chain.MedianTimePast(block.PrevHash)
+}
+
+// checkBlockTime checks that block is stamped after the median time past
+// of its parent and not too far ahead of now.
+func (chain *Blockchain) checkBlockTime(block *Block, now time.Time) error {
+
+	medianTime, err := chain.MedianTimePast(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	if block.UnixTime() <= medianTime {
+		return fmt.Errorf("%w: %d is not after the median time past %d", ErrBadTimestamp, block.UnixTime(), medianTime)
+	}
+
+	if limit := now.Add(MAX_FUTURE_BLOCK_TIME); block.Timestamp > limit.UnixNano() {
+		return fmt.Errorf("%w: %d is more than %s in the future", ErrBadTimestamp, block.UnixTime(), MAX_FUTURE_BLOCK_TIME)
+	}
+
+	return nil
+}
+
+// nextBlockTime is the timestamp, in Unix nanoseconds, to mine a block on
+// parent with: now, unless that is not after the median time past.
+func (chain *Blockchain) nextBlockTime(parent []byte, now time.Time) (int64, error) {
+
+	medianTime, err := chain.MedianTimePast(parent)
+	if err != nil {
+		return 0, err
+	}
+
+	if earliest := time.Unix(medianTime+1, 0); now.Before(earliest) {
+		return earliest.UnixNano(), nil
+	}
+
+	return now.UnixNano(), nil
+}
+
+// CheckLocks checks that t may be confirmed in a block at height whose
+// median time past is medianTime. confirmedIn finds the block a spent
+// transaction was confirmed in and the time relative locks on its outputs
+// count from, and is only needed for inputs with a relative lock.
+func (t *Transaction) CheckLocks(height int, medianTime int64, confirmedIn func(txID []byte) (*Block, int64, error)) error {
+
+	if t.LockTime < 0 {
+		return fmt.Errorf("%w: negative lock time %d", ErrLocked, t.LockTime)
+	}
+
+	if t.LockTime > 0 && !lockReached(t.LockTime, height, medianTime) {
+		return fmt.Errorf("%w: locked until %d", ErrLocked, t.LockTime)
+	}
+
+	if t.IsCoinbase() {
+		return nil
+	}
+
+	for inId, in := range t.Inputs {
+
+		lock := in.Sequence & SEQUENCE_LOCK_MASK
+		if lock == 0 {
+			continue
+		}
+
+		prevBlock, start, err := confirmedIn(in.ID)
+		if err != nil {
+			return fmt.Errorf("%w: input %d spends %x, which is not confirmed", ErrLocked, inId, in.ID)
+		}
+
+		if in.Sequence&SEQUENCE_TYPE_FLAG != 0 {
+			unlock := start + int64(lock)<<SEQUENCE_GRANULARITY
+			if medianTime < unlock {
+				return fmt.Errorf("%w: input %d is locked until %d", ErrLocked, inId, unlock)
+			}
+		} else {
+			unlock := prevBlock.Height + int(lock)
+			if height < unlock {
+				return fmt.Errorf("%w: input %d is locked until block %d", ErrLocked, inId, unlock)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NextLockPoint is what the locks of a transaction in the next block on
+// the main chain are judged against: that block's height and the tip's
+// median time past. A lock time no later than either is final.
+func (chain *Blockchain) NextLockPoint() (int, int64, error) {
+
+	lastHash, err := chain.GetLastHash(chain.Database)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lastBlock, err := chain.GetBlock(lastHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	medianTime, err := chain.MedianTimePast(lastHash)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return lastBlock.Height + 1, medianTime, nil
+}
+
+// CheckTxLocks checks that tx's locks let it into the next block on the
+// main chain.
+func (chain *Blockchain) CheckTxLocks(tx *Transaction) error {
+
+	height, medianTime, err := chain.NextLockPoint()
+	if err != nil {
+		return err
+	}
+
+	confirmedIn := func(txID []byte) (*Block, int64, error) {
+		block, err := chain.FindTransactionBlock(txID)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		start, err := chain.lockStart(block)
+		return block, start, err
+	}
+
+	return tx.CheckLocks(height, medianTime, confirmedIn)
+}
+
+// checkBlockLocks checks the locks of every transaction in block, which
+// may spend outputs of earlier transactions in the same block or of any
+// block on its own branch.
+func (chain *Blockchain) checkBlockLocks(block *Block) error {
+
+	medianTime, err := chain.MedianTimePast(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	confirmedIn := func(txID []byte) (*Block, int64, error) {
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txID) {
+				return block, medianTime, nil
+			}
+		}
+
+		prevBlock, err := chain.findTransactionBlockFrom(block.PrevHash, txID)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		start, err := chain.lockStart(prevBlock)
+		return prevBlock, start, err
+	}
+
+	for _, tx := range block.Transactions {
+		if err := tx.CheckLocks(block.Height, medianTime, confirmedIn); err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// -------------------------------------------------------------
+
+// TimeLockScript makes an output locked with script unspendable before
+// lockTime, a block height or Unix time as for Transaction.LockTime:
+//
+//	<lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP <script>
+func TimeLockScript(lockTime int64, script []byte) []byte {
+	prefix := NewScriptBuilder().
+		AddInt(lockTime).
+		AddOp(OP_CHECKLOCKTIMEVERIFY).
+		AddOp(OP_DROP).
+		Script()
+
+	return append(prefix, script...)
+}
+
+// ExtractTimeLock splits a script made by TimeLockScript into its lock
+// time and the script it wraps. Scripts without a time lock come back
+// whole with a lock time of zero.
+func ExtractTimeLock(script []byte) (int64, []byte) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 3 || ops[1].Code != OP_CHECKLOCKTIMEVERIFY || ops[2].Code != OP_DROP {
+		return 0, script
+	}
+
+	var lockTime int64
+	switch {
+	case ops[0].Code >= OP_1 && ops[0].Code <= OP_16:
+		lockTime = int64(ops[0].Code-OP_1) + 1
+	case ops[0].Data != nil:
+		if lockTime, err = decodeScriptNum(ops[0].Data, 5); err != nil || lockTime <= 0 {
+			return 0, script
+		}
+	default:
+		return 0, script
+	}
+
+	prefix := TimeLockScript(lockTime, nil)
+	if !bytes.HasPrefix(script, prefix) {
+		return 0, script
+	}
+
+	return lockTime, script[len(prefix):]
+}
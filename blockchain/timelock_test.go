@@ -0,0 +1,171 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// mineAt mines txs after a coinbase, failing the test if that fails.
+func mineAt(t *testing.T, chain *Blockchain, now time.Time, txs ...*Transaction) *Block {
+	t.Helper()
+
+	block, err := chain.MineBlockAt(append([]*Transaction{CoinbaseTX(testAddress, "")}, txs...), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestBlockTimestamps(t *testing.T) {
+	chain, err := LoadBlockchainAt(t.TempDir(), testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	OpenDB(chain)
+	defer chain.CloseDB()
+
+	start := time.Unix(1700000000, 0)
+
+	// Three blocks a minute apart, then one whose miner's clock is behind:
+	// the median of 0, 1700000000, +60 and +120 is +60, so it is stamped
+	// just after that
+	for i := 0; i < 3; i++ {
+		mineAt(t, chain, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	late := mineAt(t, chain, start)
+	if want := start.Add(time.Minute).Unix() + 1; late.UnixTime() != want {
+		t.Fatalf("block mined with a slow clock is stamped %d, want %d", late.UnixTime(), want)
+	}
+
+	medianTime, err := chain.MedianTimePast(late.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := start.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		ok        bool
+	}{
+		{"at the median time past", time.Unix(medianTime, 0), false},
+		{"just after the median time past", time.Unix(medianTime+1, 0), true},
+		{"two hours ahead", now.Add(MAX_FUTURE_BLOCK_TIME), true},
+		{"more than two hours ahead", now.Add(MAX_FUTURE_BLOCK_TIME + time.Second), false},
+	}
+
+	for _, test := range tests {
+		block, err := CreateBlock([]*Transaction{CoinbaseTX(testAddress, "")}, late.Hash, late.Height+1, test.timestamp.UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = chain.AddBlockAt(block, now)
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && !errors.Is(err, ErrBadTimestamp) {
+			t.Errorf("%s: %v, want ErrBadTimestamp", test.name, err)
+		}
+	}
+}
+
+// A time lock is judged against the median time past, not the clock or a
+// timestamp a miner picks.
+func TestLockTimeMedianTimePast(t *testing.T) {
+	chain, err := LoadBlockchainAt(t.TempDir(), testAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	OpenDB(chain)
+	defer chain.CloseDB()
+
+	start := time.Unix(1700000000, 0)
+
+	var tip *Block
+	for i := 0; i < 5; i++ {
+		tip = mineAt(t, chain, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	medianTime, err := chain.MedianTimePast(tip.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := CoinbaseTX(testAddress, "")
+
+	// Past the tip's own timestamp, but not the median time past
+	tx.LockTime = tip.UnixTime()
+	if err := chain.CheckTxLocks(tx); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock at the tip's time with median time past %d: %v, want ErrLocked", medianTime, err)
+	}
+
+	tx.LockTime = medianTime
+	if err := chain.CheckTxLocks(tx); err != nil {
+		t.Fatalf("lock at the median time past: %s", err)
+	}
+}
+
+// A wallet spend of a time locked output takes its lock time from the
+// median time past, so it is final as soon as the lock has passed, even
+// though the median lags the clock.
+func TestSpendTimeLockedOutput(t *testing.T) {
+	sender, receiver := wallet.MakeAccount(), wallet.MakeAccount()
+	w := &wallet.Wallet{Accounts: map[string]*wallet.Account{
+		string(sender.Address()):   sender,
+		string(receiver.Address()): receiver,
+	}}
+
+	chain, err := LoadBlockchainAt(t.TempDir(), string(sender.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	OpenDB(chain)
+	defer chain.CloseDB()
+
+	UTXO := &UTXOSet{chain}
+	start := time.Unix(1700000000, 0)
+	notBefore := start.Add(time.Minute).Unix()
+
+	locked := NewTimeLockedTransaction(string(sender.Address()), string(receiver.Address()), 5, notBefore, UTXO, w)
+	UTXO.Update(mineAt(t, chain, start, locked))
+
+	// Move the median time past beyond the lock
+	for i := 1; i <= 4; i++ {
+		UTXO.Update(mineAt(t, chain, start.Add(time.Duration(i)*time.Minute)))
+	}
+
+	spend := NewTransaction(string(receiver.Address()), testAddress, 5, UTXO, w)
+	if spend.LockTime < notBefore || !isTimeLock(spend.LockTime) {
+		t.Fatalf("spend has lock time %d, want a time of at least %d", spend.LockTime, notBefore)
+	}
+
+	block, err := chain.MineBlock([]*Transaction{CoinbaseTX(testAddress, ""), spend})
+	if err != nil {
+		t.Fatalf("mining the spend: %s", err)
+	}
+	UTXO.Update(block)
+
+	if len(UTXO.FindUnspentTransactions(wallet.PublicKeyHash(receiver.PublicKey))) != 0 {
+		t.Fatal("locked output is still unspent")
+	}
+
+	// A transaction that is not final yet is refused, not mined
+	early := NewTimeLockedTransaction(string(sender.Address()), string(receiver.Address()), 1, 0, UTXO, w)
+	early.LockTime = time.Now().Add(time.Hour).Unix()
+	early.ID = early.ComputeID()
+	chain.SignTransaction(early, sender.PrivateKey)
+
+	if _, err := chain.MineBlock([]*Transaction{CoinbaseTX(testAddress, ""), early}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("mining a transaction that is not final: %v, want ErrLocked", err)
+	}
+}
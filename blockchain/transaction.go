@@ -1,17 +1,14 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/i101dev/blockchain-Tensor/util"
@@ -19,9 +16,10 @@ import (
 )
 
 type Transaction struct {
-	ID      []byte // the hash of the transaction
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte // the hash of the transaction
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime int64 // see timelock.go
 }
 
 func (t *Transaction) Print() {
@@ -35,19 +33,18 @@ func (t *Transaction) Print() {
 	for _, output := range t.Outputs {
 		output.Print()
 	}
+	if t.LockTime != 0 {
+		fmt.Printf("\n> LockTime: %d\n", t.LockTime)
+	}
 }
 
+// Serialize returns the canonical encoding described in encoding.go.
 func (t Transaction) Serialize() []byte {
 
-	var encoded bytes.Buffer
-
-	encoder := gob.NewEncoder(&encoded)
-
-	if err := encoder.Encode(t); err != nil {
-		util.Handle(err, "Serialize Transaction")
-	}
+	var e encoder
+	t.encode(&e)
 
-	return encoded.Bytes()
+	return e.buf
 }
 
 func (t *Transaction) Hash() []byte {
@@ -62,6 +59,22 @@ func (t *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+// ComputeID works out what the transaction's ID should be from its
+// contents. IDs are taken before signing, so unlocking scripts are left
+// out, except for a coinbase's which holds its extra data.
+func (t *Transaction) ComputeID() []byte {
+
+	if t.IsCoinbase() {
+		return t.Hash()
+	}
+
+	txCopy := t.TrimmedCopy()
+
+	return txCopy.Hash()
+}
+
+// Sign signs every input with the P2PKH template and SIGHASH_ALL, so each
+// must spend an output locked to privKey.
 func (t *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if t.IsCoinbase() {
 		return
@@ -73,31 +86,98 @@ func (t *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transact
 		}
 	}
 
-	txCopy := t.TrimmedCopy()
+	for inId := range t.Inputs {
+		err := t.SignInput(inId, privKey, prevTXs, SIGHASH_ALL)
+		util.Handle(err, "Sign")
+	}
+}
 
-	for inId, in := range txCopy.Inputs {
+// SignInput signs input index with the P2PKH template and the given hash
+// type, see sighash.go. The other inputs are left as they are, so several
+// parties can each sign their own.
+func (t *Transaction) SignInput(index int, privKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType byte) error {
 
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.Inputs[inId].Signature = nil
+	if index < 0 || index >= len(t.Inputs) {
+		return fmt.Errorf("input %d does not exist", index)
+	}
 
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+	lockScript, err := spentLockScript(t.Inputs[index], prevTXs)
+	if err != nil {
+		return err
+	}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		util.Handle(err, "Sign Transaction")
+	spent := TxOutput{LockScript: lockScript}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+	pubKey := pubKeyFor(&privKey, spent.PubKeyHash())
+	if pubKey == nil {
+		return fmt.Errorf("input %d is not locked to this key", index)
+	}
 
-		t.Inputs[inId].Signature = signature
+	sig, err := t.signInput(&privKey, index, lockScript, hashType)
+	if err != nil {
+		return err
 	}
+
+	t.Inputs[index].UnlockScript = P2PKHUnlockScript(sig, pubKey)
+
+	return nil
 }
 
+// SignKeyInputs signs, with the given hash type, every input spending an
+// output locked to privKey, and returns how many it signed. Inputs it
+// doesn't know the spent output of are someone else's and left alone.
+func (t *Transaction) SignKeyInputs(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType byte) (int, error) {
+
+	signed := 0
+
+	for inId, in := range t.Inputs {
+
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTX.Outputs) || pubKeyFor(&privKey, prevTX.Outputs[in.Out].PubKeyHash()) == nil {
+			continue
+		}
+
+		if err := t.SignInput(inId, privKey, prevTXs, hashType); err != nil {
+			return signed, err
+		}
+		signed++
+	}
+
+	return signed, nil
+}
+
+// ErrDuplicateInput is returned for a transaction that spends the same
+// output twice, which would count its value twice.
+var ErrDuplicateInput = errors.New("output spent twice")
+
+// CheckDuplicateInputs checks that no two inputs spend the same output.
+func (t *Transaction) CheckDuplicateInputs() error {
+	spent := make(map[string]bool)
+
+	for inId, in := range t.Inputs {
+		if spent[in.OutpointKey()] {
+			return fmt.Errorf("%w: input %d spends %s again", ErrDuplicateInput, inId, in.OutpointKey())
+		}
+		spent[in.OutpointKey()] = true
+	}
+
+	return nil
+}
+
+// Verify runs each input's unlocking script against the locking script of
+// the output it spends, and checks that the outputs don't pay out more
+// than the inputs bring in. The difference, if any, is lost. No output may
+// be spent twice.
 func (t *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if t.IsCoinbase() {
 		return true
 	}
 
+	if err := t.CheckDuplicateInputs(); err != nil {
+		fmt.Printf("transaction %x: %s\n", t.ID, err)
+		return false
+	}
+
 	// Verify each of the inputs exists
 	for _, in := range t.Inputs {
 		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
@@ -105,43 +185,35 @@ func (t *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		}
 	}
 
-	txCopy := t.TrimmedCopy()
-	curve := elliptic.P256()
+	valueIn, valueOut := 0, 0
+
+	for _, out := range t.Outputs {
+		if out.Value < 0 {
+			return false
+		}
+		valueOut += out.Value
+	}
 
 	for inId, in := range t.Inputs {
 
-		// Same as what's in the Transaction.Sign() method
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		// Deconstruct the signature
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		// Deconstruct the public key
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{
-			Curve: curve,
-			X:     &x,
-			Y:     &y,
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false
 		}
 
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
+		valueIn += prevTx.Outputs[in.Out].Value
+
+		if err := VerifyScript(in.UnlockScript, prevTx.Outputs[in.Out].LockScript, t, inId); err != nil {
+			fmt.Printf("input %d of %x: %s\n", inId, t.ID, err)
 			return false
 		}
 	}
 
+	if valueOut > valueIn {
+		fmt.Printf("transaction %x pays out %d but spends only %d\n", t.ID, valueOut, valueIn)
+		return false
+	}
+
 	return true
 }
 
@@ -150,27 +222,29 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.Out, in.ID, nil, nil})
+		inputs = append(inputs, TxInput{in.Out, in.ID, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.LockScript})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		ID      string     `json:"id"`
-		Inputs  []TxInput  `json:"inputs"`
-		Outputs []TxOutput `json:"outputs"`
+		ID       string     `json:"id"`
+		Inputs   []TxInput  `json:"inputs"`
+		Outputs  []TxOutput `json:"outputs"`
+		LockTime int64      `json:"lock_time"`
 	}{
-		ID:      hex.EncodeToString(t.ID),
-		Inputs:  t.Inputs,
-		Outputs: t.Outputs,
+		ID:       hex.EncodeToString(t.ID),
+		Inputs:   t.Inputs,
+		Outputs:  t.Outputs,
+		LockTime: t.LockTime,
 	})
 }
 
@@ -198,12 +272,19 @@ func (t *Transaction) MarshalJSON() ([]byte, error) {
 // }
 
 func (tx *Transaction) IsCoinbase() bool {
-	lenOne := len(tx.Inputs) == 1
+	if len(tx.Inputs) != 1 {
+		return false
+	}
+
 	idZero := len(tx.Inputs[0].ID) == 0
 	outOne := tx.Inputs[0].Out == -1
-	return lenOne && idZero && outOne
+	return idZero && outOne
 }
 
+// COINBASE_SUBSIDY is what a coinbase creates. It may also claim the fees
+// of the block's other transactions, what they spend but don't pay out.
+const COINBASE_SUBSIDY = 20
+
 func CoinbaseTX(to string, data string) *Transaction {
 
 	if data == "" {
@@ -216,14 +297,14 @@ func CoinbaseTX(to string, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
+	// A coinbase spends nothing, so its unlocking script only carries data
 	txIn := TxInput{
-		ID:        []byte{},
-		Out:       -1,
-		Signature: nil,
-		PubKey:    []byte(data),
+		ID:           []byte{},
+		Out:          -1,
+		UnlockScript: NewScriptBuilder().AddData([]byte(data)).Script(),
 	}
 
-	txOut := NewTXOutput(20, to)
+	txOut := NewTXOutput(COINBASE_SUBSIDY, to)
 
 	newTX := Transaction{
 		ID:      nil,
@@ -237,50 +318,129 @@ func CoinbaseTX(to string, data string) *Transaction {
 }
 
 func NewTransaction(from, to string, amount int, UTXO *UTXOSet, senderWallet *wallet.Wallet) *Transaction {
+	return NewTimeLockedTransaction(from, to, amount, 0, UTXO, senderWallet)
+}
+
+// NewTimeLockedTransaction is NewTransaction with the payment locked until
+// notBefore, a block height or Unix time, or unlocked for zero. Outputs
+// the sender holds that are still locked are left alone.
+func NewTimeLockedTransaction(from, to string, amount int, notBefore int64, UTXO *UTXOSet, senderWallet *wallet.Wallet) *Transaction {
 
 	// blockchain.OpenDB(chain)
 	// defer chain.CloseDB()
 
-	var inputs []TxInput
-	var outputs []TxOutput
+	payment := NewTXOutput(amount, to)
+	if notBefore != 0 {
+		payment.LockScript = TimeLockScript(notBefore, payment.LockScript)
+	}
+
+	return newWalletTransaction(from, amount, []TxOutput{*payment}, UTXO, senderWallet)
+}
+
+// NewDataTransaction anchors data in a data output. A transaction needs
+// an input to be signed and unique, so it spends one of from's outputs
+// and pays it straight back.
+func NewDataTransaction(from string, data []byte, UTXO *UTXOSet, senderWallet *wallet.Wallet) (*Transaction, error) {
+
+	dataOut, err := NewDataOutput(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWalletTransaction(from, 1, []TxOutput{*dataOut}, UTXO, senderWallet), nil
+}
+
+// newWalletTransaction signs a transaction from the wallet account from
+// with the given outputs, gathering at least amount of its outputs and
+// returning what the outputs don't use as change.
+func newWalletTransaction(from string, amount int, payments []TxOutput, UTXO *UTXOSet, senderWallet *wallet.Wallet) *Transaction {
 
 	w := senderWallet.GetAccount(from)
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	tx, err := newUnsignedTransaction(wallet.PublicKeyHash(w.PublicKey), amount, payments, UTXO)
+	if err != nil {
+		log.Panic("Error: ", err)
+	}
+
+	UTXO.Blockchain.SignTransaction(tx, w.PrivateKey)
+
+	return tx
+}
+
+// newUnsignedTransaction is newWalletTransaction without the signing, for
+// the key hashing to pubKeyHash, so it doesn't need the key itself.
+func newUnsignedTransaction(pubKeyHash []byte, amount int, payments []TxOutput, UTXO *UTXOSet) (*Transaction, error) {
+
+	var inputs []TxInput
+	outputs := payments
+
+	paid := 0
+	for _, out := range payments {
+		paid += out.Value
+	}
+
+	from := wallet.PubKeyHashToAddr(pubKeyHash)
+
+	// Spending a time locked output needs a lock time of the same kind that
+	// has reached it. The first such output picks the kind: the next block
+	// height, or the tip's median time past, which the lock is judged
+	// against and which lags the clock.
+	height, medianTime, err := UTXO.Blockchain.NextLockPoint()
+	if err != nil {
+		return nil, err
+	}
+	var lockTime int64
+
+	acc, validOutputs := UTXO.findSpendable(func(out *TxOutput) bool {
+		if !out.IsLockedWithKey(pubKeyHash) {
+			return false
+		}
+
+		notBefore := out.NotBefore()
+		if notBefore == 0 {
+			return true
+		}
+
+		if lockTime == 0 {
+			lockTime = int64(height)
+			if isTimeLock(notBefore) {
+				lockTime = medianTime
+			}
+		}
+
+		return isTimeLock(notBefore) == isTimeLock(lockTime) && notBefore <= lockTime
+	}, amount)
 
 	if acc < amount {
-		log.Panic("Error: not enough funds")
+		return nil, fmt.Errorf("not enough funds: have %d, need %d", acc, amount)
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		util.Handle(err, "NewTransaction 1")
+		if err != nil {
+			return nil, err
+		}
 
 		for _, out := range outs {
-			input := TxInput{out, txID, nil, w.PublicKey}
+			input := TxInput{out, txID, nil, 0}
 			inputs = append(inputs, input)
 		}
 	}
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
-
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	if acc > paid {
+		outputs = append(outputs, *NewTXOutput(acc-paid, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
 
-	return &tx
+	return &tx, nil
 }
 
+// DeserializeTransaction is DecodeTransaction for data the node wrote
+// itself, where a decoding failure means corruption.
 func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
+	transaction, err := DecodeTransaction(data)
 	util.Handle(err, "DeserializeTransaction")
 	return transaction
 }
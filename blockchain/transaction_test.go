@@ -0,0 +1,184 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+func TestDuplicateInputs(t *testing.T) {
+	owner := wallet.MakeAccount()
+
+	chain, err := LoadBlockchainAt(t.TempDir(), string(owner.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	OpenDB(chain)
+	defer chain.CloseDB()
+
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase := genesis.Transactions[0]
+	prevTXs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+	value := coinbase.Outputs[0].Value
+
+	spend := func(inputs int, value int) *Transaction {
+		tx := &Transaction{Outputs: []TxOutput{*NewTXOutput(value, string(owner.Address()))}}
+		for i := 0; i < inputs; i++ {
+			tx.Inputs = append(tx.Inputs, TxInput{ID: coinbase.ID, Out: 0})
+		}
+		tx.ID = tx.ComputeID()
+		tx.Sign(owner.PrivateKey, prevTXs)
+		return tx
+	}
+
+	// Spending the coinbase twice in one transaction would pay out double
+	twice := spend(2, 2*value)
+
+	if !errors.Is(twice.CheckDuplicateInputs(), ErrDuplicateInput) {
+		t.Fatal("duplicate inputs not detected")
+	}
+
+	if twice.Verify(prevTXs) {
+		t.Fatal("transaction spending an output twice verifies")
+	}
+
+	// Or once in each of two transactions in the same block
+	a, b := spend(1, value), spend(1, value-1)
+
+	if !a.Verify(prevTXs) || !b.Verify(prevTXs) {
+		t.Fatal("single spends do not verify")
+	}
+
+	reward := CoinbaseTX(string(owner.Address()), "reward")
+
+	block, err := CreateBlock([]*Transaction{reward, a, b}, genesis.Hash, 1, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.AddBlock(block); !errors.Is(err, ErrDuplicateInput) {
+		t.Fatalf("block spending an output twice: %v, want ErrDuplicateInput", err)
+	}
+
+	block, err = CreateBlock([]*Transaction{reward, a}, genesis.Hash, 1, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.AddBlock(block); err != nil {
+		t.Fatalf("block spending the output once: %s", err)
+	}
+
+	// Or again in a later block on the same branch
+	again, err := CreateBlock([]*Transaction{CoinbaseTX(string(owner.Address()), "again"), b}, block.Hash, 2, time.Now().Add(time.Second).UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.AddBlock(again); !errors.Is(err, ErrDuplicateInput) {
+		t.Fatalf("block spending a spent output: %v, want ErrDuplicateInput", err)
+	}
+}
+
+func TestCoinbaseRules(t *testing.T) {
+	owner := wallet.MakeAccount()
+
+	chain, err := LoadBlockchainAt(t.TempDir(), string(owner.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	OpenDB(chain)
+	defer chain.CloseDB()
+
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase := genesis.Transactions[0]
+	prevTXs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+	// Spending the genesis coinbase for 5 less leaves a fee of 5
+	spend := &Transaction{
+		Inputs:  []TxInput{{ID: coinbase.ID, Out: 0}},
+		Outputs: []TxOutput{*NewTXOutput(coinbase.Outputs[0].Value-5, string(owner.Address()))},
+	}
+	spend.ID = spend.ComputeID()
+	spend.Sign(owner.PrivateKey, prevTXs)
+
+	reward := func(value int, data string) *Transaction {
+		tx := CoinbaseTX(string(owner.Address()), data)
+		tx.Outputs[0].Value = value
+		tx.ID = tx.ComputeID()
+		return tx
+	}
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		err  error
+	}{
+		{"no coinbase", []*Transaction{spend}, ErrBadCoinbase},
+		{"two coinbases", []*Transaction{reward(1, "a"), reward(1, "b"), spend}, ErrBadCoinbase},
+		{"overpaid", []*Transaction{reward(COINBASE_SUBSIDY+6, "over"), spend}, ErrBadCoinbase},
+		{"subsidy and fees", []*Transaction{reward(COINBASE_SUBSIDY+5, "exact"), spend}, nil},
+	}
+
+	for _, test := range tests {
+		block, err := CreateBlock(test.txs, genesis.Hash, 1, time.Now().UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := chain.AddBlock(block); !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// Coins paid to an account with a key from before SEC1 stay spendable,
+// also when the key is from before keys were fixed length and X or Y is
+// short.
+func TestLegacyKeySpend(t *testing.T) {
+	short := wallet.MakeAccount()
+	for len(short.PrivateKey.X.Bytes()) == 32 && len(short.PrivateKey.Y.Bytes()) == 32 {
+		short = wallet.MakeAccount()
+	}
+
+	tests := []struct {
+		name   string
+		owner  *wallet.Account
+		pubKey []byte
+	}{
+		{"64 bytes", short, wallet.LegacyPublicKeyBytes(&short.PrivateKey.PublicKey)},
+		{"short", short, append(short.PrivateKey.X.Bytes(), short.PrivateKey.Y.Bytes()...)},
+	}
+
+	for _, test := range tests {
+		owner := *test.owner
+		owner.PublicKey = test.pubKey
+
+		coinbase := CoinbaseTX(string(owner.Address()), "legacy")
+		prevTXs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+		tx := &Transaction{
+			Inputs:  []TxInput{{ID: coinbase.ID, Out: 0}},
+			Outputs: []TxOutput{*NewTXOutput(coinbase.Outputs[0].Value, string(wallet.MakeAccount().Address()))},
+		}
+		tx.ID = tx.ComputeID()
+		tx.Sign(owner.PrivateKey, prevTXs)
+
+		if !tx.Verify(prevTXs) {
+			t.Errorf("%s: spend with a legacy key does not verify", test.name)
+		}
+	}
+}
@@ -14,35 +14,53 @@ import (
 // ---------------------------------------------------------------------
 
 type TxInput struct {
-	Out       int
-	ID        []byte
-	Signature []byte
-	PubKey    []byte
+	Out          int
+	ID           []byte
+	UnlockScript []byte
+	Sequence     uint32 // relative lock, see timelock.go
 }
 
+// UsesKey reports whether the input is signed by the key whose hash is
+// pubKeyHash, which for a P2PKH spend is the last thing it pushes.
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+	pushes := ScriptPushes(in.UnlockScript)
+	if len(pushes) == 0 {
+		return false
+	}
+
+	lockingHash := wallet.PublicKeyHash(pushes[len(pushes)-1])
 	return bytes.Equal(lockingHash, pubKeyHash)
 }
 
+// OutpointKey names the output the input spends, for telling whether two
+// inputs spend the same one.
+func (in *TxInput) OutpointKey() string {
+	return fmt.Sprintf("%x:%d", in.ID, in.Out)
+}
+
 func (in *TxInput) Print() {
 	fmt.Println("    **")
 	fmt.Printf("    | ID: %x\n", in.ID)
 	fmt.Printf("    | Out: %d\n", in.Out)
-	fmt.Printf("    | Signature: %s\n", in.Signature)
+	fmt.Printf("    | Unlock: %s\n", DisasmScript(in.UnlockScript))
+	if in.Sequence != 0 {
+		fmt.Printf("    | Sequence: %d\n", in.Sequence)
+	}
 }
 
 func (in *TxInput) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		ID        string `json:"id"`
-		Out       int    `json:"out"`
-		Signature string `json:"signature"`
-		PubKey    string `json:"pubkey"`
+		ID           string `json:"id"`
+		Out          int    `json:"out"`
+		UnlockScript string `json:"unlock_script"`
+		UnlockAsm    string `json:"unlock_asm"`
+		Sequence     uint32 `json:"sequence"`
 	}{
-		ID:        hex.EncodeToString(in.ID),
-		Out:       in.Out,
-		Signature: hex.EncodeToString(in.Signature),
-		PubKey:    hex.EncodeToString(in.PubKey),
+		ID:           hex.EncodeToString(in.ID),
+		Out:          in.Out,
+		UnlockScript: hex.EncodeToString(in.UnlockScript),
+		UnlockAsm:    DisasmScript(in.UnlockScript),
+		Sequence:     in.Sequence,
 	})
 }
 
@@ -84,22 +102,60 @@ func (in *TxInput) MarshalJSON() ([]byte, error) {
 // ---------------------------------------------------------------------
 type TxOutput struct {
 	Value      int
-	PubKeyHash []byte
+	LockScript []byte
+}
+
+// PubKeyHash is the key hash a P2PKH output pays to, time locked or not,
+// nil for any other kind of output.
+func (out *TxOutput) PubKeyHash() []byte {
+	_, script := ExtractTimeLock(out.LockScript)
+	pubKeyHash, _ := ExtractPubKeyHash(script)
+	return pubKeyHash
+}
+
+// NotBefore is the lock time the output can't be spent before, zero if it
+// has none.
+func (out *TxOutput) NotBefore() int64 {
+	lockTime, _ := ExtractTimeLock(out.LockScript)
+	return lockTime
+}
+
+// Data is what a data output carries, nil for any other output.
+func (out *TxOutput) Data() []byte {
+	data, _ := ExtractData(out.LockScript)
+	return data
+}
+
+// SpendableAt reports whether the output's time lock lets a block at
+// height with the given time spend it.
+func (out *TxOutput) SpendableAt(height int, timestamp int64) bool {
+	notBefore := out.NotBefore()
+	return notBefore == 0 || lockReached(notBefore, height, timestamp)
 }
 
 func (out *TxOutput) Print() {
 	fmt.Println("    **")
 	fmt.Printf("    | Value: %d\n", out.Value)
-	fmt.Printf("    | PubKeyHash: %s\n", hex.EncodeToString(out.PubKeyHash))
+	fmt.Printf("    | Lock: %s\n", DisasmScript(out.LockScript))
 }
 
 func (out *TxOutput) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Value      int    `json:"value"`
-		PubKeyHash string `json:"pubkey_hash"`
+		LockScript string `json:"lock_script"`
+		LockAsm    string `json:"lock_asm"`
+		PubKeyHash string `json:"pubkey_hash,omitempty"`
+		Address    string `json:"address,omitempty"`
+		NotBefore  int64  `json:"not_before,omitempty"`
+		Data       string `json:"data,omitempty"`
 	}{
 		Value:      out.Value,
-		PubKeyHash: hex.EncodeToString(out.PubKeyHash),
+		LockScript: hex.EncodeToString(out.LockScript),
+		LockAsm:    DisasmScript(out.LockScript),
+		PubKeyHash: hex.EncodeToString(out.PubKeyHash()),
+		Address:    out.Address(),
+		NotBefore:  out.NotBefore(),
+		Data:       hex.EncodeToString(out.Data()),
 	})
 }
 
@@ -123,21 +179,43 @@ func (out *TxOutput) MarshalJSON() ([]byte, error) {
 // 	return nil
 // }
 
+// Lock locks the output to address with the script AddressScript gives.
 func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := util.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	lockScript, err := AddressScript(string(address))
+	util.Handle(err, "Lock")
+
+	out.LockScript = lockScript
+}
+
+// Address is the address the output pays to, or "" if its locking script
+// has no address form. Time locked P2PKH outputs belong to their key's
+// address.
+func (out *TxOutput) Address() string {
+	if pubKeyHash := out.PubKeyHash(); pubKeyHash != nil {
+		return wallet.PubKeyHashToAddr(pubKeyHash)
+	}
+
+	if scriptHash, ok := ExtractScriptHash(out.LockScript); ok {
+		return wallet.EncodeAddress(wallet.ScriptHashVersion, scriptHash)
+	}
+
+	if _, _, ok := ExtractMultisig(out.LockScript); ok {
+		return MultisigAddress(out.LockScript)
+	}
+
+	return ""
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Equal(out.PubKeyHash, pubKeyHash)
+	lockingHash := out.PubKeyHash()
+	return lockingHash != nil && bytes.Equal(lockingHash, pubKeyHash)
 }
 
 func NewTXOutput(value int, address string) *TxOutput {
 
 	txo := &TxOutput{
 		Value:      value,
-		PubKeyHash: nil,
+		LockScript: nil,
 	}
 
 	txo.Lock([]byte(address))
@@ -146,8 +224,22 @@ func NewTXOutput(value int, address string) *TxOutput {
 }
 
 // ---------------------------------------------------------------------
+
+// TxOutputs is what the UTXO set keeps of a transaction: the outputs still
+// unspent, and where each sits in the transaction, which inputs refer to.
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int
+}
+
+// add records output outIdx, unless it can never be spent.
+func (outs *TxOutputs) add(outIdx int, out TxOutput) {
+	if out.IsUnspendable() {
+		return
+	}
+
+	outs.Outputs = append(outs.Outputs, out)
+	outs.Indexes = append(outs.Indexes, outIdx)
 }
 
 func (outs TxOutputs) Serialize() []byte {
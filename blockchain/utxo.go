@@ -113,12 +113,12 @@ func (utxo *UTXOSet) Update(block *Block) {
 
 					outs := DeserializeTxOutputs(v)
 
-					for outIdx, out := range outs.Outputs {
+					for i, out := range outs.Outputs {
 						//
 						// each input contains a reference to the output it came from
 						//
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						if outs.Indexes[i] != in.Out {
+							updatedOuts.add(outs.Indexes[i], out)
 						}
 					}
 
@@ -136,8 +136,13 @@ func (utxo *UTXOSet) Update(block *Block) {
 			}
 
 			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			for outIdx, out := range tx.Outputs {
+				newOutputs.add(outIdx, out)
+			}
+
+			// Nothing to keep of a transaction with only data outputs
+			if len(newOutputs.Outputs) == 0 {
+				continue
 			}
 
 			txID := append(utxoPrefix, tx.ID...)
@@ -182,6 +187,20 @@ func (utxo UTXOSet) Reindex() {
 }
 
 func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+	return u.findUnspent(func(out *TxOutput) bool {
+		return out.IsLockedWithKey(pubKeyHash)
+	})
+}
+
+// FindUnspentScriptOutputs is FindUnspentTransactions for outputs locked
+// with exactly lockScript.
+func (u UTXOSet) FindUnspentScriptOutputs(lockScript []byte) []TxOutput {
+	return u.findUnspent(func(out *TxOutput) bool {
+		return bytes.Equal(out.LockScript, lockScript)
+	})
+}
+
+func (u UTXOSet) findUnspent(match func(out *TxOutput) bool) []TxOutput {
 	var UTXOs []TxOutput
 
 	db := u.Blockchain.Database
@@ -202,7 +221,7 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 			outs := DeserializeTxOutputs(v)
 
 			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
+				if match(&out) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
@@ -217,6 +236,20 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 }
 
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+	return u.findSpendable(func(out *TxOutput) bool {
+		return out.IsLockedWithKey(pubKeyHash)
+	}, amount)
+}
+
+// FindSpendableScriptOutputs is FindSpendableOutputs for outputs locked
+// with exactly lockScript.
+func (u UTXOSet) FindSpendableScriptOutputs(lockScript []byte, amount int) (int, map[string][]int) {
+	return u.findSpendable(func(out *TxOutput) bool {
+		return bytes.Equal(out.LockScript, lockScript)
+	}, amount)
+}
+
+func (u UTXOSet) findSpendable(match func(out *TxOutput) bool, amount int) (int, map[string][]int) {
 
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
@@ -241,10 +274,10 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 			txID := hex.EncodeToString(k)
 			outs := DeserializeTxOutputs(v)
 
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+			for i, out := range outs.Outputs {
+				if match(&out) && accumulated < amount {
 					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+					unspentOuts[txID] = append(unspentOuts[txID], outs.Indexes[i])
 				}
 			}
 		}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// /anchor puts a piece of data, usually a document hash, in a data output.
+// /anchor/prove later returns the merkle proof of the earliest transaction
+// carrying it, with the time its block's miner claims it was mined.
+
+func (bcs *BlockchainServer) Anchor(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var anchorPayload types.AnchorReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&anchorPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, err := hex.DecodeString(anchorPayload.Data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat, err := wallet.CreateWallets()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, ok := walletDat.Accounts[anchorPayload.From]; !ok {
+			http.Error(w, "ERROR: the sending account is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		tx, err := blockchain.NewDataTransaction(anchorPayload.From, data, &UTXOset, walletDat)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if anchorPayload.MineNow {
+			block, err := chain.MineBlock([]*blockchain.Transaction{blockchain.CoinbaseTX(anchorPayload.From, ""), tx})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			UTXOset.Update(block)
+		} else {
+			if !bcs.submitTx(w, tx) {
+				return
+			}
+		}
+
+		// ----------------------------------------------------------
+		m, err := tx.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) ProveAnchor(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		data, err := hex.DecodeString(req.URL.Query().Get("data"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// -----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		tx, block, err := chain.FindAnchor(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		proof, err := blockchain.NewTxProof(block, tx.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// -----------------------------------------------------------
+		// The timestamp is whatever the miner put in the header, only
+		// bounded by the median time past and the accepting nodes' clocks,
+		// so it is reported as the block's time, not as proof of when
+		blockTime := time.Unix(0, block.Timestamp).UTC()
+
+		m, err := json.Marshal(struct {
+			Data          string              `json:"data"`
+			BlockTime     string              `json:"block_time"`
+			Confirmations int                 `json:"confirmations"`
+			Proof         *blockchain.TxProof `json:"proof"`
+		}{
+			Data:          hex.EncodeToString(data),
+			BlockTime:     blockTime.Format(time.RFC3339),
+			Confirmations: chain.GetBestHeight() - block.Height + 1,
+			Proof:         proof,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
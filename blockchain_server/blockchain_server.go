@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/i101dev/blockchain-Tensor/blockchain"
 	"github.com/i101dev/blockchain-Tensor/network"
@@ -22,21 +25,28 @@ var (
 )
 
 type BlockchainServer struct {
-	port uint16
+	port    uint16
+	netCfg  network.Config
+	spvMode bool
+	node    *network.Node
+	spv     *network.SPVClient
 }
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
+func NewBlockchainServer(port uint16, netCfg network.Config, spvMode bool) *BlockchainServer {
 	return &BlockchainServer{
-		port: port,
+		port:    port,
+		netCfg:  netCfg,
+		spvMode: spvMode,
 	}
 }
 
 func (bcs *BlockchainServer) LoadBlockchain() error {
 
-	bc, err := blockchain.LoadBlockchain(ORIGIN_ADDRESS, bcs.port)
+	path := fmt.Sprintf(blockchain.DB_PATH, bcs.port)
+	bc, err := blockchain.LoadBlockchainWithGenesis(path, ORIGIN_ADDRESS, bcs.netCfg.Genesis)
 
 	if err != nil {
-		return fmt.Errorf("failed to load chain")
+		return fmt.Errorf("failed to load chain: %w", err)
 	}
 
 	cache[CHAIN_ID] = bc
@@ -55,6 +65,41 @@ func (bcs *BlockchainServer) GetBlockchain() (*blockchain.Blockchain, error) {
 	return bc, nil
 }
 
+// localOnly restricts an admin route to requests from this machine. The
+// HTTP API listens on every interface, and bans decide whom the node talks
+// to at all.
+func localOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "ERROR: only allowed from localhost", http.StatusForbidden)
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// submitTx hands tx to the network, writing an error response when the
+// memory pool refuses it or no peer could be reached to send it to; in the
+// latter case it is only in this node's memory pool.
+func (bcs *BlockchainServer) submitTx(w http.ResponseWriter, tx *blockchain.Transaction) bool {
+
+	err := bcs.node.SubmitTx(tx)
+
+	switch {
+	case errors.Is(err, network.ErrNoPeers):
+		http.Error(w, fmt.Sprintf("ERROR: transaction %x was not sent: %s", tx.ID, err), http.StatusServiceUnavailable)
+		return false
+	case err != nil:
+		http.Error(w, fmt.Sprintf("ERROR: transaction %x was rejected: %s", tx.ID, err), http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
 func (bcs *BlockchainServer) PrintChain(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -98,10 +143,20 @@ func (bcs *BlockchainServer) NewAccount(w http.ResponseWriter, req *http.Request
 		// ----------------------------------------------------------
 		w, _ := wallet.CreateWallets()
 
-		w.AddAccount()
+		// Keys are compressed unless asked for otherwise
+		var addr string
+		if req.URL.Query().Get("uncompressed") == "true" {
+			addr = w.AddUncompressedAccount()
+		} else {
+			addr = w.AddAccount()
+		}
 
 		w.SaveFile()
 
+		if bcs.spv != nil {
+			bcs.spv.Watch(wallet.PublicKeyHash(w.Accounts[addr].PublicKey))
+		}
+
 		w.Print()
 		// ----------------------------------------------------------
 		// w.Header().Add("Content-Type", "application/json")
@@ -181,6 +236,11 @@ func (bcs *BlockchainServer) GetTXN(w http.ResponseWriter, req *http.Request) {
 
 		ID := req.URL.Query().Get("id")
 
+		if bcs.spv != nil {
+			bcs.getProvenTXN(w, ID)
+			return
+		}
+
 		// -----------------------------------------------------------
 		chain, err := bcs.GetBlockchain()
 		if err != nil {
@@ -220,6 +280,83 @@ func (bcs *BlockchainServer) GetTXN(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (bcs *BlockchainServer) GetTXNProof(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		ID := req.URL.Query().Get("id")
+
+		// -----------------------------------------------------------
+		txnID, err := hex.DecodeString(ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		// -----------------------------------------------------------
+		block, err := chain.FindTransactionBlock(txnID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		proof, err := blockchain.NewTxProof(block, txnID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// -----------------------------------------------------------
+		m, err := json.Marshal(proof)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+// getProvenTXN answers /gettxn in SPV mode, where only wallet
+// transactions with a verified merkle proof are known.
+func (bcs *BlockchainServer) getProvenTXN(w http.ResponseWriter, ID string) {
+
+	txnID, err := hex.DecodeString(ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	proven, ok := bcs.spv.Transaction(txnID)
+	if !ok {
+		http.Error(w, "ERROR: no proven wallet transaction with that ID", http.StatusNotFound)
+		return
+	}
+
+	// -----------------------------------------------------------
+	TXN, err := json.Marshal(&proven.Tx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(TXN)
+}
+
 func (bcs *BlockchainServer) AddTXN(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPost:
@@ -234,6 +371,11 @@ func (bcs *BlockchainServer) AddTXN(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if _, err := blockchain.AddressScript(txnPayload.To); err != nil {
+			http.Error(w, "ERROR: to is not a valid address", http.StatusBadRequest)
+			return
+		}
+
 		// ----------------------------------------------------------
 		chain, err := bcs.GetBlockchain()
 		if err != nil {
@@ -256,15 +398,21 @@ func (bcs *BlockchainServer) AddTXN(w http.ResponseWriter, req *http.Request) {
 		}
 
 		// ----------------------------------------------------------
-		newTxn := blockchain.NewTransaction(txnPayload.From, txnPayload.To, txnPayload.Amount, &UTXOset, wallet)
+		newTxn := blockchain.NewTimeLockedTransaction(txnPayload.From, txnPayload.To, txnPayload.Amount, txnPayload.NotBefore, &UTXOset, wallet)
 
 		if txnPayload.MineNow {
 			cbTx := blockchain.CoinbaseTX(txnPayload.From, "")
 			txs := []*blockchain.Transaction{cbTx, newTxn}
-			block := chain.MineBlock(txs)
+			block, err := chain.MineBlock(txs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			UTXOset.Update(block)
 		} else {
-			network.SendTx(network.NODE_ZERO, newTxn)
+			if !bcs.submitTx(w, newTxn) {
+				return
+			}
 			fmt.Println("\nsending txn")
 		}
 
@@ -333,33 +481,64 @@ func (bcs *BlockchainServer) GetBalance(w http.ResponseWriter, req *http.Request
 		address := req.URL.Query().Get("address")
 
 		// -----------------------------------------------------------
-		chain, err := bcs.GetBlockchain()
-
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		blockchain.OpenDB(chain)
-		defer chain.CloseDB()
-
-		UTXOset := blockchain.UTXOSet{
-			Blockchain: chain,
+		balance := 0
+		locked := 0
+
+		// Multisig and P2SH addresses aren't wallet accounts, their outputs
+		// are found by locking script. SPV clients don't track them.
+		version, _, _ := wallet.DecodeAddress(address)
+		multisig := version == wallet.MultisigVersion || version == wallet.ScriptHashVersion
+
+		var pubKeyHash []byte
+		if !multisig {
+			walletDat, _ := wallet.CreateWallets()
+			account := walletDat.GetAccount(address)
+			pubKeyHash = wallet.PublicKeyHash(account.PublicKey)
 		}
 
-		// -----------------------------------------------------------
-		walletDat, _ := wallet.CreateWallets()
-		account := walletDat.GetAccount(address)
-		pubKeyHash := wallet.PublicKeyHash(account.PublicKey)
-		UTXOs := UTXOset.FindUnspentTransactions(pubKeyHash)
-
-		balance := 0
-		for _, out := range UTXOs {
-			balance += out.Value
+		if bcs.spv != nil {
+			balance = bcs.spv.Balance(pubKeyHash)
+		} else {
+			chain, err := bcs.GetBlockchain()
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			blockchain.OpenDB(chain)
+			defer chain.CloseDB()
+
+			UTXOset := blockchain.UTXOSet{
+				Blockchain: chain,
+			}
+
+			var UTXOs []blockchain.TxOutput
+			if multisig {
+				script, _ := blockchain.AddressScript(address)
+				UTXOs = UTXOset.FindUnspentScriptOutputs(script)
+			} else {
+				UTXOs = UTXOset.FindUnspentTransactions(pubKeyHash)
+			}
+
+			// Time locked outputs count towards the balance, but can't be
+			// spent by the next block yet
+			height, medianTime, err := chain.NextLockPoint()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			for _, out := range UTXOs {
+				balance += out.Value
+				if !out.SpendableAt(height, medianTime) {
+					locked += out.Value
+				}
+			}
 		}
 
 		// -----------------------------------------------------------
-		response := map[string]int{"balance": balance}
+		response := map[string]int{"balance": balance, "locked": locked}
 		jsonResponse, err := json.Marshal(response)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -415,15 +594,184 @@ func (bcs *BlockchainServer) Reindex(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (bcs *BlockchainServer) ListPeers(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		// -----------------------------------------------------------
+		peers, err := json.Marshal(bcs.node.Peers())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(peers)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) ListBans(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		// -----------------------------------------------------------
+		bans, err := json.Marshal(bcs.node.BanManager().List())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bans)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) AddBan(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var banPayload types.AddBanReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&banPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if banPayload.Host == "" {
+			http.Error(w, "ERROR: host is required", http.StatusBadRequest)
+			return
+		}
+
+		if banPayload.Reason == "" {
+			banPayload.Reason = "banned by operator"
+		}
+
+		// ----------------------------------------------------------
+		banMan := bcs.node.BanManager()
+		banMan.Ban(banPayload.Host, time.Duration(banPayload.Duration)*time.Second, banPayload.Reason)
+
+		bans, err := json.Marshal(banMan.List())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(bans)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) RemoveBan(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var banPayload types.RemoveBanReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&banPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !bcs.node.BanManager().Unban(banPayload.Host) {
+			http.Error(w, fmt.Sprintf("ERROR: %s is not banned", banPayload.Host), http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		response := map[string]string{"unbanned": network.BanHost(banPayload.Host)}
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(jsonResponse)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
 // ------------------------------------------------------------------
 
-func (bcs *BlockchainServer) startNetworkServer() {
-	bcs.LoadBlockchain()
-	chain, _ := bcs.GetBlockchain()
-	network.StartServer(chain, bcs.port, MINER_ADDRESS)
+func (bcs *BlockchainServer) startNetworkServer() error {
+	chain, err := bcs.GetBlockchain()
+	if err != nil {
+		return err
+	}
+
+	bcs.node, err = network.NewNode(chain, bcs.netCfg)
+	if err != nil {
+		return err
+	}
+
+	go bcs.node.Start()
+
+	return nil
+}
+
+// startSPVClient follows the chain by headers only, watching every
+// account in the wallet.
+func (bcs *BlockchainServer) startSPVClient() error {
+	walletDat, err := wallet.CreateWallets()
+	if err != nil {
+		return err
+	}
+
+	var watch [][]byte
+	for _, account := range walletDat.Accounts {
+		watch = append(watch, wallet.PublicKeyHash(account.PublicKey))
+	}
+
+	bcs.spv, err = network.NewSPVClient(bcs.netCfg, ORIGIN_ADDRESS, watch)
+	if err != nil {
+		return err
+	}
+
+	go bcs.spv.Start()
+
+	return nil
+}
+
+func (bcs *BlockchainServer) runSPV() {
+
+	// Only what can be answered from headers and proven transactions
+	http.HandleFunc("/newaccount", bcs.NewAccount)
+	http.HandleFunc("/loadwallet", bcs.LoadWallet)
+	http.HandleFunc("/balance", bcs.GetBalance)
+	http.HandleFunc("/gettxn", bcs.GetTXN)
+
+	if err := bcs.startSPVClient(); err != nil {
+		log.Fatal(err)
+	}
+
+	hostURL := fmt.Sprintf("0.0.0.0:%d", bcs.port)
+	fmt.Println("Blockchain HTTP Server (SPV mode) is live @:", hostURL)
+	log.Fatal(http.ListenAndServe(hostURL, nil))
 }
 
 func (bcs *BlockchainServer) Run() {
+	if bcs.spvMode {
+		bcs.runSPV()
+		return
+	}
+
 	if err := bcs.LoadBlockchain(); err != nil {
 		log.Fatal(err)
 	}
@@ -436,9 +784,35 @@ func (bcs *BlockchainServer) Run() {
 	http.HandleFunc("/balance", bcs.GetBalance)
 	http.HandleFunc("/reindex", bcs.Reindex)
 	http.HandleFunc("/gettxn", bcs.GetTXN)
+	http.HandleFunc("/txproof", bcs.GetTXNProof)
 	http.HandleFunc("/addtxn", bcs.AddTXN)
-
-	go bcs.startNetworkServer()
+	http.HandleFunc("/signtxn", bcs.SignTxn)
+	http.HandleFunc("/sendtxn", bcs.SendTxn)
+	http.HandleFunc("/pubkey", bcs.GetPubKey)
+	http.HandleFunc("/multisig/create", bcs.CreateMultisig)
+	http.HandleFunc("/multisig/spend", bcs.SpendMultisig)
+	http.HandleFunc("/multisig/sign", bcs.SignMultisig)
+	http.HandleFunc("/multisig/send", bcs.SendMultisig)
+	http.HandleFunc("/htlc/create", bcs.CreateHTLC)
+	http.HandleFunc("/htlc/claim", bcs.ClaimHTLC)
+	http.HandleFunc("/htlc/refund", bcs.RefundHTLC)
+	http.HandleFunc("/htlc/status", bcs.GetHTLCStatus)
+	http.HandleFunc("/psbt/create", bcs.CreatePSBT)
+	http.HandleFunc("/psbt/sign", bcs.SignPSBT)
+	http.HandleFunc("/psbt/combine", bcs.CombinePSBT)
+	http.HandleFunc("/psbt/finalize", bcs.FinalizePSBT)
+	http.HandleFunc("/psbt/broadcast", bcs.BroadcastPSBT)
+	http.HandleFunc("/psbt/decode", bcs.DecodePSBT)
+	http.HandleFunc("/anchor", bcs.Anchor)
+	http.HandleFunc("/anchor/prove", bcs.ProveAnchor)
+	http.HandleFunc("/peers", bcs.ListPeers)
+	http.HandleFunc("/listbans", localOnly(bcs.ListBans))
+	http.HandleFunc("/addban", localOnly(bcs.AddBan))
+	http.HandleFunc("/removeban", localOnly(bcs.RemoveBan))
+
+	if err := bcs.startNetworkServer(); err != nil {
+		log.Fatal(err)
+	}
 
 	hostURL := fmt.Sprintf("0.0.0.0:%d", bcs.port)
 	fmt.Println("Blockchain HTTP Server is live @:", hostURL)
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// An HTLC is funded by paying its P2SH address with /addtxn. The recipient
+// then claims it with the secret through /htlc/claim, or the sender takes
+// it back through /htlc/refund once its lock time has passed. /htlc/status
+// shows whether it was spent, and the secret if a claim revealed it.
+
+func addressKeyHash(address string) ([]byte, error) {
+	script, err := blockchain.AddressScript(address)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyHash, ok := blockchain.ExtractPubKeyHash(script)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a key address", address)
+	}
+
+	return pubKeyHash, nil
+}
+
+func decodeHTLC(redeemScript string) ([]byte, *blockchain.HTLC, error) {
+	script, err := hex.DecodeString(redeemScript)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, ok := blockchain.ExtractHTLC(script)
+	if !ok {
+		return nil, nil, blockchain.ErrBadHTLC
+	}
+
+	return script, h, nil
+}
+
+// -------------------------------------------------------------
+
+func (bcs *BlockchainServer) CreateHTLC(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var htlcPayload types.HTLCCreateReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&htlcPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		secretHash, err := hex.DecodeString(htlcPayload.SecretHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		recipient, err := addressKeyHash(htlcPayload.Recipient)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sender, err := addressKeyHash(htlcPayload.Sender)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		h := blockchain.HTLC{
+			SecretHash: secretHash,
+			Recipient:  recipient,
+			Sender:     sender,
+			LockTime:   htlcPayload.LockTime,
+		}
+
+		script, err := h.Script()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := json.Marshal(map[string]string{
+			"address":       blockchain.P2SHAddress(script),
+			"redeem_script": hex.EncodeToString(script),
+			"asm":           blockchain.DisasmScript(script),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) ClaimHTLC(w http.ResponseWriter, req *http.Request) {
+	bcs.spendHTLC(w, req, true)
+}
+
+func (bcs *BlockchainServer) RefundHTLC(w http.ResponseWriter, req *http.Request) {
+	bcs.spendHTLC(w, req, false)
+}
+
+func (bcs *BlockchainServer) spendHTLC(w http.ResponseWriter, req *http.Request, claim bool) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var htlcPayload types.HTLCSpendReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&htlcPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		script, h, err := decodeHTLC(htlcPayload.RedeemScript)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fundingID, err := hex.DecodeString(htlcPayload.TxID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var secret []byte
+		keyHash := h.Sender
+
+		if claim {
+			if secret, err = hex.DecodeString(htlcPayload.Secret); err != nil || len(secret) == 0 {
+				http.Error(w, "ERROR: a claim needs the secret", http.StatusBadRequest)
+				return
+			}
+			keyHash = h.Recipient
+		}
+
+		// The wallet has to hold the key the spend is signed with
+		walletDat, _ := wallet.CreateWallets()
+
+		var account *wallet.Account
+		for _, acc := range walletDat.Accounts {
+			if bytes.Equal(wallet.PublicKeyHash(acc.PublicKey), keyHash) {
+				account = acc
+			}
+		}
+
+		if account == nil {
+			http.Error(w, "ERROR: the spending key is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		to := htlcPayload.To
+		if to == "" {
+			to = wallet.PubKeyHashToAddr(keyHash)
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		fundingTX, err := chain.FindTransaction(fundingID)
+		if err != nil {
+			http.Error(w, "ERROR: funding transaction is not confirmed", http.StatusNotFound)
+			return
+		}
+
+		tx, err := blockchain.NewHTLCSpend(script, &fundingTX, to, secret, account.PrivateKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, in := range tx.Inputs {
+			if _, err := chain.FindSpendingTransaction(in.ID, in.Out); err == nil {
+				http.Error(w, "ERROR: the contract is already spent", http.StatusConflict)
+				return
+			}
+		}
+
+		prevTXs := map[string]blockchain.Transaction{hex.EncodeToString(fundingTX.ID): fundingTX}
+		if !tx.Verify(prevTXs) {
+			http.Error(w, "ERROR: transaction does not verify", http.StatusBadRequest)
+			return
+		}
+
+		// Refunds wait for the contract's lock time
+		if err := chain.CheckTxLocks(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if htlcPayload.MineNow {
+			UTXOset := blockchain.UTXOSet{
+				Blockchain: chain,
+			}
+
+			block, err := chain.MineBlock([]*blockchain.Transaction{blockchain.CoinbaseTX(to, ""), tx})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			UTXOset.Update(block)
+		} else {
+			if !bcs.submitTx(w, tx) {
+				return
+			}
+		}
+
+		// ----------------------------------------------------------
+		m, err := tx.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) GetHTLCStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		script, h, err := decodeHTLC(req.URL.Query().Get("redeem_script"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fundingID, err := hex.DecodeString(req.URL.Query().Get("txid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		fundingTX, err := chain.FindTransaction(fundingID)
+		if err != nil {
+			http.Error(w, "ERROR: funding transaction is not confirmed", http.StatusNotFound)
+			return
+		}
+
+		res := struct {
+			Address    string `json:"address"`
+			SecretHash string `json:"secret_hash"`
+			Recipient  string `json:"recipient"`
+			Sender     string `json:"sender"`
+			LockTime   int64  `json:"lock_time"`
+			Value      int    `json:"value"`
+			SpentBy    string `json:"spent_by,omitempty"`
+			Secret     string `json:"secret,omitempty"`
+		}{
+			Address:    blockchain.P2SHAddress(script),
+			SecretHash: hex.EncodeToString(h.SecretHash),
+			Recipient:  wallet.PubKeyHashToAddr(h.Recipient),
+			Sender:     wallet.PubKeyHashToAddr(h.Sender),
+			LockTime:   h.LockTime,
+		}
+
+		lockScript := blockchain.P2SHScript(blockchain.ScriptHash(script))
+
+		for outIdx, out := range fundingTX.Outputs {
+			if !bytes.Equal(out.LockScript, lockScript) {
+				continue
+			}
+
+			res.Value += out.Value
+
+			spender, err := chain.FindSpendingTransaction(fundingTX.ID, outIdx)
+			if err != nil {
+				continue
+			}
+
+			res.SpentBy = hex.EncodeToString(spender.ID)
+			if secret := blockchain.ExtractHTLCSecret(&spender, h.SecretHash); secret != nil {
+				res.Secret = hex.EncodeToString(secret)
+			}
+		}
+
+		// ----------------------------------------------------------
+		m, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"log"
 	"os"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/network"
 )
 
 func init() {
@@ -15,9 +18,54 @@ func main() {
 	defer os.Exit(0)
 
 	port := flag.Uint("port", 5000, "TCP Port Number for Blockchain Server")
+	p2pHost := flag.String("p2p-host", "localhost", "Interface the peer-to-peer server binds to")
+	p2pPort := flag.Uint("p2p-port", 0, "TCP Port Number for peer-to-peer traffic (default port+1)")
+	external := flag.String("external", "", "host:port advertised to peers (default p2p-host:p2p-port)")
+	seeds := flag.String("seeds", network.NODE_ZERO, "Comma separated list of seed peers")
+	peersFile := flag.String("peers", "", "File the peer address book is persisted to (default ../tmp/peers_<port>.json)")
+	encrypt := flag.Bool("encrypt", false, "Use the encrypted transport for all peer traffic")
+	allowPeers := flag.String("allow-peers", "", "Comma separated list of peer identities allowed to connect (implies -encrypt)")
+	banScore := flag.Int("ban-score", network.DEFAULT_BAN_SCORE, "Misbehavior score at which a peer is banned")
+	banDuration := flag.Duration("ban-duration", network.DEFAULT_BAN_DURATION, "How long misbehaving peers stay banned")
+	spv := flag.Bool("spv", false, "Run as an SPV light client that keeps block headers only")
+	headersFile := flag.String("headers", "", "File an SPV client keeps its headers in (default ../tmp/spv_<port>.dat)")
+	genesis := flag.String("genesis", blockchain.GENESIS_DATA, "Genesis block data; nodes with different values form separate networks")
 	flag.Parse()
 
-	app := NewBlockchainServer(uint16(*port))
+	netCfg := network.DefaultConfig(uint16(*port))
+	netCfg.ListenHost = *p2pHost
+	netCfg.ExternalAddr = *external
+	netCfg.MinerAddress = MINER_ADDRESS
+	netCfg.Encrypt = *encrypt
+	netCfg.BanThreshold = *banScore
+	netCfg.BanDuration = *banDuration
+	netCfg.Genesis = *genesis
+
+	if *p2pPort != 0 {
+		netCfg.ListenPort = uint16(*p2pPort)
+	}
+
+	if *peersFile != "" {
+		netCfg.PeersFile = *peersFile
+	}
+
+	if *headersFile != "" {
+		netCfg.HeadersFile = *headersFile
+	}
+
+	seedNodes, err := network.ParsePeerList(*seeds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	netCfg.SeedNodes = seedNodes
+
+	allowedPeers, err := network.ParseIdentityList(*allowPeers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	netCfg.AllowedPeers = allowedPeers
+
+	app := NewBlockchainServer(uint16(*port), netCfg, *spv)
 
 	app.Run()
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// A multisig spend moves between the holders as the hex encoded
+// transaction: /multisig/spend creates it, each holder runs /multisig/sign
+// on a node holding their wallet, and once enough have signed anyone can
+// /multisig/send it.
+
+type multisigTxResponse struct {
+	Transaction string                  `json:"transaction"`
+	Signatures  []map[string]int        `json:"signatures"`
+	Details     *blockchain.Transaction `json:"details"`
+}
+
+func writeMultisigTx(w http.ResponseWriter, tx *blockchain.Transaction, prevTXs map[string]blockchain.Transaction) {
+
+	progress, err := tx.MultisigProgress(prevTXs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := multisigTxResponse{
+		Transaction: hex.EncodeToString(tx.Serialize()),
+		Details:     tx,
+	}
+
+	for _, p := range progress {
+		res.Signatures = append(res.Signatures, map[string]int{"have": p[0], "required": p[1]})
+	}
+
+	m, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(m)
+}
+
+func decodeMultisigTx(data string) (*blockchain.Transaction, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := blockchain.DecodeTransaction(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// -------------------------------------------------------------
+
+func (bcs *BlockchainServer) GetPubKey(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+
+		address := req.URL.Query().Get("address")
+
+		// ----------------------------------------------------------
+		walletDat, _ := wallet.CreateWallets()
+
+		account, ok := walletDat.Accounts[address]
+		if !ok {
+			http.Error(w, "ERROR: account is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := json.Marshal(map[string]string{
+			"address": address,
+			"pubkey":  hex.EncodeToString(account.PublicKey),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) CreateMultisig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var msPayload types.MultisigCreateReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&msPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var pubKeys [][]byte
+		for _, k := range msPayload.PubKeys {
+			key, err := hex.DecodeString(k)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pubKeys = append(pubKeys, key)
+		}
+
+		script, err := blockchain.MultisigScript(msPayload.Required, pubKeys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := map[string]string{
+			"address": blockchain.MultisigAddress(script),
+			"script":  hex.EncodeToString(script),
+			"asm":     blockchain.DisasmScript(script),
+		}
+
+		if msPayload.P2SH {
+			if err := blockchain.CheckRedeemScript(script); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			res["address"] = blockchain.P2SHAddress(script)
+			res["redeem_script"] = res["script"]
+			res["script"] = hex.EncodeToString(blockchain.P2SHScript(blockchain.ScriptHash(script)))
+			res["asm"] = blockchain.DisasmScript(blockchain.P2SHScript(blockchain.ScriptHash(script)))
+		}
+
+		// ----------------------------------------------------------
+		m, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SpendMultisig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var msPayload types.MultisigSpendReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&msPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		script, err := blockchain.AddressScript(msPayload.From)
+		if err != nil {
+			http.Error(w, "ERROR: from is not a valid address", http.StatusBadRequest)
+			return
+		}
+
+		redeemScript, err := hex.DecodeString(msPayload.RedeemScript)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(redeemScript) == 0 {
+			redeemScript = nil
+		}
+
+		if _, err := blockchain.AddressScript(msPayload.To); err != nil {
+			http.Error(w, "ERROR: to is not a valid address", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		tx, err := blockchain.NewMultisigTransaction(script, redeemScript, msPayload.To, msPayload.Amount, msPayload.LockTime, &UTXOset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeMultisigTx(w, tx, prevTXs)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SignMultisig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var msPayload types.MultisigSignReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&msPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := decodeMultisigTx(msPayload.Transaction)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hashType, err := blockchain.ParseSigHashType(msPayload.SigHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat, _ := wallet.CreateWallets()
+
+		account, ok := walletDat.Accounts[msPayload.Address]
+		if !ok {
+			http.Error(w, "ERROR: account is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		signed, err := tx.SignMultisig(account.PrivateKey, prevTXs, hashType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if signed == 0 {
+			http.Error(w, "ERROR: account is not a signer of any input", http.StatusBadRequest)
+			return
+		}
+
+		writeMultisigTx(w, tx, prevTXs)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SendMultisig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var msPayload types.MultisigSendReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&msPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := decodeMultisigTx(msPayload.Transaction)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := tx.FinalizeMultisig(prevTXs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !tx.Verify(prevTXs) {
+			http.Error(w, "ERROR: transaction does not verify", http.StatusBadRequest)
+			return
+		}
+
+		// A refund signed ahead of time has to wait for its lock time
+		if err := chain.CheckTxLocks(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !bcs.submitTx(w, tx) {
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := tx.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
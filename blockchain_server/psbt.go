@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// The /psbt routes create, sign, combine, finalize and broadcast base64
+// encoded partially signed transactions. Only create and broadcast need
+// the chain; the psbt tool signs with a wallet file on a machine without
+// one.
+
+func writePSBT(w http.ResponseWriter, p *blockchain.PSBT, extra map[string]interface{}) {
+
+	res := map[string]interface{}{
+		"psbt":    p.String(),
+		"details": p,
+	}
+
+	for key, value := range extra {
+		res[key] = value
+	}
+
+	m, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(m)
+}
+
+func decodePSBTReq(req *http.Request) (*blockchain.PSBT, error) {
+
+	var psbtPayload types.PSBTReq
+
+	if err := json.NewDecoder(req.Body).Decode(&psbtPayload); err != nil {
+		return nil, err
+	}
+
+	return blockchain.ParsePSBT(psbtPayload.PSBT)
+}
+
+// -------------------------------------------------------------
+
+func (bcs *BlockchainServer) CreatePSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var psbtPayload types.PSBTCreateReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&psbtPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		script, err := blockchain.AddressScript(psbtPayload.From)
+		if err != nil {
+			http.Error(w, "ERROR: from is not a valid address", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := blockchain.AddressScript(psbtPayload.To); err != nil {
+			http.Error(w, "ERROR: to is not a valid address", http.StatusBadRequest)
+			return
+		}
+
+		if psbtPayload.Amount <= 0 {
+			http.Error(w, "ERROR: amount must be positive", http.StatusBadRequest)
+			return
+		}
+
+		redeemScript, err := hex.DecodeString(psbtPayload.RedeemScript)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(redeemScript) == 0 {
+			redeemScript = nil
+		}
+
+		hashType, err := blockchain.ParseSigHashType(psbtPayload.SigHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		UTXOset := blockchain.UTXOSet{
+			Blockchain: chain,
+		}
+
+		var p *blockchain.PSBT
+
+		if _, ok := blockchain.ExtractPubKeyHash(script); ok {
+			p, err = blockchain.NewPaymentPSBT(psbtPayload.From, psbtPayload.To, psbtPayload.Amount, psbtPayload.NotBefore, hashType, &UTXOset)
+		} else {
+			var tx *blockchain.Transaction
+			tx, err = blockchain.NewMultisigTransaction(script, redeemScript, psbtPayload.To, psbtPayload.Amount, psbtPayload.LockTime, &UTXOset)
+
+			if err == nil {
+				var prevTXs map[string]blockchain.Transaction
+				if prevTXs, err = chain.PreviousTransactions(tx); err == nil {
+					p, err = blockchain.NewPSBT(tx, prevTXs, [][]byte{redeemScript}, hashType)
+				}
+			}
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for key, value := range psbtPayload.Metadata {
+			p.Metadata[key] = value
+		}
+
+		// ----------------------------------------------------------
+		writePSBT(w, p, nil)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SignPSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var psbtPayload types.PSBTSignReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&psbtPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p, err := blockchain.ParsePSBT(psbtPayload.PSBT)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat, _ := wallet.CreateWallets()
+
+		account, ok := walletDat.Accounts[psbtPayload.Address]
+		if !ok {
+			http.Error(w, "ERROR: account is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		signed, err := p.Sign(account.PrivateKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if signed == 0 {
+			http.Error(w, "ERROR: account owns none of the inputs", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		writePSBT(w, p, map[string]interface{}{"signed": signed})
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) CombinePSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var psbtPayload types.PSBTCombineReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&psbtPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(psbtPayload.PSBTs) == 0 {
+			http.Error(w, "ERROR: no PSBTs to combine", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		var combined *blockchain.PSBT
+
+		for _, s := range psbtPayload.PSBTs {
+			p, err := blockchain.ParsePSBT(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if combined == nil {
+				combined = p
+			} else if err := combined.Combine(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// ----------------------------------------------------------
+		writePSBT(w, combined, nil)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) FinalizePSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		// ----------------------------------------------------------
+		p, err := decodePSBTReq(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		complete, err := p.Finalize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		extra := map[string]interface{}{"complete": complete}
+
+		if complete {
+			tx, err := p.Extract()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			extra["transaction"] = hex.EncodeToString(tx.Serialize())
+		}
+
+		// ----------------------------------------------------------
+		writePSBT(w, p, extra)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) BroadcastPSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		// ----------------------------------------------------------
+		p, err := decodePSBTReq(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := p.Finalize(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := p.Extract()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := tx.CheckDataOutputs(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		// Checked against the chain, not the outputs the PSBT claims to spend
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !tx.Verify(prevTXs) {
+			http.Error(w, "ERROR: transaction does not verify", http.StatusBadRequest)
+			return
+		}
+
+		if err := chain.CheckTxLocks(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !bcs.submitTx(w, tx) {
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := tx.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) DecodePSBT(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		// ----------------------------------------------------------
+		p, err := decodePSBTReq(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		writePSBT(w, p, nil)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
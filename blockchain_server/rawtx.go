@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// /signtxn and /sendtxn work on hex encoded transactions put together by
+// several parties, each signing their own inputs with whatever hash type
+// leaves the others room to add theirs.
+
+func (bcs *BlockchainServer) SignTxn(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var signPayload types.SignTxnReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&signPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := decodeMultisigTx(signPayload.Transaction)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hashType, err := blockchain.ParseSigHashType(signPayload.SigHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		walletDat, _ := wallet.CreateWallets()
+
+		account, ok := walletDat.Accounts[signPayload.Address]
+		if !ok {
+			http.Error(w, "ERROR: account is not in this wallet", http.StatusNotFound)
+			return
+		}
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Whoever put the transaction together may have added to it
+		tx.ID = tx.ComputeID()
+
+		signed, err := tx.SignKeyInputs(account.PrivateKey, prevTXs, hashType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if signed == 0 {
+			http.Error(w, "ERROR: account owns none of the inputs", http.StatusBadRequest)
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := json.Marshal(struct {
+			Transaction string                  `json:"transaction"`
+			Signed      int                     `json:"signed"`
+			Details     *blockchain.Transaction `json:"details"`
+		}{
+			Transaction: hex.EncodeToString(tx.Serialize()),
+			Signed:      signed,
+			Details:     tx,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) SendTxn(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+
+		var sendPayload types.SendTxnReq
+		decoder := json.NewDecoder(req.Body)
+
+		// ----------------------------------------------------------
+		err := decoder.Decode(&sendPayload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := decodeMultisigTx(sendPayload.Transaction)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(tx.Inputs) == 0 || tx.IsCoinbase() {
+			http.Error(w, "ERROR: transaction spends nothing", http.StatusBadRequest)
+			return
+		}
+
+		if err := tx.CheckDataOutputs(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx.ID = tx.ComputeID()
+
+		// ----------------------------------------------------------
+		chain, err := bcs.GetBlockchain()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		blockchain.OpenDB(chain)
+		defer chain.CloseDB()
+
+		prevTXs, err := chain.PreviousTransactions(tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !tx.Verify(prevTXs) {
+			http.Error(w, "ERROR: transaction does not verify", http.StatusBadRequest)
+			return
+		}
+
+		if err := chain.CheckTxLocks(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !bcs.submitTx(w, tx) {
+			return
+		}
+
+		// ----------------------------------------------------------
+		m, err := tx.MarshalJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(m)
+
+	default:
+		http.Error(w, "ERROR: Invalid HTTP Method", http.StatusBadRequest)
+	}
+}
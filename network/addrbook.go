@@ -0,0 +1,305 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ADDR_BUCKET_COUNT       = 64
+	ADDR_BUCKET_SIZE        = 64
+	ADDR_BUCKETS_PER_SOURCE = 8
+	ADDR_HORIZON            = 24 * time.Hour
+	ADDR_MAX_ATTEMPTS       = 3
+)
+
+// KnownAddress is an entry in the address book. LastSeen is the unix time
+// the address was last vouched for, either by talking to it directly or by
+// a peer relaying it.
+type KnownAddress struct {
+	Addr     string
+	LastSeen int64
+	Source   string
+	Attempts int
+}
+
+func (ka *KnownAddress) isStale(now time.Time) bool {
+	return now.Sub(time.Unix(ka.LastSeen, 0)) > ADDR_HORIZON || ka.Attempts >= ADDR_MAX_ATTEMPTS
+}
+
+// AddrBook holds every peer address the node has heard of. Entries are
+// spread over buckets chosen by a keyed hash of the address's network group
+// and of the group of the peer that told us about it. A single source can
+// only ever reach ADDR_BUCKETS_PER_SOURCE buckets, so a flood of made-up
+// addresses from one peer evicts its own entries rather than everyone
+// else's.
+type AddrBook struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	clock   Clock
+	rng     *lockedRand
+	key     [32]byte
+	buckets [ADDR_BUCKET_COUNT]map[string]*KnownAddress
+	index   map[string]int
+}
+
+// NewAddrBook makes an empty book. Its bucket key and the order Sample
+// returns addresses in are random, or follow seed on a simulated network,
+// see Config.RandSeed.
+func NewAddrBook(clock Clock, seed int64) *AddrBook {
+	book := &AddrBook{
+		clock: clock,
+		rng:   newLockedRand(seed),
+		index: make(map[string]int),
+	}
+
+	book.rng.Read(book.key[:])
+
+	for i := range book.buckets {
+		book.buckets[i] = make(map[string]*KnownAddress)
+	}
+
+	return book
+}
+
+// addrGroup reduces an address to the network it belongs to: the /16 for
+// IPv4, the /32 for IPv6 and the whole name for hostnames.
+func addrGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return strings.ToLower(host)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d", ip4[0], ip4[1])
+	}
+
+	return fmt.Sprintf("%x", []byte(ip.To16()[:4]))
+}
+
+func (book *AddrBook) bucketFor(addr, source string) int {
+	srcGroup := addrGroup(source)
+
+	h1 := sha256.Sum256([]byte(string(book.key[:]) + addrGroup(addr) + "|" + srcGroup))
+	slot := binary.BigEndian.Uint64(h1[:8]) % ADDR_BUCKETS_PER_SOURCE
+
+	h2 := sha256.Sum256([]byte(fmt.Sprintf("%s%s|%d", book.key[:], srcGroup, slot)))
+	return int(binary.BigEndian.Uint64(h2[:8]) % ADDR_BUCKET_COUNT)
+}
+
+// Add records addr as reported by source at the given time. It returns
+// true only when the address was not in the book before, which is what
+// callers use to decide whether it is worth relaying.
+func (book *AddrBook) Add(addr, source string, seen time.Time) bool {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return false
+	}
+
+	// Never trust a timestamp from the future
+	now := book.clock.Now()
+	if seen.After(now) {
+		seen = now
+	}
+
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if b, ok := book.index[addr]; ok {
+		ka := book.buckets[b][addr]
+		if seen.Unix() > ka.LastSeen {
+			ka.LastSeen = seen.Unix()
+		}
+		return false
+	}
+
+	b := book.bucketFor(addr, source)
+	bucket := book.buckets[b]
+
+	if len(bucket) >= ADDR_BUCKET_SIZE {
+		oldest := book.oldestIn(bucket)
+		if bucket[oldest].LastSeen >= seen.Unix() {
+			return false
+		}
+		delete(bucket, oldest)
+		delete(book.index, oldest)
+	}
+
+	bucket[addr] = &KnownAddress{
+		Addr:     addr,
+		LastSeen: seen.Unix(),
+		Source:   source,
+	}
+	book.index[addr] = b
+
+	return true
+}
+
+func (book *AddrBook) oldestIn(bucket map[string]*KnownAddress) string {
+	var oldest string
+
+	for addr, ka := range bucket {
+		if oldest == "" || ka.LastSeen < bucket[oldest].LastSeen {
+			oldest = addr
+		}
+	}
+
+	return oldest
+}
+
+// MarkGood records a successful exchange with addr.
+func (book *AddrBook) MarkGood(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if b, ok := book.index[addr]; ok {
+		ka := book.buckets[b][addr]
+		ka.LastSeen = book.clock.Now().Unix()
+		ka.Attempts = 0
+	}
+}
+
+// MarkFailed records a failed connection attempt to addr.
+func (book *AddrBook) MarkFailed(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if b, ok := book.index[addr]; ok {
+		book.buckets[b][addr].Attempts++
+	}
+}
+
+func (book *AddrBook) Size() int {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	return len(book.index)
+}
+
+// Sample returns up to max random addresses that are still fresh enough to
+// hand out, skipping any listed in exclude.
+func (book *AddrBook) Sample(max int, exclude ...string) []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	skip := make(map[string]bool, len(exclude))
+	for _, addr := range exclude {
+		skip[addr] = true
+	}
+
+	now := book.clock.Now()
+	var fresh []KnownAddress
+
+	for _, bucket := range book.buckets {
+		for addr, ka := range bucket {
+			if !skip[addr] && !ka.isStale(now) {
+				fresh = append(fresh, *ka)
+			}
+		}
+	}
+
+	// Map order is random even on a simulated network
+	sort.Slice(fresh, func(i, j int) bool {
+		return fresh[i].Addr < fresh[j].Addr
+	})
+
+	book.rng.Shuffle(len(fresh), func(i, j int) {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	})
+
+	if len(fresh) > max {
+		fresh = fresh[:max]
+	}
+
+	return fresh
+}
+
+// Entries returns every address in the book, oldest first.
+func (book *AddrBook) Entries() []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	entries := make([]KnownAddress, 0, len(book.index))
+	for _, bucket := range book.buckets {
+		for _, ka := range bucket {
+			entries = append(entries, *ka)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen < entries[j].LastSeen
+	})
+
+	return entries
+}
+
+// -------------------------------------------------------------
+
+// Load merges the addresses persisted at path into the book. A missing
+// file simply means a first run.
+func (book *AddrBook) Load(path string) error {
+
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []KnownAddress
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to decode peers file %s: %w", path, err)
+	}
+
+	for _, ka := range entries {
+		book.Add(ka.Addr, ka.Source, time.Unix(ka.LastSeen, 0))
+	}
+
+	return nil
+}
+
+func (book *AddrBook) Save(path string) error {
+
+	if path == "" {
+		return nil
+	}
+
+	// Saves come from several goroutines and share the temporary file
+	book.saveMu.Lock()
+	defer book.saveMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(book.Entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
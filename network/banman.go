@@ -0,0 +1,374 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BANS_PATH            = "../tmp/banlist_%d.json"
+	DEFAULT_BAN_SCORE    = 100
+	DEFAULT_BAN_DURATION = 24 * time.Hour
+
+	// A misbehavior score drops by one point every SCORE_DECAY_INTERVAL,
+	// so only offences that pile up faster than that lead to a ban
+	SCORE_DECAY_INTERVAL = time.Minute
+
+	// IDENTITY_BAN_PREFIX marks scores and bans kept under a peer's
+	// identity on the secure transport rather than its address
+	IDENTITY_BAN_PREFIX = "identity:"
+)
+
+// Penalties added to a peer's misbehavior score. A peer is banned once its
+// score reaches the configured threshold. No single offence reaches the
+// default on its own: an honest peer can relay a block that only fails
+// against our view of the chain, e.g. one that is too far in our future.
+const (
+	PENALTY_BAD_MESSAGE     = 20
+	PENALTY_UNKNOWN_COMMAND = 10
+	PENALTY_OVERSIZED       = 20
+	PENALTY_INVALID_BLOCK   = 50
+)
+
+// Misbehavior is returned by message handlers when the sending peer broke
+// the protocol.
+type Misbehavior struct {
+	Score  int
+	Reason string
+}
+
+func (m *Misbehavior) Error() string {
+	return fmt.Sprintf("misbehavior (+%d): %s", m.Score, m.Reason)
+}
+
+func misbehaving(score int, format string, args ...interface{}) error {
+	return &Misbehavior{score, fmt.Sprintf(format, args...)}
+}
+
+// -------------------------------------------------------------
+
+type BanEntry struct {
+	Host    string    `json:"host"`
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// BanManager tracks misbehavior scores and bans per host, or per identity
+// for peers on the secure transport. Peers connect from ephemeral ports,
+// so only the host part of an address is used, see BanHost.
+// Scores live in memory and decay; bans are persisted so a restart does
+// not let a banned peer straight back in.
+type BanManager struct {
+	mu        sync.Mutex
+	saveMu    sync.Mutex
+	clock     Clock
+	path      string
+	threshold int
+	duration  time.Duration
+	scores    map[string]*banScore
+	bans      map[string]BanEntry
+}
+
+type banScore struct {
+	score   int
+	updated time.Time
+}
+
+func NewBanManager(path string, threshold int, duration time.Duration, clock Clock) (*BanManager, error) {
+
+	if threshold <= 0 {
+		threshold = DEFAULT_BAN_SCORE
+	}
+
+	if duration <= 0 {
+		duration = DEFAULT_BAN_DURATION
+	}
+
+	bm := &BanManager{
+		clock:     clock,
+		path:      path,
+		threshold: threshold,
+		duration:  duration,
+		scores:    make(map[string]*banScore),
+		bans:      make(map[string]BanEntry),
+	}
+
+	if err := bm.load(); err != nil {
+		return nil, err
+	}
+
+	return bm, nil
+}
+
+// IdentityBanKey is what a peer with the given identity, see IdentityID,
+// is scored and banned under.
+func IdentityBanKey(identity string) string {
+	return IDENTITY_BAN_PREFIX + identity
+}
+
+// BanHost reduces host:port addresses to the host bans are kept under, so
+// that "localhost", "127.0.0.1" and "::ffff:127.0.0.1" are the same host.
+// Every node on this machine shares the loopback host, so loopback
+// addresses keep their port and are told apart by it, see peerKey for how
+// a local peer's listening port is found. Identity keys are kept as they
+// are.
+func BanHost(addr string) string {
+	if strings.HasPrefix(addr, IDENTITY_BAN_PREFIX) {
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+
+	host = canonicalHost(host)
+
+	if port != "" && isLoopback(host) {
+		return net.JoinHostPort(host, port)
+	}
+
+	return host
+}
+
+func canonicalHost(host string) string {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if host == "localhost" {
+		return "127.0.0.1"
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// banKeys lists the entries that ban addr: its own and, on loopback, one
+// for the whole host.
+func banKeys(addr string) []string {
+	key := BanHost(addr)
+
+	if strings.HasPrefix(key, IDENTITY_BAN_PREFIX) {
+		return []string{key}
+	}
+
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		return []string{key, host}
+	}
+
+	return []string{key}
+}
+
+// Misbehaving adds score to the peer at addr and bans it once the threshold
+// is reached. It reports whether the peer is now banned.
+func (bm *BanManager) Misbehaving(addr string, score int, reason string) bool {
+	host := BanHost(addr)
+
+	bm.mu.Lock()
+	total := bm.decayedScore(host) + score
+	bm.scores[host] = &banScore{total, bm.clock.Now()}
+	bm.mu.Unlock()
+
+	fmt.Printf("peer %s misbehaving (%d/%d): %s\n", host, total, bm.threshold, reason)
+
+	if total < bm.threshold {
+		return false
+	}
+
+	bm.Ban(host, bm.duration, reason)
+
+	return true
+}
+
+func (bm *BanManager) Score(addr string) int {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	return bm.decayedScore(BanHost(addr))
+}
+
+// decayedScore brings host's score up to date, a point less for every
+// SCORE_DECAY_INTERVAL since it last changed, and returns it. Callers must
+// hold mu.
+func (bm *BanManager) decayedScore(host string) int {
+	s, ok := bm.scores[host]
+	if !ok {
+		return 0
+	}
+
+	steps := int(bm.clock.Now().Sub(s.updated) / SCORE_DECAY_INTERVAL)
+	if steps >= s.score {
+		delete(bm.scores, host)
+		return 0
+	}
+
+	s.score -= steps
+	s.updated = s.updated.Add(time.Duration(steps) * SCORE_DECAY_INTERVAL)
+
+	return s.score
+}
+
+func (bm *BanManager) Ban(addr string, duration time.Duration, reason string) {
+	host := BanHost(addr)
+	now := bm.clock.Now()
+
+	if duration <= 0 {
+		duration = bm.duration
+	}
+
+	bm.mu.Lock()
+	bm.bans[host] = BanEntry{
+		Host:    host,
+		Until:   now.Add(duration),
+		Reason:  reason,
+		Created: now,
+	}
+	delete(bm.scores, host)
+	bm.mu.Unlock()
+
+	bm.save()
+}
+
+// Unban lifts a ban and reports whether there was one.
+func (bm *BanManager) Unban(addr string) bool {
+	host := BanHost(addr)
+
+	bm.mu.Lock()
+	_, ok := bm.bans[host]
+	delete(bm.bans, host)
+	delete(bm.scores, host)
+	bm.mu.Unlock()
+
+	if ok {
+		bm.save()
+	}
+
+	return ok
+}
+
+func (bm *BanManager) IsBanned(addr string) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	for _, host := range banKeys(addr) {
+		ban, ok := bm.bans[host]
+		if !ok {
+			continue
+		}
+
+		if bm.clock.Now().After(ban.Until) {
+			delete(bm.bans, host)
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// List returns the active bans, soonest to expire first.
+func (bm *BanManager) List() []BanEntry {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.pruneExpired()
+
+	bans := make([]BanEntry, 0, len(bm.bans))
+	for _, ban := range bm.bans {
+		bans = append(bans, ban)
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+
+	return bans
+}
+
+// pruneExpired drops bans that have run out. Callers must hold mu.
+func (bm *BanManager) pruneExpired() {
+	now := bm.clock.Now()
+
+	for host, ban := range bm.bans {
+		if now.After(ban.Until) {
+			delete(bm.bans, host)
+		}
+	}
+}
+
+// -------------------------------------------------------------
+
+func (bm *BanManager) load() error {
+
+	if bm.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(bm.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bans []BanEntry
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("failed to decode ban list %s: %w", bm.path, err)
+	}
+
+	for _, ban := range bans {
+		bm.bans[ban.Host] = ban
+	}
+
+	bm.pruneExpired()
+
+	return nil
+}
+
+func (bm *BanManager) save() {
+
+	if bm.path == "" {
+		return
+	}
+
+	bm.saveMu.Lock()
+	defer bm.saveMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(bm.path), os.ModePerm); err != nil {
+		fmt.Printf("failed to save ban list: %s\n", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(bm.List(), "", "  ")
+	if err != nil {
+		fmt.Printf("failed to save ban list: %s\n", err)
+		return
+	}
+
+	tmp := bm.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		fmt.Printf("failed to save ban list: %s\n", err)
+		return
+	}
+
+	if err := os.Rename(tmp, bm.path); err != nil {
+		fmt.Printf("failed to save ban list: %s\n", err)
+	}
+}
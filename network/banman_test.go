@@ -0,0 +1,79 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time                   { return c.now }
+func (c *testClock) NewTicker(d time.Duration) Ticker { return nil }
+
+// A local peer connects from a new ephemeral port every time, but its bad
+// messages still add up to a ban on the address it listens on.
+func TestLocalPeerBan(t *testing.T) {
+	clock := &testClock{time.Unix(1700000000, 0)}
+
+	banMan, err := NewBanManager("", 0, 0, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Node{banMan: banMan}
+
+	bad := func(i int) {
+		req := append(CmdToBytes("bogus"), GobEncode(Ping{"localhost:3001", 1})...)
+		src := MsgSource{RemoteAddr: fmt.Sprintf("127.0.0.1:%d", 50000+i)}
+
+		n.punish(peerKey(req, src), n.handleRequest(req, src))
+	}
+
+	for i := 0; i < DEFAULT_BAN_SCORE/PENALTY_UNKNOWN_COMMAND-1; i++ {
+		bad(i)
+	}
+
+	if banMan.IsBanned("127.0.0.1:3001") {
+		t.Fatal("banned before reaching the threshold")
+	}
+
+	// Spread out far enough, the offences are forgiven
+	clock.now = clock.now.Add(DEFAULT_BAN_SCORE * SCORE_DECAY_INTERVAL)
+
+	if score := banMan.Score("127.0.0.1:3001"); score != 0 {
+		t.Fatalf("score %d after decaying, want 0", score)
+	}
+
+	for i := 0; i < DEFAULT_BAN_SCORE/PENALTY_UNKNOWN_COMMAND; i++ {
+		bad(i)
+	}
+
+	if !banMan.IsBanned("localhost:3001") {
+		t.Fatal("local peer not banned")
+	}
+
+	if banMan.IsBanned("127.0.0.1:3002") {
+		t.Fatal("another local peer banned")
+	}
+}
+
+// On the secure transport a peer is known by its identity, whatever
+// address it claims.
+func TestIdentityBan(t *testing.T) {
+	req := append(CmdToBytes("bogus"), GobEncode(Ping{"localhost:3001", 1})...)
+
+	a := peerKey(req, MsgSource{RemoteAddr: "10.0.0.1:50000", Identity: "ab"})
+	b := peerKey(req, MsgSource{RemoteAddr: "10.0.0.2:50001", Identity: "ab"})
+
+	if a != b || a != IdentityBanKey("ab") {
+		t.Fatalf("keys %q and %q, want %q", a, b, IdentityBanKey("ab"))
+	}
+
+	// Remote peers go by the host they connect from
+	if key := peerKey(req, MsgSource{RemoteAddr: "10.0.0.1:50000"}); key != "10.0.0.1" {
+		t.Fatalf("remote peer key %q, want 10.0.0.1", key)
+	}
+}
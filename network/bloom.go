@@ -0,0 +1,215 @@
+package network
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sync"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// Bloom filters let a light client ask for "transactions that might be
+// mine" without saying exactly which addresses it owns. The layout and
+// hashing follow BIP37, so filters are sized the way wallets expect.
+const (
+	MAX_BLOOM_FILTER_SIZE = 36000 // bytes
+	MAX_BLOOM_HASH_FUNCS  = 50
+	MAX_FILTER_ADD_SIZE   = 520
+
+	BLOOM_UPDATE_NONE = 0 // never change the filter on a match
+	BLOOM_UPDATE_ALL  = 1 // add the outpoint of every matched output, so spends of it match too
+
+	bloomSeedStep = 0xFBA4C795
+)
+
+type BloomFilter struct {
+	mu        sync.Mutex
+	bits      []byte
+	hashFuncs uint32
+	tweak     uint32
+	flags     byte
+}
+
+// NewBloomFilter sizes a filter for the given number of elements at the
+// given false positive rate.
+func NewBloomFilter(elements int, fpRate float64, tweak uint32, flags byte) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	size = min(max(size, 1), MAX_BLOOM_FILTER_SIZE)
+
+	funcs := int(float64(size*8) / float64(elements) * math.Ln2)
+	funcs = min(max(funcs, 1), MAX_BLOOM_HASH_FUNCS)
+
+	return LoadBloomFilter(make([]byte, size), uint32(funcs), tweak, flags)
+}
+
+// LoadBloomFilter wraps a filter received from a peer.
+func LoadBloomFilter(filter []byte, hashFuncs, tweak uint32, flags byte) *BloomFilter {
+	return &BloomFilter{
+		bits:      append([]byte(nil), filter...),
+		hashFuncs: hashFuncs,
+		tweak:     tweak,
+		flags:     flags,
+	}
+}
+
+// FilterLoad is the message that installs this filter on a peer.
+func (bf *BloomFilter) FilterLoad(from string) FilterLoad {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	return FilterLoad{from, append([]byte(nil), bf.bits...), bf.hashFuncs, bf.tweak, bf.flags}
+}
+
+func (bf *BloomFilter) bitIndex(i uint32, data []byte) uint32 {
+	return murmur3(i*bloomSeedStep+bf.tweak, data) % uint32(len(bf.bits)*8)
+}
+
+func (bf *BloomFilter) Add(data []byte) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	bf.add(data)
+}
+
+func (bf *BloomFilter) add(data []byte) {
+	if len(bf.bits) == 0 {
+		return
+	}
+
+	for i := uint32(0); i < bf.hashFuncs; i++ {
+		idx := bf.bitIndex(i, data)
+		bf.bits[idx/8] |= 1 << (idx % 8)
+	}
+}
+
+func (bf *BloomFilter) Matches(data []byte) bool {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	return bf.matches(data)
+}
+
+func (bf *BloomFilter) matches(data []byte) bool {
+	if len(bf.bits) == 0 {
+		return false
+	}
+
+	for i := uint32(0); i < bf.hashFuncs; i++ {
+		idx := bf.bitIndex(i, data)
+		if bf.bits[idx/8]&(1<<(idx%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Outpoint is how an output is put into a filter: the transaction ID
+// followed by the output index.
+func Outpoint(txID []byte, index int) []byte {
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(index))
+
+	return append(append([]byte{}, txID...), idx[:]...)
+}
+
+// MatchTx reports whether tx is relevant to the filter's owner: its ID,
+// data pushed by an output's locking script, a spent outpoint, or data
+// (or its HASH160, which for P2PKH is the spending key's hash) pushed by
+// an unlocking script is in the filter. With BLOOM_UPDATE_ALL the outpoints of matched outputs
+// are added, so the transaction that later spends them matches as well.
+func (bf *BloomFilter) MatchTx(tx *blockchain.Transaction) bool {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	matched := bf.matches(tx.ID)
+
+	for i, out := range tx.Outputs {
+		for _, data := range blockchain.ScriptPushes(out.LockScript) {
+			if bf.matches(data) {
+				matched = true
+
+				if bf.flags == BLOOM_UPDATE_ALL {
+					bf.add(Outpoint(tx.ID, i))
+				}
+				break
+			}
+		}
+	}
+
+	if matched {
+		return true
+	}
+
+	for _, in := range tx.Inputs {
+		if tx.IsCoinbase() {
+			break
+		}
+
+		if bf.matches(Outpoint(in.ID, in.Out)) {
+			return true
+		}
+
+		for _, data := range blockchain.ScriptPushes(in.UnlockScript) {
+			if bf.matches(data) || bf.matches(wallet.PublicKeyHash(data)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// -------------------------------------------------------------
+
+// murmur3 is the 32 bit MurmurHash3 BIP37 filters are defined with.
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	h := seed
+	n := len(data) / 4
+
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
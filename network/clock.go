@@ -0,0 +1,36 @@
+package network
+
+import "time"
+
+// Clock is where the node gets the time from. Everything runs on the real
+// clock except under the simulator, which drives time by hand so that
+// tests are repeatable.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+var RealClock Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
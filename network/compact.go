@@ -0,0 +1,416 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// Compact blocks announce a new block as its header plus a short ID per
+// transaction. Peers rebuild the block from their memory pool and only
+// ask for the transactions they are missing:
+//
+//	miner -> peer   cmpctblock (header, salt, short IDs, coinbase)
+//	peer  -> miner  getblocktxn (indexes it could not fill)
+//	miner -> peer   blocktxn (those transactions)
+//
+// Short IDs are salted per block, so nobody can grind transactions that
+// collide with someone else's ahead of time. A collision that happens
+// anyway shows up as a proof of work that does not verify, and the peer
+// falls back to downloading the full block.
+const (
+	CMPCT_BLOCK   = "cmpctblock"
+	GET_BLOCK_TXN = "getblocktxn"
+	BLOCK_TXN     = "blocktxn"
+
+	SHORT_ID_LENGTH      = 6
+	MAX_TXS_PER_BLOCK    = 100000
+	MAX_PARTIAL_BLOCKS   = 16
+	PARTIAL_BLOCK_EXPIRY = time.Minute
+)
+
+type BlockHeader struct {
+	Timestamp int64
+	Height    int
+	Nonce     int
+	PrevHash  []byte
+	Hash      []byte
+}
+
+type PrefilledTx struct {
+	Index       int
+	Transaction []byte
+}
+
+type CompactBlock struct {
+	AddrFrom  string
+	Header    BlockHeader
+	Salt      uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+type GetBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type BlockTxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+// partialBlock is a compact block waiting for the transactions we could
+// not find locally.
+type partialBlock struct {
+	header  BlockHeader
+	txs     []*blockchain.Transaction
+	missing []int
+	from    string
+	added   time.Time
+}
+
+// -------------------------------------------------------------
+
+func shortTxID(blockHash []byte, salt uint64, txID []byte) uint64 {
+	var saltBytes [8]byte
+	binary.BigEndian.PutUint64(saltBytes[:], salt)
+
+	h := sha256.New()
+	h.Write(blockHash)
+	h.Write(saltBytes[:])
+	h.Write(txID)
+
+	var id [8]byte
+	copy(id[8-SHORT_ID_LENGTH:], h.Sum(nil)[:SHORT_ID_LENGTH])
+
+	return binary.BigEndian.Uint64(id[:])
+}
+
+func headerOf(b *blockchain.Block) BlockHeader {
+	return BlockHeader{b.Timestamp, b.Height, b.Nonce, b.PrevHash, b.Hash}
+}
+
+// NewCompactBlock encodes b for relay, with short IDs salted by salt.
+// Coinbases never sit in anyone's memory pool, so they are sent in full.
+func NewCompactBlock(from string, b *blockchain.Block, salt uint64) CompactBlock {
+	cb := CompactBlock{
+		AddrFrom: from,
+		Header:   headerOf(b),
+		Salt:     salt,
+	}
+
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, PrefilledTx{i, tx.Serialize()})
+		} else {
+			cb.ShortIDs = append(cb.ShortIDs, shortTxID(b.Hash, cb.Salt, tx.ID))
+		}
+	}
+
+	return cb
+}
+
+// meetsTarget checks the header's claimed hash against the difficulty
+// target, which weeds out junk before we spend a round trip on it. The
+// full proof is checked once the block is rebuilt.
+func (h BlockHeader) meetsTarget() bool {
+	if len(h.Hash) != sha256.Size {
+		return false
+	}
+
+	var intHash big.Int
+	intHash.SetBytes(h.Hash)
+
+	return intHash.Cmp(blockchain.NewProof(&blockchain.Block{}).Target) == -1
+}
+
+func (p *partialBlock) block() *blockchain.Block {
+	return &blockchain.Block{
+		Timestamp:    p.header.Timestamp,
+		Height:       p.header.Height,
+		Nonce:        p.header.Nonce,
+		PrevHash:     p.header.PrevHash,
+		Hash:         p.header.Hash,
+		Transactions: p.txs,
+	}
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) SendCompactBlock(addr string, b *blockchain.Block) {
+	payload := GobEncode(NewCompactBlock(n.Address, b, n.rng.Uint64()))
+	request := append(CmdToBytes(CMPCT_BLOCK), payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendGetBlockTxn(addr string, blockHash []byte, indexes []int) {
+	payload := GobEncode(GetBlockTxn{n.Address, blockHash, indexes})
+	request := append(CmdToBytes(GET_BLOCK_TXN), payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendBlockTxn(addr string, blockHash []byte, txs [][]byte) {
+	payload := GobEncode(BlockTxn{n.Address, blockHash, txs})
+	request := append(CmdToBytes(BLOCK_TXN), payload...)
+	n.SendData(addr, request)
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) HandleCompactBlock(request []byte) error {
+	var buff bytes.Buffer
+	var payload CompactBlock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable cmpctblock payload")
+	}
+
+	header := payload.Header
+	total := len(payload.ShortIDs) + len(payload.Prefilled)
+
+	if total == 0 || total > MAX_TXS_PER_BLOCK {
+		return misbehaving(PENALTY_OVERSIZED, "compact block with %d transactions", total)
+	}
+
+	if !header.meetsTarget() {
+		return misbehaving(PENALTY_INVALID_BLOCK, "compact block %x does not meet the target", header.Hash)
+	}
+
+	var known bool
+	n.withChain(func(chain *blockchain.Blockchain) {
+		known = chain.HasBlock(header.Hash)
+	})
+	if known || n.orphanBlocks.Has(header.Hash) || n.hasPartialBlock(header.Hash) {
+		return nil
+	}
+
+	partial := &partialBlock{
+		header: header,
+		txs:    make([]*blockchain.Transaction, total),
+		from:   payload.AddrFrom,
+		added:  n.clock.Now(),
+	}
+
+	for _, pre := range payload.Prefilled {
+		if pre.Index < 0 || pre.Index >= total || partial.txs[pre.Index] != nil {
+			return misbehaving(PENALTY_BAD_MESSAGE, "bad prefilled index %d", pre.Index)
+		}
+
+		tx, err := blockchain.DecodeTransaction(pre.Transaction)
+		if err != nil {
+			return misbehaving(PENALTY_BAD_MESSAGE, "undecodable prefilled transaction")
+		}
+		partial.txs[pre.Index] = &tx
+	}
+
+	// Map the memory pool onto this block's short IDs. IDs claimed by more
+	// than one of our transactions are ambiguous and get fetched instead.
+	candidates := make(map[uint64]*blockchain.Transaction)
+	ambiguous := make(map[uint64]bool)
+
+	for _, tx := range n.mempoolSnapshot() {
+		tx := tx
+		id := shortTxID(header.Hash, payload.Salt, tx.ID)
+
+		if _, ok := candidates[id]; ok {
+			ambiguous[id] = true
+		}
+		candidates[id] = &tx
+	}
+
+	next := 0
+	for i := range partial.txs {
+		if partial.txs[i] != nil {
+			continue
+		}
+
+		id := payload.ShortIDs[next]
+		next++
+
+		if tx, ok := candidates[id]; ok && !ambiguous[id] {
+			partial.txs[i] = tx
+		} else {
+			partial.missing = append(partial.missing, i)
+		}
+	}
+
+	if len(partial.missing) == 0 {
+		fmt.Printf("Rebuilt compact block %x from the memory pool\n", header.Hash)
+		return n.completePartialBlock(partial)
+	}
+
+	fmt.Printf("Compact block %x is missing %d of %d transactions\n", header.Hash, len(partial.missing), total)
+
+	n.addPartialBlock(partial)
+	n.SendGetBlockTxn(payload.AddrFrom, header.Hash, partial.missing)
+
+	return nil
+}
+
+func (n *Node) HandleGetBlockTxn(request []byte) error {
+	var buff bytes.Buffer
+	var payload GetBlockTxn
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable getblocktxn payload")
+	}
+
+	var block *blockchain.Block
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		block, err = chain.GetBlock(payload.BlockHash)
+	})
+	if err != nil {
+		return nil
+	}
+
+	if len(payload.Indexes) > len(block.Transactions) {
+		return misbehaving(PENALTY_OVERSIZED, "%d transactions requested from a block of %d", len(payload.Indexes), len(block.Transactions))
+	}
+
+	txs := make([][]byte, 0, len(payload.Indexes))
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(block.Transactions) {
+			return misbehaving(PENALTY_BAD_MESSAGE, "transaction index %d out of range", i)
+		}
+		txs = append(txs, block.Transactions[i].Serialize())
+	}
+
+	n.SendBlockTxn(payload.AddrFrom, payload.BlockHash, txs)
+
+	return nil
+}
+
+func (n *Node) HandleBlockTxn(request []byte) error {
+	var buff bytes.Buffer
+	var payload BlockTxn
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable blocktxn payload")
+	}
+
+	// Unrequested or late answers are simply dropped
+	partial, ok := n.takePartialBlock(payload.BlockHash)
+	if !ok {
+		return nil
+	}
+
+	if len(payload.Transactions) != len(partial.missing) {
+		return misbehaving(PENALTY_BAD_MESSAGE, "asked for %d transactions, got %d", len(partial.missing), len(payload.Transactions))
+	}
+
+	for i, data := range payload.Transactions {
+		tx, err := blockchain.DecodeTransaction(data)
+		if err != nil {
+			return misbehaving(PENALTY_BAD_MESSAGE, "undecodable block transaction")
+		}
+		partial.txs[partial.missing[i]] = &tx
+	}
+	partial.missing = nil
+
+	return n.completePartialBlock(partial)
+}
+
+// completePartialBlock checks a rebuilt block and hands it on like any
+// block received in full. A rebuilt block whose proof fails may just have
+// hit a short ID collision, so before blaming the peer the full block is
+// requested.
+func (n *Node) completePartialBlock(partial *partialBlock) error {
+	block := partial.block()
+
+	if valid, err := blockchain.NewProof(block).Verify(); err != nil || !valid {
+		fmt.Printf("Compact block %x did not rebuild, downloading it in full\n", block.Hash)
+		n.SendGetData(partial.from, BLOCK, block.Hash)
+		return nil
+	}
+
+	return n.acceptBlock(block, partial.from)
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) hasPartialBlock(hash []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.partialBlocks[hex.EncodeToString(hash)]
+	return ok
+}
+
+// addPartialBlock remembers a block waiting for transactions, forgetting
+// ones whose peer never answered and, if still full, the oldest.
+func (n *Node) addPartialBlock(partial *partialBlock) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.clock.Now()
+	var oldest string
+
+	for hash, p := range n.partialBlocks {
+		if now.Sub(p.added) > PARTIAL_BLOCK_EXPIRY {
+			delete(n.partialBlocks, hash)
+			continue
+		}
+		if oldest == "" || p.added.Before(n.partialBlocks[oldest].added) {
+			oldest = hash
+		}
+	}
+
+	if len(n.partialBlocks) >= MAX_PARTIAL_BLOCKS {
+		delete(n.partialBlocks, oldest)
+	}
+
+	n.partialBlocks[hex.EncodeToString(partial.header.Hash)] = partial
+}
+
+func (n *Node) takePartialBlock(hash []byte) (*partialBlock, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := hex.EncodeToString(hash)
+
+	partial, ok := n.partialBlocks[key]
+	delete(n.partialBlocks, key)
+
+	return partial, ok
+}
+
+// setCompactPeer records whether addr said it understands compact blocks.
+func (n *Node) setCompactPeer(addr string, compact bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	if !ok {
+		st = &peerState{}
+		n.peerStates[addr] = st
+	}
+	st.compact = compact
+}
+
+func (n *Node) isCompactPeer(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	return ok && st.compact
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+const (
+	PEERS_PATH        = "../tmp/peers_%d.json"
+	DEFAULT_MAX_PEERS = 8
+)
+
+// Config describes where a node listens, how it presents itself to the
+// rest of the network and who it talks to first.
+type Config struct {
+	ListenHost   string   // interface to bind, e.g. "0.0.0.0" inside a container
+	ListenPort   uint16   // TCP port for peer traffic
+	ExternalAddr string   // host:port advertised to peers, defaults to the listen address
+	SeedNodes    []string // peers contacted on startup
+	PeersFile    string   // where the address book is persisted between runs, empty to disable
+	MaxPeers     int      // how many peers we actively gossip with
+	MinerAddress string
+
+	PingInterval time.Duration // how often peers are pinged
+	PingTimeout  time.Duration // how long a peer may take to answer before it is dropped
+
+	IdentityFile string   // where the node's ed25519 identity key lives
+	Encrypt      bool     // dial peers over the secure transport and refuse plaintext
+	AllowedPeers []string // identities allowed to connect, empty allows any; implies Encrypt
+
+	BanFile      string        // where bans are persisted between runs, empty to disable
+	BanThreshold int           // misbehavior score at which a peer gets banned
+	BanDuration  time.Duration // how long a ban lasts
+
+	HeadersFile string // where an SPV client keeps its headers and proven transactions
+
+	Genesis string // genesis coinbase data, nodes with different values are separate networks
+
+	Clock     Clock     // defaults to the real clock
+	RandSeed  int64     // seeds nonces, salts and shuffles on a simulated network, zero draws them from crypto/rand
+	Transport Transport // defaults to TCP
+}
+
+// DefaultConfig reproduces the historical layout where the peer port sits
+// right above the HTTP port and localhost:5001 is the only seed.
+func DefaultConfig(port uint16) Config {
+	return Config{
+		ListenHost: "localhost",
+		ListenPort: port + 1,
+		SeedNodes:  []string{NODE_ZERO},
+		PeersFile:  fmt.Sprintf(PEERS_PATH, port),
+		MaxPeers:   DEFAULT_MAX_PEERS,
+
+		PingInterval: DEFAULT_PING_INTERVAL,
+		PingTimeout:  DEFAULT_PING_TIMEOUT,
+
+		IdentityFile: fmt.Sprintf(IDENTITY_PATH, port),
+
+		HeadersFile: fmt.Sprintf(SPV_PATH, port),
+
+		Genesis: blockchain.GENESIS_DATA,
+
+		BanFile:      fmt.Sprintf(BANS_PATH, port),
+		BanThreshold: DEFAULT_BAN_SCORE,
+		BanDuration:  DEFAULT_BAN_DURATION,
+	}
+}
+
+func (cfg Config) ListenAddr() string {
+	return net.JoinHostPort(cfg.ListenHost, strconv.Itoa(int(cfg.ListenPort)))
+}
+
+// AdvertisedAddr is the address this node hands out to peers. Binding to a
+// wildcard interface says nothing about how to reach us, so it cannot be
+// advertised without ExternalAddr.
+func (cfg Config) AdvertisedAddr() (string, error) {
+	if cfg.ExternalAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.ExternalAddr); err != nil {
+			return "", fmt.Errorf("invalid external address %q: %w", cfg.ExternalAddr, err)
+		}
+		return cfg.ExternalAddr, nil
+	}
+
+	switch cfg.ListenHost {
+	case "", "0.0.0.0", "::":
+		return "", fmt.Errorf("listening on all interfaces requires an external address")
+	}
+
+	return cfg.ListenAddr(), nil
+}
+
+// ParsePeerList splits a comma separated list of host:port peers.
+func ParsePeerList(list string) ([]string, error) {
+	var peers []string
+
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(p); err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", p, err)
+		}
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
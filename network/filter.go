@@ -0,0 +1,357 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// Light clients install a bloom filter on a full peer and from then on
+// only hear about transactions that match it. Blocks are fetched with a
+// getdata of type FILTERED_BLOCK and come back as a merkleblock: the
+// header, a partial merkle tree proving the matched transactions are in
+// the block, and those transactions.
+const (
+	FILTER_LOAD  = "filterload"
+	FILTER_ADD   = "filteradd"
+	FILTER_CLEAR = "filterclear"
+	MERKLE_BLOCK = "merkleblock"
+
+	FILTERED_BLOCK = "filteredblock"
+)
+
+var ErrBadMerkleBlock = errors.New("merkle block does not match its header")
+
+type FilterLoad struct {
+	AddrFrom  string
+	Filter    []byte
+	HashFuncs uint32
+	Tweak     uint32
+	Flags     byte
+}
+
+type FilterAdd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+type FilterClear struct {
+	AddrFrom string
+}
+
+type MerkleBlock struct {
+	AddrFrom     string
+	Header       BlockHeader
+	Tree         blockchain.PartialMerkleTree
+	Transactions [][]byte
+}
+
+// NewMerkleBlock filters b down to the transactions matching bf.
+func NewMerkleBlock(from string, b *blockchain.Block, bf *BloomFilter) MerkleBlock {
+	mb := MerkleBlock{
+		AddrFrom: from,
+		Header:   headerOf(b),
+	}
+
+	leaves := make([][]byte, len(b.Transactions))
+	matches := make([]bool, len(b.Transactions))
+
+	for i, tx := range b.Transactions {
+		leaves[i] = blockchain.TxLeaf(tx)
+
+		if bf.MatchTx(tx) {
+			matches[i] = true
+			mb.Transactions = append(mb.Transactions, tx.Serialize())
+		}
+	}
+
+	mb.Tree = *blockchain.NewPartialMerkleTree(leaves, matches)
+
+	return mb
+}
+
+// Verify checks the proof against the header's proof of work and returns
+// the matched transactions, in block order. Anything that was not proven
+// to be in the block is an error.
+func (mb *MerkleBlock) Verify() ([]blockchain.Transaction, error) {
+	_, txs, err := mb.verify()
+	return txs, err
+}
+
+// verify is Verify that also hands back the merkle root the header's
+// proof of work commits to.
+func (mb *MerkleBlock) verify() ([]byte, []blockchain.Transaction, error) {
+
+	root, matched, _, err := mb.Tree.ExtractMatches()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := &blockchain.Block{
+		Timestamp: mb.Header.Timestamp,
+		PrevHash:  mb.Header.PrevHash,
+		Nonce:     mb.Header.Nonce,
+		Hash:      mb.Header.Hash,
+	}
+
+	if !blockchain.NewProof(header).VerifyRoot(root) {
+		return nil, nil, ErrBadMerkleBlock
+	}
+
+	if len(matched) != len(mb.Transactions) {
+		return nil, nil, ErrBadMerkleBlock
+	}
+
+	txs := make([]blockchain.Transaction, len(mb.Transactions))
+	for i, data := range mb.Transactions {
+		tx, err := blockchain.DecodeTransaction(data)
+		if err != nil {
+			return nil, nil, ErrBadMerkleBlock
+		}
+		txs[i] = tx
+
+		// Leaves take the ID as given, so it must be the transaction's own
+		if !bytes.Equal(txs[i].ComputeID(), txs[i].ID) || !bytes.Equal(blockchain.TxLeafHash(&txs[i]), matched[i]) {
+			return nil, nil, ErrBadMerkleBlock
+		}
+	}
+
+	return root, txs, nil
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) SendFilterLoad(addr string, bf *BloomFilter) {
+	payload := GobEncode(bf.FilterLoad(n.Address))
+	request := append(CmdToBytes(FILTER_LOAD), payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendFilterAdd(addr string, data []byte) {
+	payload := GobEncode(FilterAdd{n.Address, data})
+	request := append(CmdToBytes(FILTER_ADD), payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendFilterClear(addr string) {
+	payload := GobEncode(FilterClear{n.Address})
+	request := append(CmdToBytes(FILTER_CLEAR), payload...)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendMerkleBlock(addr string, b *blockchain.Block, bf *BloomFilter) {
+	payload := GobEncode(NewMerkleBlock(n.Address, b, bf))
+	request := append(CmdToBytes(MERKLE_BLOCK), payload...)
+	n.SendData(addr, request)
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) HandleFilterLoad(request []byte, src MsgSource) error {
+	var buff bytes.Buffer
+	var payload FilterLoad
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable filterload payload")
+	}
+
+	if len(payload.Filter) > MAX_BLOOM_FILTER_SIZE || payload.HashFuncs > MAX_BLOOM_HASH_FUNCS {
+		return misbehaving(PENALTY_OVERSIZED, "bloom filter of %d bytes with %d hash functions", len(payload.Filter), payload.HashFuncs)
+	}
+
+	if err := n.checkPeerSender(payload.AddrFrom, src); err != nil {
+		return err
+	}
+
+	if n.isFullPeer(payload.AddrFrom) {
+		return fmt.Errorf("filterload from %s, which announced itself a full node", payload.AddrFrom)
+	}
+
+	n.setPeerFilter(payload.AddrFrom, LoadBloomFilter(payload.Filter, payload.HashFuncs, payload.Tweak, payload.Flags), src.Identity)
+
+	fmt.Printf("Loaded a %d byte bloom filter for %s\n", len(payload.Filter), payload.AddrFrom)
+
+	return nil
+}
+
+func (n *Node) HandleFilterAdd(request []byte, src MsgSource) error {
+	var buff bytes.Buffer
+	var payload FilterAdd
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable filteradd payload")
+	}
+
+	if len(payload.Data) > MAX_FILTER_ADD_SIZE {
+		return misbehaving(PENALTY_OVERSIZED, "%d bytes added to a bloom filter", len(payload.Data))
+	}
+
+	if err := n.checkPeerSender(payload.AddrFrom, src); err != nil {
+		return err
+	}
+
+	bf := n.peerFilter(payload.AddrFrom)
+	if bf == nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "filteradd without a loaded filter")
+	}
+
+	bf.Add(payload.Data)
+
+	return nil
+}
+
+func (n *Node) HandleFilterClear(request []byte, src MsgSource) error {
+	var buff bytes.Buffer
+	var payload FilterClear
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable filterclear payload")
+	}
+
+	if err := n.checkPeerSender(payload.AddrFrom, src); err != nil {
+		return err
+	}
+
+	n.setPeerFilter(payload.AddrFrom, nil, "")
+
+	return nil
+}
+
+// -------------------------------------------------------------
+
+// checkPeerSender checks that a message about how we relay to the peer at
+// addr, a filter or whether it is a light client, comes from that peer.
+// AddrFrom is whatever the sender says it is, so without this any peer
+// could swap out or clear someone else's filter.
+//
+// Over the secure transport the sender must be the identity we find
+// listening on addr when we dial it, which any other process, even one on
+// the same host, can't pass for. On plaintext, or if addr can't be dialed
+// securely, all there is to go on is that the connection comes from addr's
+// host and that a filter loaded by an identity stays that identity's.
+func (n *Node) checkPeerSender(addr string, src MsgSource) error {
+
+	if src.Identity != "" && n.peerIdentity(addr) == "" {
+		// Dialing addr tells us who is really there
+		_, height := n.Tip()
+		n.sendVersion(addr, height)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+
+	if ok && st.identity != "" {
+		if src.Identity != st.identity {
+			return misbehaving(PENALTY_BAD_MESSAGE, "message for %s sent by another identity", addr)
+		}
+		return nil
+	}
+
+	if !sameHost(addr, src.RemoteAddr) {
+		return misbehaving(PENALTY_BAD_MESSAGE, "message for %s sent from %s", addr, src.RemoteAddr)
+	}
+
+	if ok && st.filterOwner != "" && st.filterOwner != src.Identity {
+		return misbehaving(PENALTY_BAD_MESSAGE, "filter for %s sent by another identity", addr)
+	}
+
+	return nil
+}
+
+// setPeerIdentity records the identity found listening on addr.
+func (n *Node) setPeerIdentity(addr, identity string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	if !ok {
+		st = &peerState{}
+		n.peerStates[addr] = st
+	}
+	st.identity = identity
+}
+
+func (n *Node) peerIdentity(addr string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if st, ok := n.peerStates[addr]; ok {
+		return st.identity
+	}
+	return ""
+}
+
+// setFullPeer records whether addr announced itself a full node. A full
+// node gets everything relayed, so any filter it had is dropped.
+func (n *Node) setFullPeer(addr string, full bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	if !ok {
+		st = &peerState{}
+		n.peerStates[addr] = st
+	}
+	st.full = full
+	if full {
+		st.filter, st.filterOwner = nil, ""
+	}
+}
+
+func (n *Node) isFullPeer(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	return ok && st.full
+}
+
+// sameHost reports whether two host:port addresses are on the same host.
+func sameHost(a, b string) bool {
+	hostA, _, errA := net.SplitHostPort(a)
+	hostB, _, errB := net.SplitHostPort(b)
+
+	return errA == nil && errB == nil && canonicalHost(hostA) == canonicalHost(hostB)
+}
+
+// setPeerFilter installs bf for addr, loaded by the peer with the given
+// transport identity, empty on plaintext.
+func (n *Node) setPeerFilter(addr string, bf *BloomFilter, owner string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	if !ok {
+		st = &peerState{}
+		n.peerStates[addr] = st
+	}
+	st.filter = bf
+	st.filterOwner = owner
+}
+
+// peerFilter returns the filter addr loaded, or nil if it relays
+// everything.
+func (n *Node) peerFilter(addr string) *BloomFilter {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if st, ok := n.peerStates[addr]; ok {
+		return st.filter
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func filterLoadFrom(addr string) []byte {
+	bf := NewBloomFilter(10, 0.01, 1, BLOOM_UPDATE_ALL)
+	return append(CmdToBytes(FILTER_LOAD), GobEncode(bf.FilterLoad(addr))...)
+}
+
+// A filter for a peer can only come from that peer, and never turns a
+// peer that announced itself a full node into a filtered one.
+func TestFilterSender(t *testing.T) {
+	n := &Node{peerStates: make(map[string]*peerState)}
+
+	light, full := "127.0.0.1:4001", "127.0.0.1:4002"
+	local := MsgSource{RemoteAddr: "127.0.0.1:50000"}
+
+	if err := n.HandleFilterLoad(filterLoadFrom(light), local); err != nil {
+		t.Fatalf("filterload from the light client: %s", err)
+	}
+
+	if err := n.HandleFilterLoad(filterLoadFrom(light), MsgSource{RemoteAddr: "10.0.0.1:50000"}); err == nil {
+		t.Fatal("filterload from another host accepted")
+	}
+
+	// Once we know who listens on the address, only they may set its filter
+	n.setPeerIdentity(light, "aa")
+
+	var m *Misbehavior
+	if err := n.HandleFilterLoad(filterLoadFrom(light), MsgSource{RemoteAddr: local.RemoteAddr, Identity: "bb"}); !errors.As(err, &m) {
+		t.Fatalf("filterload from another identity: %v, want misbehavior", err)
+	}
+
+	if err := n.HandleFilterLoad(filterLoadFrom(light), MsgSource{RemoteAddr: local.RemoteAddr, Identity: "aa"}); err != nil {
+		t.Fatalf("filterload from the identity on the address: %s", err)
+	}
+
+	n.setFullPeer(full, true)
+
+	if err := n.HandleFilterLoad(filterLoadFrom(full), local); err == nil {
+		t.Fatal("filterload for a full node accepted")
+	}
+
+	if n.peerFilter(full) != nil {
+		t.Fatal("full node has a filter")
+	}
+}
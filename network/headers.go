@@ -0,0 +1,119 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// VerifiedHeader is a block header along with the merkle root its proof
+// of work commits to. Blocks carry no root of their own, so without it a
+// header could not be checked again later.
+type VerifiedHeader struct {
+	BlockHeader
+	MerkleRoot []byte
+}
+
+func (h *VerifiedHeader) checkProof() bool {
+	header := &blockchain.Block{
+		Timestamp: h.Timestamp,
+		PrevHash:  h.PrevHash,
+		Nonce:     h.Nonce,
+		Hash:      h.Hash,
+	}
+
+	return blockchain.NewProof(header).VerifyRoot(h.MerkleRoot)
+}
+
+// headerChain is every header an SPV client has verified, forks included.
+// The best chain is the one with the highest tip. It is not safe for
+// concurrent use; the client guards it.
+type headerChain struct {
+	byHash map[string]*VerifiedHeader
+	tip    *VerifiedHeader
+}
+
+func newHeaderChain(genesis VerifiedHeader) *headerChain {
+	hc := &headerChain{
+		byHash: make(map[string]*VerifiedHeader),
+		tip:    &genesis,
+	}
+	hc.byHash[hex.EncodeToString(genesis.Hash)] = &genesis
+
+	return hc
+}
+
+func (hc *headerChain) get(hash []byte) (*VerifiedHeader, bool) {
+	h, ok := hc.byHash[hex.EncodeToString(hash)]
+	return h, ok
+}
+
+func (hc *headerChain) has(hash []byte) bool {
+	_, ok := hc.get(hash)
+	return ok
+}
+
+// add links h onto its parent after checking its proof of work. A header
+// whose parent we don't have yet is reported as blockchain.ErrOrphanBlock.
+func (hc *headerChain) add(h VerifiedHeader) error {
+
+	if hc.has(h.Hash) {
+		return nil
+	}
+
+	if !h.checkProof() {
+		return fmt.Errorf("header %x has an invalid proof of work", h.Hash)
+	}
+
+	parent, ok := hc.get(h.PrevHash)
+	if !ok {
+		return blockchain.ErrOrphanBlock
+	}
+
+	if h.Height != parent.Height+1 {
+		return fmt.Errorf("header height %d does not follow parent height %d", h.Height, parent.Height)
+	}
+
+	hc.byHash[hex.EncodeToString(h.Hash)] = &h
+
+	if h.Height > hc.tip.Height {
+		hc.tip = &h
+	}
+
+	return nil
+}
+
+// onBestChain reports whether hash is an ancestor of, or is, the tip.
+func (hc *headerChain) onBestChain(hash []byte) bool {
+	target, ok := hc.get(hash)
+	if !ok {
+		return false
+	}
+
+	h := hc.tip
+	for h.Height > target.Height {
+		h, ok = hc.get(h.PrevHash)
+		if !ok {
+			return false
+		}
+	}
+
+	return h == target
+}
+
+// headers lists every header, lowest first, which is the order add needs
+// when they are loaded back.
+func (hc *headerChain) headers() []VerifiedHeader {
+	list := make([]VerifiedHeader, 0, len(hc.byHash))
+	for _, h := range hc.byHash {
+		list = append(list, *h)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Height < list[j].Height
+	})
+
+	return list
+}
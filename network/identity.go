@@ -0,0 +1,75 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const IDENTITY_PATH = "../tmp/node_key_%d"
+
+// LoadIdentity reads the node's long-term ed25519 key from path, creating
+// and saving a fresh one on first run. Peers recognise the node by the
+// public half, so the file must survive restarts.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+
+	data, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())), 0600); err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid node key in %s", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// IdentityID is the printable form of a node identity, used in logs and
+// allowlists.
+func IdentityID(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// ParseIdentityList splits a comma separated list of identity IDs.
+func ParseIdentityList(list string) ([]string, error) {
+	var ids []string
+
+	for _, id := range strings.Split(list, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" {
+			continue
+		}
+
+		if raw, err := hex.DecodeString(id); err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid peer identity %q", id)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
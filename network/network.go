@@ -3,7 +3,7 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +11,7 @@ import (
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/i101dev/blockchain-Tensor/blockchain"
 	"github.com/vrecan/death"
@@ -24,26 +25,38 @@ const (
 	ADDR       = "addr"
 	BLOCK      = "block"
 	INV        = "inv"
+	GET_ADDR   = "getaddr"
 	GET_BLOCKS = "getblocks"
 	GET_DATA   = "getdata"
+	PING       = "ping"
+	PONG       = "pong"
 	TX         = "tx"
 	VERSION    = "version"
 
 	NODE_ZERO = "localhost:5001"
-)
 
-var (
-	nodeAddress     string
-	mineAddress     string
-	KnownNodes      = []string{NODE_ZERO}
-	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
+	MAX_INV_PER_MSG     = 50000
+	MAX_ADDR_PER_MSG    = 1000
+	ADDR_RELAY_MAX      = 10
+	ADDR_RELAY_FANOUT   = 2
+	GETADDR_REPLY_SIZE  = 250
+	ADDR_RELAY_INTERVAL = 2 * time.Minute
 )
 
 // -------------------------------------------------------------
 
+type NetAddr struct {
+	Addr      string
+	Timestamp int64
+}
+
 type Addr struct {
-	AddrList []string
+	AddrFrom string
+	AddrList []NetAddr
+}
+
+type GetAddr struct {
+	AddrFrom string
 }
 
 type Block struct {
@@ -67,15 +80,28 @@ type Inv struct {
 	Items    [][]byte
 }
 
+type Ping struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
+type Pong struct {
+	AddrFrom string
+	Nonce    uint64
+}
+
 type Tx struct {
 	AddrFrom    string
 	Transaction []byte
 }
 
 type Version struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version       int
+	BestHeight    int
+	AddrFrom      string
+	CompactBlocks bool   // the sender understands cmpctblock
+	Light         bool   // the sender is an SPV client and serves no blocks
+	Genesis       string // the sender's genesis data, which names its network
 }
 
 // -------------------------------------------------------------
@@ -119,91 +145,173 @@ func GobEncode(data interface{}) []byte {
 }
 
 // -------------------------------------------------------------
-func SendData(addr string, data []byte) {
 
-	conn, err := net.Dial(protocol, addr)
+// ErrBannedPeer is returned by SendData for a peer we have banned.
+var ErrBannedPeer = errors.New("peer is banned")
 
-	// fmt.Printf("\n*** >>> [SendData] - %s - %s", addr, string(data))
-
-	if err != nil {
+// SendData sends one message to addr on a connection of its own. Failures
+// are logged, for the many callers that fire and forget, and returned for
+// those that need to know whether the message went out.
+func (n *Node) SendData(addr string, data []byte) error {
 
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+	if n.banMan.IsBanned(addr) {
+		n.RemoveKnownNode(addr)
+		return ErrBannedPeer
+	}
 
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
+	conn, err := n.dial(addr)
 
-		KnownNodes = updatedNodes
+	// fmt.Printf("\n*** >>> [SendData] - %s - %s", addr, string(data))
 
-		return
+	if err != nil {
+		fmt.Printf("%s is not available: %s\n", addr, err)
+		n.RemoveKnownNode(addr)
+		n.addrBook.MarkFailed(addr)
+		return err
 	}
 
-	defer conn.Close()
+	if sc, ok := conn.(*SecureConn); ok {
+		n.setPeerIdentity(addr, IdentityID(sc.RemoteIdentity()))
+	}
 
 	_, err = io.Copy(conn, bytes.NewReader(data))
+
+	// Closing a secure connection sends the end of the message
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to send to %s: %s\n", addr, err)
 	}
+
+	return err
 }
 
-func SendTx(addr string, txn *blockchain.Transaction) {
-	data := Tx{nodeAddress, txn.Serialize()}
+func (n *Node) SendTx(addr string, txn *blockchain.Transaction) error {
+	data := Tx{n.Address, txn.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes(TX), payload...)
-	SendData(addr, request)
+	return n.SendData(addr, request)
+}
+
+// ErrNoPeers is returned by SubmitTx when no full node it knows of took
+// the transaction.
+var ErrNoPeers = errors.New("no reachable peers to relay the transaction to")
+
+// SubmitTx puts a locally created transaction in the memory pool and sends
+// it to every known full node, the seeds among them, which relay it on to
+// the miners. If none of them can be reached the transaction stays in
+// this node's pool only and ErrNoPeers is returned. A transaction that
+// doesn't verify or that the pool refuses, see addToMempool, is not sent
+// at all.
+func (n *Node) SubmitTx(txn *blockchain.Transaction) error {
+
+	if err := n.checkPoolTx(txn); err != nil {
+		return err
+	}
+
+	if err := n.addToMempool(*txn); err != nil {
+		return err
+	}
+
+	sent := 0
+	for _, node := range n.KnownNodes() {
+		if node == n.Address {
+			continue
+		}
+
+		// Light clients only hear about what their filter matches, and
+		// don't pass it on
+		if bf := n.peerFilter(node); bf != nil {
+			if bf.MatchTx(txn) {
+				n.SendInv(node, TX, [][]byte{txn.ID})
+			}
+			continue
+		}
+
+		if n.SendTx(node, txn) == nil {
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		return ErrNoPeers
+	}
+
+	return nil
 }
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
+func (n *Node) SendInv(address, kind string, items [][]byte) {
+	inventory := Inv{n.Address, kind, items}
 	payload := GobEncode(inventory)
 	request := append(CmdToBytes(INV), payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
+func (n *Node) SendAddr(address string, addrs []NetAddr) {
+	payload := GobEncode(Addr{n.Address, addrs})
 	request := append(CmdToBytes(ADDR), payload...)
-	SendData(address, request)
+	n.SendData(address, request)
+}
+
+func (n *Node) SendGetAddr(address string) {
+	payload := GobEncode(GetAddr{n.Address})
+	request := append(CmdToBytes(GET_ADDR), payload...)
+	n.SendData(address, request)
 }
 
-func SendBlock(addr string, b *blockchain.Block) {
-	data := Block{nodeAddress, b.Serialize()}
+func (n *Node) SendBlock(addr string, b *blockchain.Block) {
+	data := Block{n.Address, b.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes(BLOCK), payload...)
-	SendData(addr, request)
+	n.SendData(addr, request)
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
+func (n *Node) SendGetData(address, kind string, id []byte) {
+	payload := GobEncode(GetData{n.Address, kind, id})
 	request := append(CmdToBytes(GET_DATA), payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
-func SendVersion(addr string, chain *blockchain.Blockchain) {
+func (n *Node) SendVersion(addr string) {
 
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
+	var bestHeight int
 
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	n.withChain(func(chain *blockchain.Blockchain) {
+		bestHeight = chain.GetBestHeight()
+	})
+
+	n.sendVersion(addr, bestHeight)
+}
+
+func (n *Node) sendVersion(addr string, bestHeight int) {
+	payload := GobEncode(Version{version, bestHeight, n.Address, true, false, n.Config.Genesis})
 	request := append(CmdToBytes(VERSION), payload...)
-	SendData(addr, request)
+	n.SendData(addr, request)
+}
+
+func (n *Node) SendPing(address string, nonce uint64) {
+	payload := GobEncode(Ping{n.Address, nonce})
+	request := append(CmdToBytes(PING), payload...)
+	n.SendData(address, request)
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
+func (n *Node) SendPong(address string, nonce uint64) {
+	payload := GobEncode(Pong{n.Address, nonce})
+	request := append(CmdToBytes(PONG), payload...)
+	n.SendData(address, request)
+}
+
+func (n *Node) SendGetBlocks(address string) {
+	payload := GobEncode(GetBlocks{n.Address})
 	request := append(CmdToBytes(GET_BLOCKS), payload...)
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
 // -------------------------------------------------------------
 
-func HandleTx(request []byte, chain *blockchain.Blockchain) {
+func (n *Node) HandleTx(request []byte) error {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -211,29 +319,232 @@ func HandleTx(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable tx payload")
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DecodeTransaction(txData)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable transaction")
+	}
+
+	if len(tx.ID) == 0 || len(tx.Inputs) == 0 {
+		return misbehaving(PENALTY_BAD_MESSAGE, "malformed transaction")
+	}
+
+	// The ID names the transaction in the pool and to orphans waiting on
+	// it, so a copy under someone else's ID is never let in
+	if !bytes.Equal(tx.ComputeID(), tx.ID) {
+		return misbehaving(PENALTY_BAD_MESSAGE, "transaction %x does not match its ID", tx.ID)
+	}
+
+	if err := tx.CheckDataOutputs(); err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "transaction %x: %s", tx.ID, err)
+	}
+
+	if err := tx.CheckDuplicateInputs(); err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "transaction %x: %s", tx.ID, err)
+	}
+
+	if _, ok := n.MempoolTx(tx.ID); ok || n.orphanTxs.Has(tx.ID) {
+		return nil
+	}
+
+	var confirmed bool
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		_, err := chain.FindTransaction(tx.ID)
+		confirmed = err == nil
+	})
+
+	// Already in a block, but it may still be the parent orphans wait for
+	if confirmed {
+		n.announceTxs(n.promoteOrphanTxs(tx.ID), payload.AddrFrom)
+		return nil
+	}
+
+	if missing := n.missingTxParents(&tx); len(missing) > 0 {
+		if n.orphanTxs.Add(tx, payload.AddrFrom, missing) {
+			fmt.Printf("Transaction %x is an orphan, requesting %d parents\n", tx.ID, len(missing))
+			for _, parent := range missing {
+				n.SendGetData(payload.AddrFrom, TX, parent)
+			}
+		}
+		return nil
+	}
+
+	if err := n.checkPoolTx(&tx); err != nil {
+		// The block spending the output may just not have reached the
+		// sender yet
+		if errors.Is(err, blockchain.ErrOutputSpent) {
+			fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+			return nil
+		}
+		return misbehaving(PENALTY_BAD_MESSAGE, "%s", err)
+	}
+
+	// Transactions that can't go into the next block aren't kept around,
+	// they have to be sent again once their locks have passed
+	if err := n.checkTxLocks(&tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return nil
+	}
+
+	// Two spends of one output race through the network; the one that
+	// arrives second is dropped, not held against its sender
+	if err := n.addToMempool(tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return nil
+	}
+
+	accepted := append([]blockchain.Transaction{tx}, n.promoteOrphanTxs(tx.ID)...)
+	n.announceTxs(accepted, payload.AddrFrom)
+
+	return nil
+}
+
+// announceTxs passes freshly accepted transactions on. Seeds relay them to
+// the rest of the network, miners mine once enough have piled up.
+func (n *Node) announceTxs(txs []blockchain.Transaction, from string) {
+
+	if len(txs) == 0 {
+		return
+	}
+
+	poolSize := n.MempoolSize()
+
+	fmt.Printf("%s, %d", n.Address, poolSize)
+
+	if n.IsSeed() {
+		var ids [][]byte
+		for _, tx := range txs {
+			ids = append(ids, tx.ID)
+		}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+		for _, node := range n.KnownNodes() {
+			if node == n.Address || node == from {
+				continue
+			}
 
-	if nodeAddress == NODE_ZERO {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, TX, [][]byte{tx.ID})
+			if bf := n.peerFilter(node); bf != nil {
+				if matching := filterTxIDs(txs, bf); len(matching) > 0 {
+					n.SendInv(node, TX, matching)
+				}
+				continue
 			}
+
+			n.SendInv(node, TX, ids)
 		}
 	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
+		if poolSize >= 2 && len(n.MinerAddress) > 0 {
+			n.MineTx()
 		}
 	}
 }
 
-func HandleInv(request []byte, chain *blockchain.Blockchain) {
+// filterTxIDs picks out the IDs of the transactions a light client's
+// filter matches.
+func filterTxIDs(txs []blockchain.Transaction, bf *BloomFilter) [][]byte {
+	var ids [][]byte
+
+	for i := range txs {
+		if bf.MatchTx(&txs[i]) {
+			ids = append(ids, txs[i].ID)
+		}
+	}
+
+	return ids
+}
+
+// missingTxParents lists the transactions tx spends from that are neither
+// in the chain nor in the memory pool.
+func (n *Node) missingTxParents(tx *blockchain.Transaction) [][]byte {
+	var inChain [][]byte
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		inChain = chain.MissingParents(tx)
+	})
+
+	var missing [][]byte
+	for _, parent := range inChain {
+		if _, ok := n.MempoolTx(parent); !ok {
+			missing = append(missing, parent)
+		}
+	}
+
+	return missing
+}
+
+// checkPoolTx checks tx's scripts and values against the outputs it spends,
+// in the chain or in the memory pool.
+func (n *Node) checkPoolTx(tx *blockchain.Transaction) error {
+	var err error
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		err = chain.CheckPoolTransaction(tx, n.MempoolTx)
+	})
+
+	return err
+}
+
+// checkTxLocks checks that tx's time locks let it into the next block.
+func (n *Node) checkTxLocks(tx *blockchain.Transaction) error {
+	var err error
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		err = chain.CheckTxLocks(tx)
+	})
+
+	return err
+}
+
+// promoteOrphanTxs moves the orphans that were waiting on parent into the
+// memory pool, then the orphans waiting on those, and returns all of them.
+// Orphans still missing another parent go back into the pool.
+func (n *Node) promoteOrphanTxs(parent []byte) []blockchain.Transaction {
+	var promoted []blockchain.Transaction
+
+	parents := [][]byte{parent}
+
+	for len(parents) > 0 {
+		next := parents[0]
+		parents = parents[1:]
+
+		for _, orphan := range n.orphanTxs.TakeChildren(next) {
+			if missing := n.missingTxParents(&orphan.tx); len(missing) > 0 {
+				n.orphanTxs.Add(orphan.tx, orphan.from, missing)
+				continue
+			}
+
+			if err := n.checkPoolTx(&orphan.tx); err != nil {
+				if errors.Is(err, blockchain.ErrOutputSpent) {
+					fmt.Printf("Rejected orphan transaction %x: %s\n", orphan.tx.ID, err)
+				} else {
+					n.punish(orphan.from, misbehaving(PENALTY_BAD_MESSAGE, "orphan transaction rejected: %s", err))
+				}
+				continue
+			}
+
+			if err := n.checkTxLocks(&orphan.tx); err != nil {
+				fmt.Printf("Rejected orphan transaction %x: %s\n", orphan.tx.ID, err)
+				continue
+			}
+
+			if err := n.addToMempool(orphan.tx); err != nil {
+				fmt.Printf("Rejected orphan transaction %x: %s\n", orphan.tx.ID, err)
+				continue
+			}
+
+			fmt.Printf("Promoted orphan transaction %x\n", orphan.tx.ID)
+			promoted = append(promoted, orphan.tx)
+			parents = append(parents, orphan.tx.ID)
+		}
+	}
+
+	return promoted
+}
+
+func (n *Node) HandleInv(request []byte) error {
 	var buff bytes.Buffer
 	var payload Inv
 
@@ -241,52 +552,124 @@ func HandleInv(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable inv payload")
+	}
+
+	if len(payload.Items) == 0 {
+		return misbehaving(PENALTY_BAD_MESSAGE, "empty inventory")
+	}
+
+	if len(payload.Items) > MAX_INV_PER_MSG {
+		return misbehaving(PENALTY_OVERSIZED, "%d items in one inventory", len(payload.Items))
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == BLOCK {
-		blocksInTransit = payload.Items
+		var missing [][]byte
+
+		// Inventories list the newest block first, ask for parents before
+		// their children so they connect as they arrive
+		n.withChain(func(chain *blockchain.Blockchain) {
+			for i := len(payload.Items) - 1; i >= 0; i-- {
+				hash := payload.Items[i]
+				if !chain.HasBlock(hash) && !n.orphanBlocks.Has(hash) {
+					missing = append(missing, hash)
+				}
+			}
+		})
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, BLOCK, blockHash)
+		if len(missing) == 0 {
+			return nil
+		}
+
+		n.setBlocksInTransit(missing)
+
+		blockHash := missing[0]
+		n.SendGetData(payload.AddrFrom, BLOCK, blockHash)
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if !bytes.Equal(b, blockHash) {
-				newInTransit = append(newInTransit, b)
+		n.removeBlockInTransit(blockHash)
+	}
+
+	if payload.Type == TX {
+		for _, txID := range payload.Items {
+			if _, ok := n.MempoolTx(txID); !ok && !n.orphanTxs.Has(txID) {
+				n.SendGetData(payload.AddrFrom, TX, txID)
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 
-	if payload.Type == TX {
-		txID := payload.Items[0]
+	return nil
+}
+
+func (n *Node) HandleAddr(request []byte) error {
+	var buff bytes.Buffer
+	var payload Addr
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable addr payload")
+	}
+
+	if len(payload.AddrList) > MAX_ADDR_PER_MSG {
+		return misbehaving(PENALTY_OVERSIZED, "%d addresses in one message", len(payload.AddrList))
+	}
+
+	var fresh []NetAddr
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, TX, txID)
+	for _, addr := range payload.AddrList {
+		if addr.Addr == n.Address {
+			continue
+		}
+		if n.addrBook.Add(addr.Addr, payload.AddrFrom, time.Unix(addr.Timestamp, 0)) {
+			fresh = append(fresh, addr)
 		}
 	}
+
+	fmt.Printf("received %d addresses, %d new, %d in address book\n", len(payload.AddrList), len(fresh), n.addrBook.Size())
+
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	n.saveAddrBook()
+
+	// Small unsolicited announcements are passed on, large batches are
+	// answers to our own getaddr and stay with us. Only addresses we had
+	// never seen are relayed, which keeps gossip from looping.
+	if len(payload.AddrList) <= ADDR_RELAY_MAX {
+		n.relayAddrs(fresh, payload.AddrFrom)
+	}
+
+	n.connectMorePeers()
+
+	return nil
 }
 
-func HandleAddr(request []byte) {
+func (n *Node) HandleGetAddr(request []byte) error {
 	var buff bytes.Buffer
-	var payload Addr
+	var payload GetAddr
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable getaddr payload")
+	}
+
+	addrs := []NetAddr{{n.Address, n.clock.Now().Unix()}}
+	for _, ka := range n.addrBook.Sample(GETADDR_REPLY_SIZE, payload.AddrFrom) {
+		addrs = append(addrs, NetAddr{ka.Addr, ka.LastSeen})
 	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	n.SendAddr(payload.AddrFrom, addrs)
+
+	return nil
 }
 
-func HandleBlock(request []byte, chain *blockchain.Blockchain) {
+func (n *Node) HandleBlock(request []byte) error {
 	var buff bytes.Buffer
 	var payload Block
 
@@ -294,36 +677,60 @@ func HandleBlock(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable block payload")
 	}
 
 	blockData := payload.Block
-	block, _ := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable block")
+	}
 
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
+	if valid, err := blockchain.NewProof(block).Verify(); err != nil || !valid {
+		return misbehaving(PENALTY_INVALID_BLOCK, "block %x has an invalid proof of work", block.Hash)
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	return n.acceptBlock(block, payload.AddrFrom)
+}
+
+// acceptBlock connects a block whose proof has been verified, whether it
+// arrived whole or was rebuilt from a compact block, and carries on with
+// any download in progress.
+func (n *Node) acceptBlock(block *blockchain.Block, from string) error {
+
+	err := n.connectBlock(block)
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, BLOCK, blockHash)
-		blocksInTransit = blocksInTransit[1:]
+	if errors.Is(err, blockchain.ErrOrphanBlock) {
+		n.orphanBlocks.Add(block, from)
+
+		missing := n.orphanBlocks.MissingAncestor(block.PrevHash)
+		fmt.Printf("Block %x is an orphan, requesting %x\n", block.Hash, missing)
+		n.SendGetData(from, BLOCK, missing)
+
+	} else if err != nil {
+		return misbehaving(PENALTY_INVALID_BLOCK, "block %x rejected: %s", block.Hash, err)
+	}
+
+	if blockHash, ok := n.nextBlockInTransit(); ok {
+		n.SendGetData(from, BLOCK, blockHash)
 
 	} else {
 
-		UTXOSet := blockchain.UTXOSet{
-			Blockchain: chain,
-		}
+		n.withChain(func(chain *blockchain.Blockchain) {
+			UTXOSet := blockchain.UTXOSet{
+				Blockchain: chain,
+			}
 
-		UTXOSet.Reindex()
+			UTXOSet.Reindex()
+		})
 	}
+
+	return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.Blockchain) {
+func (n *Node) HandleGetData(request []byte) error {
 	var buff bytes.Buffer
 	var payload GetData
 
@@ -331,32 +738,62 @@ func HandleGetData(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable getdata payload")
 	}
-	//
-	// ------------------------
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
-	// ------------------------
-	//
+
 	if payload.Type == BLOCK {
-		block, err := chain.GetBlock([]byte(payload.ID))
+		var block *blockchain.Block
+
+		n.withChain(func(chain *blockchain.Blockchain) {
+			block, err = chain.GetBlock([]byte(payload.ID))
+		})
 		if err != nil {
-			return
+			return nil
+		}
+
+		n.SendBlock(payload.AddrFrom, block)
+	}
+
+	if payload.Type == FILTERED_BLOCK {
+		// The filterload may still be in flight on another connection
+		bf := n.peerFilter(payload.AddrFrom)
+		if bf == nil {
+			fmt.Printf("Ignoring filtered block request from %s without a filter\n", payload.AddrFrom)
+			return nil
+		}
+
+		var block *blockchain.Block
+
+		n.withChain(func(chain *blockchain.Blockchain) {
+			block, err = chain.GetBlock([]byte(payload.ID))
+		})
+		if err != nil {
+			return nil
 		}
 
-		SendBlock(payload.AddrFrom, block)
+		n.SendMerkleBlock(payload.AddrFrom, block, bf)
 	}
 
 	if payload.Type == TX {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := n.MempoolTx(payload.ID)
+
+		// Orphans ask for parents that may already be confirmed here
+		if !ok {
+			n.withChain(func(chain *blockchain.Blockchain) {
+				tx, err = chain.FindTransaction(payload.ID)
+			})
+			if err != nil {
+				return nil
+			}
+		}
 
-		SendTx(payload.AddrFrom, &tx)
+		n.SendTx(payload.AddrFrom, &tx)
 	}
+
+	return nil
 }
 
-func HandleVersion(request []byte, chain *blockchain.Blockchain) {
+func (n *Node) HandleVersion(request []byte, src MsgSource) error {
 	var buff bytes.Buffer
 	var payload Version
 
@@ -364,29 +801,58 @@ func HandleVersion(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable version payload")
+	}
+
+	// A peer of another network has nothing we can use. It isn't
+	// misbehaving, and banning its host could shut out peers of ours
+	// running on the same machine, so it is just left out.
+	if payload.Genesis != n.Config.Genesis {
+		fmt.Printf("Ignoring %s, which is on network %q\n", payload.AddrFrom, payload.Genesis)
+		return nil
 	}
-	//
-	// ------------------------
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
-	// ------------------------
-	//
-	bestHeight := chain.GetBestHeight()
+
+	var bestHeight int
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		bestHeight = chain.GetBestHeight()
+	})
+
 	otherHeight := payload.BestHeight
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+	if bestHeight < otherHeight && !payload.Light {
+		n.SendGetBlocks(payload.AddrFrom)
 	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
+		n.sendVersion(payload.AddrFrom, bestHeight)
 	}
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	isNew := !n.NodeIsKnown(payload.AddrFrom)
+
+	n.AddKnownNodes(payload.AddrFrom)
+	n.setCompactPeer(payload.AddrFrom, payload.CompactBlocks)
+
+	// Whether a peer gets filtered relay is only up to the peer itself
+	if n.checkPeerSender(payload.AddrFrom, src) == nil {
+		n.setFullPeer(payload.AddrFrom, !payload.Light)
 	}
+
+	// Light clients get our announcements but are no use to other peers,
+	// so they stay out of the address book and out of gossip
+	if payload.Light {
+		return nil
+	}
+
+	n.addrBook.Add(payload.AddrFrom, payload.AddrFrom, n.clock.Now())
+	n.addrBook.MarkGood(payload.AddrFrom)
+
+	if isNew {
+		n.SendGetAddr(payload.AddrFrom)
+	}
+
+	return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
+func (n *Node) HandleGetBlocks(request []byte) error {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
@@ -394,75 +860,304 @@ func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable getblocks payload")
+	}
+
+	var blocks [][]byte
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		blocks = chain.GetBlockHashes()
+	})
+
+	n.SendInv(payload.AddrFrom, BLOCK, blocks)
+
+	return nil
+}
+
+func (n *Node) HandlePing(request []byte) error {
+	var buff bytes.Buffer
+	var payload Ping
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable ping payload")
 	}
-	//
-	// ------------------------
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
-	// ------------------------
-	//
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, BLOCK, blocks)
+
+	n.SendPong(payload.AddrFrom, payload.Nonce)
+
+	return nil
+}
+
+func (n *Node) HandlePong(request []byte) error {
+	var buff bytes.Buffer
+	var payload Pong
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehaving(PENALTY_BAD_MESSAGE, "undecodable pong payload")
+	}
+
+	// Late or unsolicited pongs are harmless, they just don't count
+	if !n.recordPong(payload.AddrFrom, payload.Nonce) {
+		fmt.Printf("Ignoring unexpected pong from %s\n", payload.AddrFrom)
+	}
+
+	return nil
+}
+
+// connectBlock adds block to the chain and then every orphan that was
+// waiting on it, their own orphans in turn, and so on.
+func (n *Node) connectBlock(block *blockchain.Block) error {
+	var err error
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		_, err = chain.AddBlockAt(block, n.clock.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added block %x\n", block.Hash)
+
+	connected := []*blockchain.Block{block}
+	parents := [][]byte{block.Hash}
+
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for _, orphan := range n.orphanBlocks.TakeChildren(parent) {
+			n.withChain(func(chain *blockchain.Blockchain) {
+				_, err = chain.AddBlockAt(orphan.block, n.clock.Now())
+			})
+
+			if err != nil {
+				n.punish(orphan.from, misbehaving(PENALTY_INVALID_BLOCK, "orphan %x rejected: %s", orphan.block.Hash, err))
+				continue
+			}
+
+			fmt.Printf("Connected orphan block %x\n", orphan.block.Hash)
+			connected = append(connected, orphan.block)
+			parents = append(parents, orphan.block.Hash)
+		}
+	}
+
+	// Confirmed transactions leave the memory pool and can unblock orphan
+	// transactions
+	var promoted []blockchain.Transaction
+	for _, b := range connected {
+		n.removeFromMempool(b.Transactions)
+
+		for _, tx := range b.Transactions {
+			promoted = append(promoted, n.promoteOrphanTxs(tx.ID)...)
+		}
+	}
+	n.announceTxs(promoted, "")
+
+	return nil
 }
 
 // -------------------------------------------------------------
 
-func MineTx(chain *blockchain.Blockchain) {
-	var txs []*blockchain.Transaction
-	//
-	// ------------------------
-	blockchain.OpenDB(chain)
-	defer chain.CloseDB()
-	// ------------------------
-	//
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+// MineTx mines the verified contents of the memory pool into new blocks
+// until the pool is drained or nothing left in it is valid. Transactions
+// that no longer verify, say because a block spent their outputs, are
+// dropped from the pool.
+func (n *Node) MineTx() {
+	for {
+		var txs, invalid []*blockchain.Transaction
+		var newBlock *blockchain.Block
+
+		n.withChain(func(chain *blockchain.Blockchain) {
+			for _, tx := range n.mempoolSnapshot() {
+				fmt.Printf("tx: %s\n", tx.ID)
+				tx := tx
+
+				// Spends from the memory pool wait for their parents' block
+				if len(chain.MissingParents(&tx)) > 0 {
+					continue
+				}
+
+				// As do transactions whose relative locks count from a
+				// block that isn't there yet
+				if chain.CheckTxLocks(&tx) != nil {
+					continue
+				}
+
+				if err := chain.CheckPoolTransaction(&tx, noPooledTx); err != nil {
+					fmt.Printf("Dropped transaction %x: %s\n", tx.ID, err)
+					invalid = append(invalid, &tx)
+					continue
+				}
+
+				txs = append(txs, &tx)
+			}
+
+			n.removeFromMempool(invalid)
+
+			if len(txs) == 0 {
+				return
+			}
+
+			newBlock = n.mineBlock(chain, txs)
+			n.removeFromMempool(txs)
+		})
+
+		if newBlock == nil {
+			fmt.Println("All Transactions are invalid")
+			return
+		}
+
+		fmt.Println("New Block mined")
+		n.announceBlock(newBlock)
+
+		if n.MempoolSize() == 0 {
+			return
 		}
 	}
+}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
+// noPooledTx finds nothing, for checking transactions whose parents are
+// all in the chain.
+func noPooledTx([]byte) (blockchain.Transaction, bool) {
+	return blockchain.Transaction{}, false
+}
+
+// Mine mines txs straight into a new block, bypassing the memory pool, and
+// announces it to every peer. It returns nil if txs can't be mined.
+func (n *Node) Mine(txs []*blockchain.Transaction) *blockchain.Block {
+	var newBlock *blockchain.Block
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		newBlock = n.mineBlock(chain, txs)
+	})
+
+	if newBlock == nil {
+		return nil
 	}
 
-	cbTx := blockchain.CoinbaseTX(mineAddress, "")
-	txs = append(txs, cbTx)
+	fmt.Println("New Block mined")
+	n.announceBlock(newBlock)
+
+	return newBlock
+}
+
+// mineBlock pays the coinbase to MinerAddress and mines txs on top of the
+// tip at the node's time, returning nil if that fails. Callers must hold
+// the chain.
+func (n *Node) mineBlock(chain *blockchain.Blockchain, txs []*blockchain.Transaction) *blockchain.Block {
+
+	// Random data keeps coinbases to the same address apart
+	data := make([]byte, 24)
+	n.coinbaseRand.Read(data)
+
+	cbTx := blockchain.CoinbaseTX(n.MinerAddress, fmt.Sprintf("%x", data))
+	txs = append(append([]*blockchain.Transaction{}, txs...), cbTx)
+
+	newBlock, err := chain.MineBlockAt(txs, n.clock.Now())
+	if err != nil {
+		fmt.Printf("Failed to mine a block: %s\n", err)
+		return nil
+	}
 
-	newBlock := chain.MineBlock(txs)
 	UTXOSet := blockchain.UTXOSet{
 		Blockchain: chain,
 	}
 	UTXOSet.Reindex()
 
-	fmt.Println("New Block mined")
-
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
-	}
+	return newBlock
+}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, BLOCK, [][]byte{newBlock.Hash})
+// announceBlock pushes a compact block to peers that understand them and
+// an inv to everyone else.
+func (n *Node) announceBlock(block *blockchain.Block) {
+	for _, node := range n.KnownNodes() {
+		if node == n.Address {
+			continue
 		}
-	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+		// Light clients fetch a filtered block off the inv instead
+		if n.isCompactPeer(node) && n.peerFilter(node) == nil {
+			n.SendCompactBlock(node, block)
+		} else {
+			n.SendInv(node, BLOCK, [][]byte{block.Hash})
+		}
 	}
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
+func (n *Node) HandleConnection(conn net.Conn) {
 
-	req, err := io.ReadAll(conn)
 	defer conn.Close()
 
+	peer := conn.RemoteAddr().String()
+	if n.banMan.IsBanned(peer) {
+		fmt.Printf("Rejected connection from banned peer %s\n", peer)
+		return
+	}
+
+	req, src, err := n.readRequest(conn)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to read from %s: %s\n", peer, err)
+		return
+	}
+
+	peer = peerKey(req, src)
+	if n.banMan.IsBanned(peer) {
+		fmt.Printf("Rejected message from banned peer %s\n", peer)
+		return
+	}
+
+	if err := n.handleRequest(req, src); err != nil {
+		n.punish(peer, err)
+	}
+}
+
+// peerKey is what the sender of req is scored and banned under: its
+// identity on the secure transport, which it can't shed by reconnecting,
+// or else the host it connects from. Local peers share the loopback host
+// and connect from ephemeral ports, so they go by the listening address
+// they put in AddrFrom, as long as that is on loopback too.
+func peerKey(req []byte, src MsgSource) string {
+	if src.Identity != "" {
+		return IdentityBanKey(src.Identity)
+	}
+
+	key := BanHost(src.RemoteAddr)
+	if host, _, err := net.SplitHostPort(key); err != nil || !isLoopback(host) {
+		return key
+	}
+
+	// Every payload carries AddrFrom, and gob matches fields by name
+	var payload struct{ AddrFrom string }
+	if len(req) > commandLength {
+		gob.NewDecoder(bytes.NewReader(req[commandLength:])).Decode(&payload)
+	}
+
+	from := BanHost(payload.AddrFrom)
+	if host, _, err := net.SplitHostPort(from); err == nil && isLoopback(host) {
+		return from
+	}
+
+	return key
+}
+
+// handleRequest dispatches a single message. A panic deeper down is logged
+// rather than taking the whole node down. It is not charged to the peer:
+// handlers check what peers send, so a panic is our bug, not theirs.
+func (n *Node) handleRequest(req []byte, src MsgSource) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("message handler failed: %v", r)
+		}
+	}()
+
+	if len(req) < commandLength {
+		return misbehaving(PENALTY_BAD_MESSAGE, "truncated message")
 	}
 
 	command := BytesToCmd(req[:commandLength])
@@ -470,37 +1165,116 @@ func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
 
 	switch command {
 	case ADDR:
-		HandleAddr(req)
+		return n.HandleAddr(req)
 	case BLOCK:
-		HandleBlock(req, chain)
+		return n.HandleBlock(req)
+	case BLOCK_TXN:
+		return n.HandleBlockTxn(req)
+	case CMPCT_BLOCK:
+		return n.HandleCompactBlock(req)
 	case INV:
-		HandleInv(req, chain)
+		return n.HandleInv(req)
+	case GET_ADDR:
+		return n.HandleGetAddr(req)
 	case GET_BLOCKS:
-		HandleGetBlocks(req, chain)
+		return n.HandleGetBlocks(req)
+	case GET_BLOCK_TXN:
+		return n.HandleGetBlockTxn(req)
+	case FILTER_ADD:
+		return n.HandleFilterAdd(req, src)
+	case FILTER_CLEAR:
+		return n.HandleFilterClear(req, src)
+	case FILTER_LOAD:
+		return n.HandleFilterLoad(req, src)
 	case GET_DATA:
-		HandleGetData(req, chain)
+		return n.HandleGetData(req)
+	case PING:
+		return n.HandlePing(req)
+	case PONG:
+		return n.HandlePong(req)
 	case TX:
-		HandleTx(req, chain)
+		return n.HandleTx(req)
 	case VERSION:
-		HandleVersion(req, chain)
+		return n.HandleVersion(req, src)
 	default:
-		fmt.Println("Unknown command")
+		return misbehaving(PENALTY_UNKNOWN_COMMAND, "unknown command %q", command)
+	}
+}
+
+func (n *Node) punish(peer string, err error) {
+
+	var m *Misbehavior
+	if !errors.As(err, &m) {
+		fmt.Printf("Error handling message from %s: %s\n", peer, err)
+		return
+	}
+
+	if n.banMan.Misbehaving(peer, m.Score, m.Reason) {
+		fmt.Printf("Banned %s\n", BanHost(peer))
+	}
+}
+
+// relayAddrs forwards addresses to a few random peers, never back to the
+// peer they came from.
+func (n *Node) relayAddrs(addrs []NetAddr, from string) {
+	for _, node := range n.randomPeers(ADDR_RELAY_FANOUT, from) {
+		n.SendAddr(node, addrs)
+	}
+}
+
+// connectMorePeers tops the active peer list back up to MaxPeers from
+// the address book.
+func (n *Node) connectMorePeers() {
+	known := n.KnownNodes()
+
+	need := n.Config.MaxPeers - len(known)
+	if need <= 0 {
+		return
+	}
+
+	for _, ka := range n.addrBook.Sample(need, append(known, n.Address)...) {
+		n.AddKnownNodes(ka.Addr)
+		n.SendVersion(ka.Addr)
 	}
 }
 
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
+// advertiseAddrs announces ourselves and a sample of the address book to a
+// few peers, and asks for more addresses while the book is still small.
+func (n *Node) advertiseAddrs() {
+	addrs := []NetAddr{{n.Address, n.clock.Now().Unix()}}
+	for _, ka := range n.addrBook.Sample(ADDR_RELAY_MAX-1, n.Address) {
+		addrs = append(addrs, NetAddr{ka.Addr, ka.LastSeen})
+	}
+
+	n.relayAddrs(addrs, "")
+
+	if n.addrBook.Size() < GETADDR_REPLY_SIZE {
+		for _, node := range n.randomPeers(1, "") {
+			n.SendGetAddr(node)
 		}
 	}
 
-	return false
+	n.connectMorePeers()
+	n.saveAddrBook()
+}
+
+func (n *Node) addrRelayLoop() {
+	ticker := n.clock.NewTicker(ADDR_RELAY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+			n.advertiseAddrs()
+		case <-n.quit:
+			return
+		}
+	}
 }
 
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
+func (n *Node) RequestBlocks() {
+	for _, node := range n.KnownNodes() {
+		n.SendGetBlocks(node)
 	}
 }
 
@@ -516,30 +1290,75 @@ func CloseDB(chain *blockchain.Blockchain) {
 
 // -----------------------------------------------------------------------
 
-func StartServer(chain *blockchain.Blockchain, port uint16, minerAddress string) {
+// Serve accepts peer connections on ln until it fails, handling each on
+// its own goroutine.
+func (n *Node) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go n.HandleConnection(conn)
+	}
+}
 
-	nodeAddress = fmt.Sprintf("localhost:%d", port+1)
-	mineAddress = minerAddress
+func (n *Node) Start() {
 
-	ln, err := net.Listen(protocol, nodeAddress)
+	ln, err := n.transport.Listen(n.Config.ListenAddr())
 	if err != nil {
 		log.Panic(err)
 	}
 
 	defer ln.Close()
-	go CloseDB(chain)
+	go CloseDB(n.Chain)
 
-	if nodeAddress != NODE_ZERO {
-		SendVersion(NODE_ZERO, chain)
+	if err := n.Run(ln); err != nil {
+		log.Panic(err)
 	}
+}
 
-	fmt.Println("Blockchain Net Server listening @:", nodeAddress)
+// Run introduces the node to its seeds, starts the background loops and
+// serves ln until Stop is called.
+func (n *Node) Run(ln net.Listener) error {
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
+	n.mu.Lock()
+	n.listener = ln
+	n.mu.Unlock()
+
+	for _, seed := range n.Config.SeedNodes {
+		if seed != n.Address {
+			n.SendVersion(seed)
+			n.SendGetAddr(seed)
 		}
-		go HandleConnection(conn, chain)
 	}
+
+	go n.addrRelayLoop()
+	go n.pingLoop()
+
+	fmt.Printf("Blockchain Net Server listening @: %s (advertised as %s)\n", n.Config.ListenAddr(), n.Address)
+	fmt.Printf("Node identity: %s (encrypted transport: %t)\n", n.Identity(), n.Config.Encrypt)
+
+	err := n.Serve(ln)
+
+	select {
+	case <-n.quit:
+		return nil
+	default:
+		return err
+	}
+}
+
+// Stop shuts the listener and the background loops down. Connections
+// already being handled run to completion.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		if n.listener != nil {
+			n.listener.Close()
+		}
+	})
 }
@@ -0,0 +1,368 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// Node owns everything a running peer needs: its own address, the
+// address mining rewards go to, the chain it serves, the peers it
+// knows about and its memory pool. Handlers run on concurrent
+// connection goroutines, so all mutable state sits behind mu and
+// every use of the Badger store goes through chainMu.
+type Node struct {
+	Config       Config
+	Address      string
+	MinerAddress string
+	Chain        *blockchain.Blockchain
+
+	wire
+
+	clock        Clock
+	rng          *lockedRand // nonces, salts and shuffles
+	coinbaseRand *lockedRand // coinbase data, kept apart so mining doesn't depend on timing
+	addrBook     *AddrBook
+	banMan       *BanManager
+	orphanBlocks *OrphanBlockPool
+	orphanTxs    *OrphanTxPool
+
+	mu              sync.Mutex
+	knownNodes      []string
+	blocksInTransit [][]byte
+	memoryPool      map[string]blockchain.Transaction
+	peerStates      map[string]*peerState
+	partialBlocks   map[string]*partialBlock
+	listener        net.Listener
+
+	chainMu  sync.Mutex
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewNode(chain *blockchain.Blockchain, cfg Config) (*Node, error) {
+
+	address, err := cfg.AdvertisedAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = DEFAULT_MAX_PEERS
+	}
+
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = DEFAULT_PING_INTERVAL
+	}
+
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = DEFAULT_PING_TIMEOUT
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = RealClock
+	}
+
+	if cfg.Genesis == "" {
+		cfg.Genesis = blockchain.GENESIS_DATA
+	}
+
+	w, err := newWire(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rng := newLockedRand(cfg.RandSeed)
+
+	addrBook := NewAddrBook(cfg.Clock, rng.Seed())
+	if err := addrBook.Load(cfg.PeersFile); err != nil {
+		return nil, err
+	}
+
+	banMan, err := NewBanManager(cfg.BanFile, cfg.BanThreshold, cfg.BanDuration, cfg.Clock)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		Config:        cfg,
+		Address:       address,
+		MinerAddress:  cfg.MinerAddress,
+		Chain:         chain,
+		clock:         cfg.Clock,
+		rng:           rng,
+		coinbaseRand:  newLockedRand(rng.Seed()),
+		wire:          w,
+		addrBook:      addrBook,
+		banMan:        banMan,
+		orphanBlocks:  NewOrphanBlockPool(MAX_ORPHAN_BLOCKS, cfg.Clock),
+		orphanTxs:     NewOrphanTxPool(MAX_ORPHAN_TXS, ORPHAN_TX_EXPIRY, cfg.Clock),
+		memoryPool:    make(map[string]blockchain.Transaction),
+		peerStates:    make(map[string]*peerState),
+		partialBlocks: make(map[string]*partialBlock),
+		quit:          make(chan struct{}),
+	}
+
+	peers := append([]string{}, cfg.SeedNodes...)
+	for _, ka := range addrBook.Sample(cfg.MaxPeers, address) {
+		peers = append(peers, ka.Addr)
+	}
+
+	for _, addr := range peers {
+		if addr != address && !n.nodeIsKnown(addr) {
+			n.knownNodes = append(n.knownNodes, addr)
+		}
+	}
+
+	return n, nil
+}
+
+func (n *Node) AddrBook() *AddrBook {
+	return n.addrBook
+}
+
+func (n *Node) BanManager() *BanManager {
+	return n.banMan
+}
+
+func (n *Node) saveAddrBook() {
+	if err := n.addrBook.Save(n.Config.PeersFile); err != nil {
+		fmt.Printf("failed to save peers: %s\n", err)
+	}
+}
+
+// IsSeed reports whether this node is one of the configured seeds. Seeds
+// relay transactions to the rest of the network instead of mining them.
+func (n *Node) IsSeed() bool {
+	if len(n.Config.SeedNodes) == 0 {
+		return true
+	}
+
+	for _, seed := range n.Config.SeedNodes {
+		if seed == n.Address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// -------------------------------------------------------------
+
+// withChain opens the node's database for the duration of fn. Calls
+// are serialized so that only one goroutine holds the Badger directory
+// lock at a time.
+func (n *Node) withChain(fn func(chain *blockchain.Blockchain)) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	blockchain.OpenDB(n.Chain)
+	defer n.Chain.CloseDB()
+
+	fn(n.Chain)
+}
+
+// Tip returns the hash and height of the node's best block.
+func (n *Node) Tip() ([]byte, int) {
+	var hash []byte
+	var height int
+
+	n.withChain(func(chain *blockchain.Blockchain) {
+		hash = append([]byte(nil), chain.LastHash...)
+		height = chain.GetBestHeight()
+	})
+
+	return hash, height
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) KnownNodes() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]string(nil), n.knownNodes...)
+}
+
+func (n *Node) NodeIsKnown(addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.nodeIsKnown(addr)
+}
+
+func (n *Node) nodeIsKnown(addr string) bool {
+	for _, node := range n.knownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Node) AddKnownNodes(addrs ...string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, addr := range addrs {
+		if addr != n.Address && !n.nodeIsKnown(addr) {
+			n.knownNodes = append(n.knownNodes, addr)
+		}
+	}
+
+	return len(n.knownNodes)
+}
+
+// randomPeers picks up to max known peers at random, leaving out except.
+func (n *Node) randomPeers(max int, except string) []string {
+	var peers []string
+
+	for _, node := range n.KnownNodes() {
+		if node != except && node != n.Address {
+			peers = append(peers, node)
+		}
+	}
+
+	n.rng.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	if len(peers) > max {
+		peers = peers[:max]
+	}
+
+	return peers
+}
+
+func (n *Node) RemoveKnownNode(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var updatedNodes []string
+
+	for _, node := range n.knownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+
+	n.knownNodes = updatedNodes
+	delete(n.peerStates, addr)
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) setBlocksInTransit(items [][]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.blocksInTransit = append([][]byte(nil), items...)
+}
+
+// removeBlockInTransit drops hash from the download queue.
+func (n *Node) removeBlockInTransit(hash []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	newInTransit := [][]byte{}
+	for _, b := range n.blocksInTransit {
+		if !bytes.Equal(b, hash) {
+			newInTransit = append(newInTransit, b)
+		}
+	}
+	n.blocksInTransit = newInTransit
+}
+
+// nextBlockInTransit pops the next hash waiting to be downloaded.
+func (n *Node) nextBlockInTransit() ([]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.blocksInTransit) == 0 {
+		return nil, false
+	}
+
+	blockHash := n.blocksInTransit[0]
+	n.blocksInTransit = n.blocksInTransit[1:]
+
+	return blockHash, true
+}
+
+// -------------------------------------------------------------
+
+func (n *Node) MempoolSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.memoryPool)
+}
+
+func (n *Node) MempoolTx(id []byte) (blockchain.Transaction, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	tx, ok := n.memoryPool[hex.EncodeToString(id)]
+	return tx, ok
+}
+
+// ErrMempoolConflict is returned by addToMempool for a transaction that
+// spends an output a transaction already in the pool spends.
+var ErrMempoolConflict = errors.New("conflicts with a transaction in the memory pool")
+
+// addToMempool adds tx unless it spends an output twice, itself or together
+// with a transaction already in the pool. The first spend seen wins, and
+// a transaction already pooled keeps the copy it was first seen as.
+func (n *Node) addToMempool(tx blockchain.Transaction) error {
+	if err := tx.CheckDuplicateInputs(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.memoryPool[hex.EncodeToString(tx.ID)]; ok {
+		return nil
+	}
+
+	for _, pooled := range n.memoryPool {
+
+		for _, a := range pooled.Inputs {
+			for _, b := range tx.Inputs {
+				if a.OutpointKey() == b.OutpointKey() {
+					return fmt.Errorf("%w: %x also spends %s", ErrMempoolConflict, pooled.ID, a.OutpointKey())
+				}
+			}
+		}
+	}
+
+	n.memoryPool[hex.EncodeToString(tx.ID)] = tx
+
+	return nil
+}
+
+func (n *Node) removeFromMempool(txs []*blockchain.Transaction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, tx := range txs {
+		delete(n.memoryPool, hex.EncodeToString(tx.ID))
+	}
+}
+
+func (n *Node) mempoolSnapshot() []blockchain.Transaction {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	txs := make([]blockchain.Transaction, 0, len(n.memoryPool))
+	for _, tx := range n.memoryPool {
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
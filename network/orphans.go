@@ -0,0 +1,295 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+const MAX_ORPHAN_BLOCKS = 100
+
+type orphanBlock struct {
+	block *blockchain.Block
+	from  string
+	added time.Time
+}
+
+// OrphanBlockPool holds blocks that arrived before their parent, indexed
+// both by their own hash and by the parent they are waiting for. It is
+// bounded: once full, the oldest orphan makes room for the newest.
+type OrphanBlockPool struct {
+	mu     sync.Mutex
+	clock  Clock
+	max    int
+	byHash map[string]*orphanBlock
+	byPrev map[string][]string
+}
+
+func NewOrphanBlockPool(max int, clock Clock) *OrphanBlockPool {
+	return &OrphanBlockPool{
+		clock:  clock,
+		max:    max,
+		byHash: make(map[string]*orphanBlock),
+		byPrev: make(map[string][]string),
+	}
+}
+
+// Add stores block until its parent shows up. It returns false if the
+// block was already waiting.
+func (pool *OrphanBlockPool) Add(block *blockchain.Block, from string) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if _, ok := pool.byHash[hash]; ok {
+		return false
+	}
+
+	if len(pool.byHash) >= pool.max {
+		pool.evictOldest()
+	}
+
+	prev := hex.EncodeToString(block.PrevHash)
+	pool.byHash[hash] = &orphanBlock{block, from, pool.clock.Now()}
+	pool.byPrev[prev] = append(pool.byPrev[prev], hash)
+
+	return true
+}
+
+func (pool *OrphanBlockPool) Has(hash []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.byHash[hex.EncodeToString(hash)]
+	return ok
+}
+
+func (pool *OrphanBlockPool) Size() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return len(pool.byHash)
+}
+
+// MissingAncestor follows a chain of orphans back from hash and returns
+// the first ancestor that is not in the pool, which is the block to ask
+// for next.
+func (pool *OrphanBlockPool) MissingAncestor(hash []byte) []byte {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for {
+		orphan, ok := pool.byHash[hex.EncodeToString(hash)]
+		if !ok {
+			return hash
+		}
+		hash = orphan.block.PrevHash
+	}
+}
+
+// TakeChildren removes and returns every orphan waiting on parent.
+func (pool *OrphanBlockPool) TakeChildren(parent []byte) []*orphanBlock {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	prev := hex.EncodeToString(parent)
+
+	var children []*orphanBlock
+	for _, hash := range pool.byPrev[prev] {
+		if orphan, ok := pool.byHash[hash]; ok {
+			children = append(children, orphan)
+			delete(pool.byHash, hash)
+		}
+	}
+	delete(pool.byPrev, prev)
+
+	return children
+}
+
+// evictOldest drops the orphan that has waited longest. Callers must hold mu.
+func (pool *OrphanBlockPool) evictOldest() {
+	var oldest string
+
+	for hash, orphan := range pool.byHash {
+		if oldest == "" || orphan.added.Before(pool.byHash[oldest].added) {
+			oldest = hash
+		}
+	}
+
+	if oldest == "" {
+		return
+	}
+
+	prev := hex.EncodeToString(pool.byHash[oldest].block.PrevHash)
+	delete(pool.byHash, oldest)
+
+	siblings := pool.byPrev[prev][:0]
+	for _, hash := range pool.byPrev[prev] {
+		if hash != oldest {
+			siblings = append(siblings, hash)
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(pool.byPrev, prev)
+	} else {
+		pool.byPrev[prev] = siblings
+	}
+}
+
+// -------------------------------------------------------------
+
+const (
+	MAX_ORPHAN_TXS   = 100
+	ORPHAN_TX_EXPIRY = 20 * time.Minute
+)
+
+type orphanTx struct {
+	tx      blockchain.Transaction
+	from    string
+	expires time.Time
+}
+
+// OrphanTxPool holds transactions that spend outputs of transactions we
+// have not seen yet. Entries expire after ORPHAN_TX_EXPIRY, and when the
+// pool is full the entry closest to expiry is dropped.
+type OrphanTxPool struct {
+	mu       sync.Mutex
+	clock    Clock
+	max      int
+	expiry   time.Duration
+	byID     map[string]*orphanTx
+	byParent map[string][]string
+}
+
+func NewOrphanTxPool(max int, expiry time.Duration, clock Clock) *OrphanTxPool {
+	return &OrphanTxPool{
+		clock:    clock,
+		max:      max,
+		expiry:   expiry,
+		byID:     make(map[string]*orphanTx),
+		byParent: make(map[string][]string),
+	}
+}
+
+// Add stores tx until the parents it is missing arrive. It returns false
+// if tx was already waiting.
+func (pool *OrphanTxPool) Add(tx blockchain.Transaction, from string, missing [][]byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.expire(pool.clock.Now())
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := pool.byID[id]; ok {
+		return false
+	}
+
+	if len(pool.byID) >= pool.max {
+		pool.evictFirstToExpire()
+	}
+
+	pool.byID[id] = &orphanTx{tx, from, pool.clock.Now().Add(pool.expiry)}
+
+	for _, parent := range missing {
+		key := hex.EncodeToString(parent)
+		pool.byParent[key] = append(pool.byParent[key], id)
+	}
+
+	return true
+}
+
+func (pool *OrphanTxPool) Has(id []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	_, ok := pool.byID[hex.EncodeToString(id)]
+	return ok
+}
+
+func (pool *OrphanTxPool) Size() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.expire(pool.clock.Now())
+
+	return len(pool.byID)
+}
+
+// TakeChildren removes and returns every orphan that spends from parent.
+// They may still be missing other parents, callers re-check and add them
+// back if so.
+func (pool *OrphanTxPool) TakeChildren(parent []byte) []*orphanTx {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.expire(pool.clock.Now())
+
+	key := hex.EncodeToString(parent)
+
+	// remove rewrites byParent, so walk a copy
+	ids := append([]string(nil), pool.byParent[key]...)
+
+	var children []*orphanTx
+	for _, id := range ids {
+		if orphan, ok := pool.byID[id]; ok {
+			children = append(children, orphan)
+			pool.remove(id)
+		}
+	}
+	delete(pool.byParent, key)
+
+	return children
+}
+
+// expire drops orphans past their expiry. Callers must hold mu.
+func (pool *OrphanTxPool) expire(now time.Time) {
+	for id, orphan := range pool.byID {
+		if now.After(orphan.expires) {
+			pool.remove(id)
+		}
+	}
+}
+
+// evictFirstToExpire makes room for a new orphan. Callers must hold mu.
+func (pool *OrphanTxPool) evictFirstToExpire() {
+	var first string
+
+	for id, orphan := range pool.byID {
+		if first == "" || orphan.expires.Before(pool.byID[first].expires) {
+			first = id
+		}
+	}
+
+	if first != "" {
+		pool.remove(first)
+	}
+}
+
+// remove deletes an orphan from both indexes. Callers must hold mu.
+func (pool *OrphanTxPool) remove(id string) {
+	orphan, ok := pool.byID[id]
+	if !ok {
+		return
+	}
+	delete(pool.byID, id)
+
+	for _, in := range orphan.tx.Inputs {
+		key := hex.EncodeToString(in.ID)
+
+		waiting := pool.byParent[key][:0]
+		for _, other := range pool.byParent[key] {
+			if other != id {
+				waiting = append(waiting, other)
+			}
+		}
+
+		if len(waiting) == 0 {
+			delete(pool.byParent, key)
+		} else {
+			pool.byParent[key] = waiting
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_PING_INTERVAL = time.Minute
+	DEFAULT_PING_TIMEOUT  = 20 * time.Second
+
+	PING_CHECKS_PER_TIMEOUT = 4
+)
+
+// peerState is what a node knows about the liveness of one of its peers.
+type peerState struct {
+	pingNonce   uint64
+	pingSent    time.Time
+	lastPong    time.Time
+	latency     time.Duration
+	compact     bool         // announced support for compact blocks
+	full        bool         // announced itself a full node, which gets everything relayed
+	identity    string       // transport identity we found listening on the address when we dialed it
+	filter      *BloomFilter // set by light clients, limits what we relay to them
+	filterOwner string       // transport identity that set filter, if it came over the secure transport
+}
+
+// PeerInfo is the public view of a peer, as served by the peer listing.
+type PeerInfo struct {
+	Addr      string
+	Latency   time.Duration
+	LastPong  time.Time
+	PingSince time.Time // zero unless a ping is waiting for its pong
+}
+
+func (p PeerInfo) MarshalJSON() ([]byte, error) {
+	var lastPong, pingSince *time.Time
+
+	if !p.LastPong.IsZero() {
+		lastPong = &p.LastPong
+	}
+
+	if !p.PingSince.IsZero() {
+		pingSince = &p.PingSince
+	}
+
+	return json.Marshal(struct {
+		Addr      string     `json:"addr"`
+		LatencyMS float64    `json:"latency_ms"`
+		LastPong  *time.Time `json:"last_pong"`
+		PingSince *time.Time `json:"ping_outstanding_since"`
+	}{
+		Addr:      p.Addr,
+		LatencyMS: float64(p.Latency) / float64(time.Millisecond),
+		LastPong:  lastPong,
+		PingSince: pingSince,
+	})
+}
+
+// Peers lists the known peers along with their measured round trip times.
+func (n *Node) Peers() []PeerInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(n.knownNodes))
+
+	for _, addr := range n.knownNodes {
+		info := PeerInfo{Addr: addr}
+
+		if st, ok := n.peerStates[addr]; ok {
+			info.Latency = st.latency
+			info.LastPong = st.lastPong
+			if st.pingNonce != 0 {
+				info.PingSince = st.pingSent
+			}
+		}
+
+		peers = append(peers, info)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	return peers
+}
+
+// -------------------------------------------------------------
+
+// pingPeers sends a ping to every peer that has none outstanding.
+func (n *Node) pingPeers() {
+	now := n.clock.Now()
+
+	pings := make(map[string]uint64)
+
+	n.mu.Lock()
+	for _, addr := range n.knownNodes {
+		st, ok := n.peerStates[addr]
+		if !ok {
+			st = &peerState{}
+			n.peerStates[addr] = st
+		}
+
+		if st.pingNonce != 0 {
+			continue
+		}
+
+		// Zero marks "no ping outstanding", so never use it as a nonce
+		for st.pingNonce == 0 {
+			st.pingNonce = n.rng.Uint64()
+		}
+		st.pingSent = now
+		pings[addr] = st.pingNonce
+	}
+	n.mu.Unlock()
+
+	for addr, nonce := range pings {
+		n.SendPing(addr, nonce)
+	}
+}
+
+// expirePings drops every peer that let its last ping time out.
+func (n *Node) expirePings() {
+	now := n.clock.Now()
+
+	var expired []string
+
+	n.mu.Lock()
+	for _, addr := range n.knownNodes {
+		st, ok := n.peerStates[addr]
+		if ok && st.pingNonce != 0 && now.Sub(st.pingSent) > n.Config.PingTimeout {
+			expired = append(expired, addr)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, addr := range expired {
+		fmt.Printf("%s did not answer ping, disconnecting\n", addr)
+		n.RemoveKnownNode(addr)
+		n.addrBook.MarkFailed(addr)
+	}
+}
+
+// recordPong matches a pong to our outstanding ping and updates the
+// latency estimate. It reports whether the pong was expected.
+func (n *Node) recordPong(addr string, nonce uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st, ok := n.peerStates[addr]
+	if !ok || st.pingNonce == 0 || st.pingNonce != nonce {
+		return false
+	}
+
+	now := n.clock.Now()
+	st.latency = now.Sub(st.pingSent)
+	st.lastPong = now
+	st.pingNonce = 0
+
+	return true
+}
+
+// pingLoop pings peers every PingInterval and looks for unanswered pings
+// several times per PingTimeout, so a silent peer is dropped soon after
+// its timeout rather than at the next ping.
+func (n *Node) pingLoop() {
+	ticker := n.clock.NewTicker(n.Config.PingInterval)
+	defer ticker.Stop()
+
+	check := n.Config.PingTimeout / PING_CHECKS_PER_TIMEOUT
+	if check <= 0 {
+		check = n.Config.PingTimeout
+	}
+
+	expiry := n.clock.NewTicker(check)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+			n.pingPeers()
+		case <-expiry.Chan():
+			n.expirePings()
+		case <-n.quit:
+			return
+		}
+	}
+}
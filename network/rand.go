@@ -0,0 +1,83 @@
+package network
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// lockedRand is the node's source of nonces, salts and shuffles. Ping
+// nonces and compact block salts must not be guessable, or a peer could
+// answer pings it never saw or build transactions whose short IDs collide,
+// so they come from crypto/rand. Only a simulated network seeds the source
+// itself: everything then comes from math/rand and each run is the same.
+// Handlers share it, hence the lock.
+type lockedRand struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	seeded bool
+}
+
+// newLockedRand seeds a source with seed for a simulated network, or
+// returns one backed by crypto/rand when it is zero.
+func newLockedRand(seed int64) *lockedRand {
+	if seed != 0 {
+		return &lockedRand{rng: rand.New(rand.NewSource(seed)), seeded: true}
+	}
+
+	var b [8]byte
+	cryptoRead(b[:])
+
+	return &lockedRand{rng: rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(b[:]))))}
+}
+
+func cryptoRead(p []byte) {
+	if _, err := crand.Read(p); err != nil {
+		panic(err)
+	}
+}
+
+// Seed draws the seed for another source, zero unless this one is seeded,
+// so a source split off a crypto/rand one is backed by crypto/rand too.
+func (r *lockedRand) Seed() int64 {
+	if !r.seeded {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rng.Int63() | 1
+}
+
+func (r *lockedRand) Uint64() uint64 {
+	var b [8]byte
+	r.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (r *lockedRand) Uint32() uint32 {
+	var b [4]byte
+	r.Read(b[:])
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+func (r *lockedRand) Read(p []byte) {
+	if !r.seeded {
+		cryptoRead(p)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rng.Read(p)
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rng.Shuffle(n, swap)
+}
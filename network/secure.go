@@ -0,0 +1,318 @@
+package network
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The secure transport is a small Noise-style handshake:
+//
+//	initiator -> responder   SECURE_MAGIC, ephemeral X25519 key
+//	responder -> initiator   ephemeral X25519 key
+//	responder -> initiator   enc(identity key, signature over transcript)
+//	initiator -> responder   enc(identity key, signature over transcript)
+//
+// Both directions are then keyed from the ephemeral Diffie-Hellman secret
+// and every frame is sealed with ChaCha20-Poly1305. Signing the transcript
+// with the long-term ed25519 identity authenticates each side, which is
+// what the allowlist checks against.
+//
+// After the handshake each frame starts with its type, frameData or
+// frameEnd. The sender closes with an end frame, so a message cut short
+// by whoever can close the TCP connection is told apart from a whole one.
+const (
+	SECURE_MAGIC      = 0x00
+	secureProtocol    = "blockchain-Tensor/secure/2/X25519/ChaCha20Poly1305/SHA256"
+	handshakeTimeout  = 10 * time.Second
+	maxFramePlaintext = 64 * 1024
+	frameHeaderLength = 4
+
+	frameData = 0x00
+	frameEnd  = 0x01
+)
+
+var (
+	ErrPeerNotAllowed = errors.New("peer identity is not on the allowlist")
+	ErrBadHandshake   = errors.New("secure handshake failed")
+)
+
+// SecureConn is a net.Conn whose reads and writes go through the encrypted
+// framing. Close sends the end frame and reads return io.EOF once it
+// arrives, so the rest of the package can keep using io.ReadAll and
+// io.Copy. A connection that closes before the end frame fails reads with
+// io.ErrUnexpectedEOF.
+type SecureConn struct {
+	net.Conn
+
+	remoteID  ed25519.PublicKey
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	sendNonce uint64
+	recvNonce uint64
+	readBuf   []byte
+	ended     bool // the peer's end frame has arrived
+	closed    bool
+}
+
+func (c *SecureConn) RemoteIdentity() ed25519.PublicKey {
+	return c.remoteID
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFramePlaintext-1 {
+			chunk = chunk[:maxFramePlaintext-1]
+		}
+
+		if err := c.writeFrame(append([]byte{frameData}, chunk...)); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		if c.ended {
+			return 0, io.EOF
+		}
+
+		frame, err := c.readFrame()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case len(frame) == 1 && frame[0] == frameEnd:
+			c.ended = true
+		case len(frame) > 0 && frame[0] == frameData:
+			c.readBuf = frame[1:]
+		default:
+			return 0, fmt.Errorf("invalid frame type")
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+// Close ends the message with an end frame and closes the connection.
+func (c *SecureConn) Close() error {
+	if !c.closed {
+		c.closed = true
+		c.writeFrame([]byte{frameEnd})
+	}
+
+	return c.Conn.Close()
+}
+
+func frameNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce, counter)
+	return nonce
+}
+
+func (c *SecureConn) writeFrame(plaintext []byte) error {
+	sealed := c.sendAEAD.Seal(nil, frameNonce(c.sendNonce), plaintext, nil)
+	c.sendNonce++
+
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	frame = append(frame, sealed...)
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *SecureConn) readFrame() ([]byte, error) {
+	var header [frameHeaderLength]byte
+
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size < uint32(c.recvAEAD.Overhead()) || size > maxFramePlaintext+uint32(c.recvAEAD.Overhead()) {
+		return nil, fmt.Errorf("invalid frame size %d", size)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	plaintext, err := c.recvAEAD.Open(nil, frameNonce(c.recvNonce), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.recvNonce++
+
+	return plaintext, nil
+}
+
+// -------------------------------------------------------------
+
+// ClientHandshake secures an outgoing connection.
+func ClientHandshake(conn net.Conn, identity ed25519.PrivateKey, allowed map[string]bool) (*SecureConn, error) {
+	return secureHandshake(conn, identity, allowed, true)
+}
+
+// ServerHandshake secures an incoming connection whose SECURE_MAGIC byte
+// has already been read.
+func ServerHandshake(conn net.Conn, identity ed25519.PrivateKey, allowed map[string]bool) (*SecureConn, error) {
+	return secureHandshake(conn, identity, allowed, false)
+}
+
+func secureHandshake(conn net.Conn, identity ed25519.PrivateKey, allowed map[string]bool, initiator bool) (*SecureConn, error) {
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	curve := ecdh.X25519()
+
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	local := ephemeral.PublicKey().Bytes()
+	remote := make([]byte, len(local))
+
+	if initiator {
+		if _, err := conn.Write(append([]byte{SECURE_MAGIC}, local...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, remote); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := io.ReadFull(conn, remote); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteKey, err := curve.NewPublicKey(remote)
+	if err != nil {
+		return nil, ErrBadHandshake
+	}
+
+	shared, err := ephemeral.ECDH(remoteKey)
+	if err != nil {
+		return nil, ErrBadHandshake
+	}
+
+	// -------------------------------------------------------------
+	initKey, respKey := local, remote
+	if !initiator {
+		initKey, respKey = remote, local
+	}
+
+	transcript := sha256.New()
+	transcript.Write([]byte(secureProtocol))
+	transcript.Write(initKey)
+	transcript.Write(respKey)
+	h := transcript.Sum(nil)
+
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, h, []byte(secureProtocol)), keys); err != nil {
+		return nil, err
+	}
+
+	initToResp, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	respToInit, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecureConn{Conn: conn}
+
+	if initiator {
+		sc.sendAEAD, sc.recvAEAD = initToResp, respToInit
+	} else {
+		sc.sendAEAD, sc.recvAEAD = respToInit, initToResp
+	}
+
+	// -------------------------------------------------------------
+	// The role is signed along with the transcript so that a signature
+	// can't be reflected back at the node that made it
+	sendIdentity := func(role string) error {
+		sig := ed25519.Sign(identity, append([]byte(role), h...))
+		return sc.writeFrame(append(identity.Public().(ed25519.PublicKey), sig...))
+	}
+
+	recvIdentity := func(role string) error {
+		frame, err := sc.readFrame()
+		if err != nil {
+			return err
+		}
+
+		if len(frame) != ed25519.PublicKeySize+ed25519.SignatureSize {
+			return ErrBadHandshake
+		}
+
+		pub := ed25519.PublicKey(frame[:ed25519.PublicKeySize])
+		if !ed25519.Verify(pub, append([]byte(role), h...), frame[ed25519.PublicKeySize:]) {
+			return ErrBadHandshake
+		}
+
+		if len(allowed) > 0 && !allowed[IdentityID(pub)] {
+			return ErrPeerNotAllowed
+		}
+
+		sc.remoteID = pub
+
+		return nil
+	}
+
+	if initiator {
+		if err := recvIdentity("responder"); err != nil {
+			return nil, err
+		}
+		if err := sendIdentity("initiator"); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := sendIdentity("responder"); err != nil {
+			return nil, err
+		}
+		if err := recvIdentity("initiator"); err != nil {
+			return nil, err
+		}
+	}
+
+	return sc, nil
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func newTestWire(t *testing.T) *wire {
+	t.Helper()
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &wire{identity: identity, allowed: map[string]bool{}, encrypt: true}
+}
+
+// sendSecure sends msg over the secure transport and returns what the
+// receiving end read. With truncate the sender drops the connection
+// without the end frame.
+func sendSecure(t *testing.T, msg []byte, truncate bool) ([]byte, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	sender, receiver := newTestWire(t), newTestWire(t)
+
+	go func() {
+		sc, err := ClientHandshake(client, sender.identity, nil)
+		if err != nil {
+			client.Close()
+			return
+		}
+
+		sc.Write(msg)
+
+		if truncate {
+			sc.Conn.Close()
+		} else {
+			sc.Close()
+		}
+	}()
+
+	req, _, err := receiver.readRequest(server)
+	server.Close()
+
+	return req, err
+}
+
+func TestSecureMessageEnd(t *testing.T) {
+	msg := bytes.Repeat([]byte("message "), maxFramePlaintext/4)
+
+	req, err := sendSecure(t, msg, false)
+	if err != nil {
+		t.Fatalf("readRequest: %s", err)
+	}
+
+	if !bytes.Equal(req, msg) {
+		t.Fatalf("read %d bytes, want %d", len(req), len(msg))
+	}
+
+	// Cut off at a frame boundary, the message must not pass for whole
+	if _, err := sendSecure(t, msg, true); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated message: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	if _, err := readMessage(bytes.NewReader(make([]byte, 11)), 10); err == nil {
+		t.Fatal("oversized message read")
+	}
+
+	if data, err := readMessage(bytes.NewReader(make([]byte, 10)), 10); err != nil || len(data) != 10 {
+		t.Fatalf("read %d bytes, %v", len(data), err)
+	}
+}
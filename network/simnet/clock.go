@@ -0,0 +1,153 @@
+package simnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/network"
+)
+
+// Clock is a network.Clock that only moves when Advance is called. Tickers
+// and timers fire in timestamp order as time passes over them, so a run
+// driven by the same calls sees the same times.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	at      time.Time
+	period  time.Duration
+	fn      func()
+	ch      chan time.Time
+	stopped bool
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Clock) NewTicker(d time.Duration) network.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &timer{
+		at:     c.now.Add(d),
+		period: d,
+		ch:     make(chan time.Time, 1),
+	}
+	c.timers = append(c.timers, t)
+
+	return &ticker{c, t}
+}
+
+// AfterFunc runs fn once the clock has been advanced by d.
+func (c *Clock) AfterFunc(d time.Duration, fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timers = append(c.timers, &timer{at: c.now.Add(d), fn: fn})
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due
+// on the way in the order they are due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+
+		next := c.nextDue(end)
+		if next == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+
+		c.now = next.at
+
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			next.stopped = true
+			c.removeStopped()
+		}
+
+		now := c.now
+		c.mu.Unlock()
+
+		if next.fn != nil {
+			next.fn()
+		} else {
+			// Like time.Ticker, drop ticks nobody is around to read
+			select {
+			case next.ch <- now:
+			default:
+			}
+		}
+	}
+}
+
+// nextDue returns the earliest live timer at or before end. Callers must
+// hold mu.
+func (c *Clock) nextDue(end time.Time) *timer {
+	var due []*timer
+
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(end) {
+			due = append(due, t)
+		}
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+
+	return due[0]
+}
+
+// removeStopped forgets timers that will never fire again. Callers must
+// hold mu.
+func (c *Clock) removeStopped() {
+	live := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.stopped {
+			live = append(live, t)
+		}
+	}
+	c.timers = live
+}
+
+// -------------------------------------------------------------
+
+type ticker struct {
+	clock *Clock
+	t     *timer
+}
+
+func (tk *ticker) Chan() <-chan time.Time {
+	return tk.t.ch
+}
+
+func (tk *ticker) Stop() {
+	tk.clock.mu.Lock()
+	defer tk.clock.mu.Unlock()
+
+	tk.t.stopped = true
+	tk.clock.removeStopped()
+}
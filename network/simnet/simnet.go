@@ -0,0 +1,433 @@
+// Package simnet runs several nodes inside one process over an in-memory
+// network. Time is virtual and only moves when the test says so, and
+// latency, partitions and packet loss can be set per link, which makes
+// multi-node behaviour testable without real sockets or sleeps.
+package simnet
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/network"
+)
+
+const (
+	SIM_PORT        = 5001
+	GENESIS_ADDRESS = "1CdnbM5PaWJRWMcMghkCoNPQaURHRsxFtj"
+	DEFAULT_STEP    = 100 * time.Millisecond
+)
+
+// Network is a set of simulated nodes sharing one clock. Node i listens on
+// "node<i>:5001" and node0 is everyone's seed.
+type Network struct {
+	Clock *Clock
+	Step  time.Duration // virtual time that passes per poll while waiting
+
+	dir string
+
+	mu             sync.Mutex
+	rng            *rand.Rand
+	nodes          []*network.Node
+	clients        []*network.SPVClient
+	listeners      map[string]*listener
+	latency        map[[2]string]time.Duration
+	defaultLatency time.Duration
+	groups         map[string]int
+	dropRate       float64
+	nextPort       int
+	running        sync.WaitGroup
+}
+
+// NewNetwork creates an empty network whose nodes keep their chains and
+// state files under dir. The seed drives every random choice the
+// simulator makes, such as which connections get dropped, and seeds each
+// node's own nonces and shuffles.
+func NewNetwork(dir string, seed int64) *Network {
+	return &Network{
+		Clock:     NewClock(time.Unix(1700000000, 0)),
+		Step:      DEFAULT_STEP,
+		dir:       dir,
+		rng:       rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*listener),
+		latency:   make(map[[2]string]time.Duration),
+		groups:    make(map[string]int),
+		nextPort:  40000,
+	}
+}
+
+func hostName(i int) string {
+	return fmt.Sprintf("node%d", i)
+}
+
+// Addr is the peer address of node i.
+func Addr(i int) string {
+	return fmt.Sprintf("%s:%d", hostName(i), SIM_PORT)
+}
+
+// AddNode creates a node with its own fresh chain. All chains start from
+// the same genesis block, so the nodes agree on where history begins.
+func (sn *Network) AddNode() (*network.Node, error) {
+	sn.mu.Lock()
+	i := len(sn.nodes)
+	seed := sn.rng.Int63()
+	sn.mu.Unlock()
+
+	host := hostName(i)
+	dir := filepath.Join(sn.dir, host)
+
+	chain, err := blockchain.LoadBlockchainAt(filepath.Join(dir, "blocks"), GENESIS_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := network.Config{
+		ListenHost:   host,
+		ListenPort:   SIM_PORT,
+		SeedNodes:    []string{Addr(0)},
+		PeersFile:    filepath.Join(dir, "peers.json"),
+		MaxPeers:     network.DEFAULT_MAX_PEERS,
+		MinerAddress: GENESIS_ADDRESS,
+		IdentityFile: filepath.Join(dir, "node_key"),
+		BanFile:      filepath.Join(dir, "banlist.json"),
+		BanThreshold: network.DEFAULT_BAN_SCORE,
+		BanDuration:  network.DEFAULT_BAN_DURATION,
+		Clock:        sn.Clock,
+		RandSeed:     seed,
+		Transport:    &transport{net: sn, host: host},
+	}
+
+	node, err := network.NewNode(chain, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sn.mu.Lock()
+	sn.nodes = append(sn.nodes, node)
+	sn.mu.Unlock()
+
+	return node, nil
+}
+
+// AddSPVClient creates a light client watching the given public key
+// hashes. Clients listen on "spv<i>:5001" and sync from node0.
+func (sn *Network) AddSPVClient(watch [][]byte) (*network.SPVClient, error) {
+	sn.mu.Lock()
+	i := len(sn.clients)
+	seed := sn.rng.Int63()
+	sn.mu.Unlock()
+
+	host := fmt.Sprintf("spv%d", i)
+	dir := filepath.Join(sn.dir, host)
+
+	cfg := network.Config{
+		ListenHost:   host,
+		ListenPort:   SIM_PORT,
+		SeedNodes:    []string{Addr(0)},
+		IdentityFile: filepath.Join(dir, "node_key"),
+		HeadersFile:  filepath.Join(dir, "spv.dat"),
+		Clock:        sn.Clock,
+		RandSeed:     seed,
+		Transport:    &transport{net: sn, host: host},
+	}
+
+	client, err := network.NewSPVClient(cfg, GENESIS_ADDRESS, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	sn.mu.Lock()
+	sn.clients = append(sn.clients, client)
+	sn.mu.Unlock()
+
+	return client, nil
+}
+
+// AddNodes adds count nodes.
+func (sn *Network) AddNodes(count int) error {
+	for i := 0; i < count; i++ {
+		if _, err := sn.AddNode(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sn *Network) Node(i int) *network.Node {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	return sn.nodes[i]
+}
+
+func (sn *Network) Nodes() []*network.Node {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	return append([]*network.Node(nil), sn.nodes...)
+}
+
+// Start brings every node up, seed first, then the SPV clients.
+func (sn *Network) Start() error {
+	for _, node := range sn.Nodes() {
+		if err := sn.run(node.Config, node.Address, node.Run); err != nil {
+			return err
+		}
+	}
+
+	for _, client := range sn.SPVClients() {
+		if err := sn.run(client.Config, client.Address, client.Run); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sn *Network) run(cfg network.Config, addr string, run func(net.Listener) error) error {
+	ln, err := cfg.Transport.Listen(cfg.ListenAddr())
+	if err != nil {
+		return err
+	}
+
+	sn.running.Add(1)
+	go func() {
+		defer sn.running.Done()
+
+		if err := run(ln); err != nil {
+			fmt.Printf("simnet: %s stopped: %s\n", addr, err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts every node and client down and waits for them to exit.
+func (sn *Network) Stop() {
+	for _, client := range sn.SPVClients() {
+		client.Stop()
+	}
+	for _, node := range sn.Nodes() {
+		node.Stop()
+	}
+	sn.running.Wait()
+}
+
+func (sn *Network) SPVClients() []*network.SPVClient {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	return append([]*network.SPVClient(nil), sn.clients...)
+}
+
+// Mine has node i mine an empty block and announce it.
+func (sn *Network) Mine(i int) *blockchain.Block {
+	return sn.Node(i).Mine(nil)
+}
+
+// -------------------------------------------------------------
+
+// SetLatency delays connections between nodes a and b, in both
+// directions, by d of virtual time.
+func (sn *Network) SetLatency(a, b int, d time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.latency[[2]string{hostName(a), hostName(b)}] = d
+	sn.latency[[2]string{hostName(b), hostName(a)}] = d
+}
+
+// SetDefaultLatency sets the delay for every link without its own.
+func (sn *Network) SetDefaultLatency(d time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.defaultLatency = d
+}
+
+// SetDropRate makes each new connection silently vanish with probability p.
+func (sn *Network) SetDropRate(p float64) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.dropRate = p
+}
+
+// Partition splits the network so that nodes can only reach others in the
+// same group. Nodes left out of every group form a group of their own.
+func (sn *Network) Partition(groups ...[]int) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.groups = make(map[string]int)
+	for g, members := range groups {
+		for _, i := range members {
+			sn.groups[hostName(i)] = g + 1
+		}
+	}
+}
+
+// Heal removes every partition.
+func (sn *Network) Heal() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	sn.groups = make(map[string]int)
+}
+
+// -------------------------------------------------------------
+
+func (sn *Network) listen(addr string) (net.Listener, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if _, ok := sn.listeners[addr]; ok {
+		return nil, fmt.Errorf("simnet: %s already in use", addr)
+	}
+
+	l := &listener{addr: simAddr(addr), net: sn}
+	l.cond = sync.NewCond(&l.mu)
+	sn.listeners[addr] = l
+
+	return l, nil
+}
+
+func (sn *Network) unlisten(l *listener) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if sn.listeners[string(l.addr)] == l {
+		delete(sn.listeners, string(l.addr))
+	}
+}
+
+func (sn *Network) dial(from, addr string) (net.Conn, error) {
+	to, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sn.mu.Lock()
+
+	if sn.groups[from] != sn.groups[to] {
+		sn.mu.Unlock()
+		return nil, ErrUnreachable
+	}
+
+	l, ok := sn.listeners[addr]
+	if !ok {
+		sn.mu.Unlock()
+		return nil, fmt.Errorf("simnet: connection refused by %s", addr)
+	}
+
+	dropped := sn.dropRate > 0 && sn.rng.Float64() < sn.dropRate
+
+	delay, ok := sn.latency[[2]string{from, to}]
+	if !ok {
+		delay = sn.defaultLatency
+	}
+
+	// Every connection gets its own source port, like a real ephemeral port
+	sn.nextPort++
+	local := fmt.Sprintf("%s:%d", from, sn.nextPort)
+
+	sn.mu.Unlock()
+
+	client, server := newConnPair(local, addr)
+
+	switch {
+	case dropped:
+		// The dialer believes it is connected but nothing ever arrives
+	case delay > 0:
+		sn.Clock.AfterFunc(delay, func() { l.deliver(server) })
+	default:
+		l.deliver(server)
+	}
+
+	return client, nil
+}
+
+// -------------------------------------------------------------
+
+// Heights reports the best height of every node, keyed by address.
+func (sn *Network) Heights() map[string]int {
+	heights := make(map[string]int)
+
+	for _, node := range sn.Nodes() {
+		_, height := node.Tip()
+		heights[node.Address] = height
+	}
+
+	return heights
+}
+
+// Converged reports whether every node has the same tip.
+func (sn *Network) Converged() bool {
+	var first []byte
+
+	for i, node := range sn.Nodes() {
+		hash, _ := node.Tip()
+		if i == 0 {
+			first = hash
+		} else if !bytes.Equal(hash, first) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WaitForConvergence advances virtual time a Step at a time until all
+// nodes share a tip, giving up after timeout of real time.
+func (sn *Network) WaitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for !sn.Converged() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("simnet: nodes did not converge: %s", sn.describeHeights())
+		}
+
+		sn.Clock.Advance(sn.Step)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// TB is the part of testing.TB the assertions need.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// RequireConvergence fails the test if the nodes do not converge in time.
+func (sn *Network) RequireConvergence(t TB, timeout time.Duration) {
+	t.Helper()
+
+	if err := sn.WaitForConvergence(timeout); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func (sn *Network) describeHeights() string {
+	heights := sn.Heights()
+
+	addrs := make([]string, 0, len(heights))
+	for addr := range heights {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var buf bytes.Buffer
+	for _, addr := range addrs {
+		fmt.Fprintf(&buf, "%s=%d ", addr, heights[addr])
+	}
+
+	return buf.String()
+}
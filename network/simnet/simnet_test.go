@@ -0,0 +1,319 @@
+package simnet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/network"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+const testTimeout = 60 * time.Second
+
+func startNetwork(t *testing.T, nodes int, seed int64) *Network {
+	t.Helper()
+
+	sn := NewNetwork(t.TempDir(), seed)
+	sn.Step = time.Second
+
+	if err := sn.AddNodes(nodes); err != nil {
+		t.Fatalf("AddNodes: %s", err)
+	}
+
+	if err := sn.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(sn.Stop)
+
+	return sn
+}
+
+// waitFor advances virtual time until cond holds.
+func waitFor(t *testing.T, sn *Network, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %s", what, sn.describeHeights())
+		}
+
+		sn.Clock.Advance(sn.Step)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func requireTip(t *testing.T, sn *Network, hash []byte, height int) {
+	t.Helper()
+
+	for _, node := range sn.Nodes() {
+		tip, h := node.Tip()
+		if !bytes.Equal(tip, hash) || h != height {
+			t.Fatalf("%s is at %x (height %d), want %x (height %d)", node.Address, tip, h, hash, height)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	sn := startNetwork(t, 4, 1)
+
+	var last *blockchain.Block
+	for i := 1; i <= 3; i++ {
+		last = sn.Mine(i)
+		sn.RequireConvergence(t, testTimeout)
+	}
+
+	requireTip(t, sn, last.Hash, 3)
+}
+
+func TestRelay(t *testing.T) {
+	sn := NewNetwork(t.TempDir(), 2)
+	sn.Step = time.Second
+
+	if err := sn.AddNodes(3); err != nil {
+		t.Fatalf("AddNodes: %s", err)
+	}
+
+	sender, receiver := wallet.MakeAccount(), wallet.MakeAccount()
+	sn.Node(1).MinerAddress = string(sender.Address())
+
+	if err := sn.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(sn.Stop)
+
+	block := sn.Mine(1)
+	sn.RequireConvergence(t, testTimeout)
+
+	coinbase := block.Transactions[len(block.Transactions)-1]
+
+	tx := &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{{ID: coinbase.ID, Out: 0}},
+		Outputs: []blockchain.TxOutput{
+			*blockchain.NewTXOutput(5, string(receiver.Address())),
+			*blockchain.NewTXOutput(15, string(sender.Address())),
+		},
+	}
+	tx.ID = tx.ComputeID()
+	tx.Sign(sender.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(coinbase.ID): *coinbase})
+
+	if err := sn.Node(1).SubmitTx(tx); err != nil {
+		t.Fatalf("SubmitTx: %s", err)
+	}
+
+	waitFor(t, sn, "the transaction to reach every memory pool", func() bool {
+		for _, node := range sn.Nodes() {
+			if _, ok := node.MempoolTx(tx.ID); !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	mined := sn.Node(2).Mine([]*blockchain.Transaction{tx})
+	sn.RequireConvergence(t, testTimeout)
+	requireTip(t, sn, mined.Hash, 2)
+
+	waitFor(t, sn, "the transaction to leave the memory pools", func() bool {
+		for _, node := range sn.Nodes()[:2] {
+			if _, ok := node.MempoolTx(tx.ID); ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// A copy of a transaction with someone else's signature, which has the
+// same ID, must not keep the real one out of the memory pools.
+func TestRelayForgedCopy(t *testing.T) {
+	sn := NewNetwork(t.TempDir(), 3)
+	sn.Step = time.Second
+
+	if err := sn.AddNodes(3); err != nil {
+		t.Fatalf("AddNodes: %s", err)
+	}
+
+	sender, receiver := wallet.MakeAccount(), wallet.MakeAccount()
+	sn.Node(1).MinerAddress = string(sender.Address())
+
+	if err := sn.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(sn.Stop)
+
+	block := sn.Mine(1)
+	sn.RequireConvergence(t, testTimeout)
+
+	coinbase := block.Transactions[len(block.Transactions)-1]
+	prevTXs := map[string]blockchain.Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: coinbase.ID, Out: 0}},
+		Outputs: []blockchain.TxOutput{*blockchain.NewTXOutput(20, string(receiver.Address()))},
+	}
+	tx.ID = tx.ComputeID()
+	tx.Sign(sender.PrivateKey, prevTXs)
+
+	// The ID leaves out the unlocking scripts, so spoiling the signature
+	// keeps it
+	forged := *tx
+	forged.Inputs = []blockchain.TxInput{tx.Inputs[0]}
+	forged.Inputs[0].UnlockScript = append([]byte(nil), tx.Inputs[0].UnlockScript...)
+	forged.Inputs[0].UnlockScript[10] ^= 0xff
+
+	if err := sn.Node(2).SubmitTx(&forged); err == nil {
+		t.Fatal("forged transaction submitted")
+	}
+
+	for _, node := range sn.Nodes() {
+		if node != sn.Node(2) {
+			sn.Node(2).SendTx(node.Address, &forged)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		sn.Clock.Advance(sn.Step)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := sn.Node(1).SubmitTx(tx); err != nil {
+		t.Fatalf("SubmitTx: %s", err)
+	}
+
+	waitFor(t, sn, "the transaction to reach every memory pool", func() bool {
+		for _, node := range sn.Nodes() {
+			pooled, ok := node.MempoolTx(tx.ID)
+			if !ok || !bytes.Equal(pooled.Inputs[0].UnlockScript, tx.Inputs[0].UnlockScript) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// A transaction no peer could be reached for was not sent.
+func TestSubmitUnreachable(t *testing.T) {
+	sn := NewNetwork(t.TempDir(), 4)
+	sn.Step = time.Second
+
+	if err := sn.AddNodes(2); err != nil {
+		t.Fatalf("AddNodes: %s", err)
+	}
+
+	sender, receiver := wallet.MakeAccount(), wallet.MakeAccount()
+	sn.Node(1).MinerAddress = string(sender.Address())
+
+	if err := sn.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(sn.Stop)
+
+	block := sn.Mine(1)
+	sn.RequireConvergence(t, testTimeout)
+
+	coinbase := block.Transactions[len(block.Transactions)-1]
+
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: coinbase.ID, Out: 0}},
+		Outputs: []blockchain.TxOutput{*blockchain.NewTXOutput(20, string(receiver.Address()))},
+	}
+	tx.ID = tx.ComputeID()
+	tx.Sign(sender.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(coinbase.ID): *coinbase})
+
+	sn.Partition([]int{0}, []int{1})
+
+	if err := sn.Node(1).SubmitTx(tx); !errors.Is(err, network.ErrNoPeers) {
+		t.Fatalf("SubmitTx: %v, want ErrNoPeers", err)
+	}
+}
+
+func TestPartitionReorg(t *testing.T) {
+	sn := startNetwork(t, 3, 3)
+
+	sn.Mine(1)
+	sn.RequireConvergence(t, testTimeout)
+
+	sn.Partition([]int{0, 1}, []int{2})
+
+	minority := sn.Mine(1)
+	waitFor(t, sn, "node0 to follow node1", func() bool {
+		tip, _ := sn.Node(0).Tip()
+		return bytes.Equal(tip, minority.Hash)
+	})
+
+	var majority *blockchain.Block
+	for i := 0; i < 3; i++ {
+		majority = sn.Mine(2)
+	}
+
+	if sn.Converged() {
+		t.Fatal("nodes converged across the partition")
+	}
+
+	sn.Heal()
+
+	sn.RequireConvergence(t, testTimeout)
+	requireTip(t, sn, majority.Hash, 4)
+}
+
+// Two networks built from the same seed and driven by the same calls mine
+// the same blocks.
+func TestDeterministic(t *testing.T) {
+	run := func() []byte {
+		sn := startNetwork(t, 3, 4)
+
+		var last *blockchain.Block
+		for i := 0; i < 3; i++ {
+			last = sn.Mine(1)
+			sn.Clock.Advance(time.Minute)
+		}
+
+		sn.RequireConvergence(t, testTimeout)
+		requireTip(t, sn, last.Hash, 3)
+
+		return last.Hash
+	}
+
+	if first, second := run(), run(); !bytes.Equal(first, second) {
+		t.Fatalf("same seed mined %x and %x", first, second)
+	}
+}
+
+// A light client's filter is accepted from its own host and matches the
+// coinbase paying it.
+func TestLightClient(t *testing.T) {
+	sn := NewNetwork(t.TempDir(), 5)
+	sn.Step = time.Second
+
+	if err := sn.AddNodes(2); err != nil {
+		t.Fatalf("AddNodes: %s", err)
+	}
+
+	account := wallet.MakeAccount()
+	pubKeyHash := wallet.PublicKeyHash(account.PublicKey)
+	sn.Node(1).MinerAddress = string(account.Address())
+
+	client, err := sn.AddSPVClient([][]byte{pubKeyHash})
+	if err != nil {
+		t.Fatalf("AddSPVClient: %s", err)
+	}
+
+	if err := sn.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	t.Cleanup(sn.Stop)
+
+	sn.Clock.Advance(time.Second)
+	sn.Mine(1)
+	sn.RequireConvergence(t, testTimeout)
+
+	waitFor(t, sn, "the light client to see its coinbase", func() bool {
+		return client.Balance(pubKeyHash) == 20
+	})
+}
@@ -0,0 +1,229 @@
+package simnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrUnreachable = errors.New("simnet: host unreachable")
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// pipe is one direction of an in-memory connection. Writes never block, so
+// a sender can finish and close before the receiver gets scheduled, the
+// same way a small TCP message sits in the kernel buffers.
+type pipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func newPipe() *pipe {
+	p := &pipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	p.buf = append(p.buf, b...)
+	p.cond.Broadcast()
+
+	return len(b), nil
+}
+
+// read blocks until data arrives, the writer closes or the real-time
+// deadline passes. Deadlines stay on the wall clock because they only
+// guard against a hung peer, which virtual time would never unstick.
+func (p *pipe) read(b []byte, deadline time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !deadline.IsZero() {
+		wake := time.AfterFunc(time.Until(deadline), func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		defer wake.Stop()
+	}
+
+	for len(p.buf) == 0 && !p.closed {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.cond.Wait()
+	}
+
+	if len(p.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+
+	return n, nil
+}
+
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// -------------------------------------------------------------
+
+type conn struct {
+	local, remote simAddr
+	in, out       *pipe
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newConnPair(client, server string) (*conn, *conn) {
+	up, down := newPipe(), newPipe()
+
+	c := &conn{local: simAddr(client), remote: simAddr(server), in: down, out: up}
+	s := &conn{local: simAddr(server), remote: simAddr(client), in: up, out: down}
+
+	return c, s
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	return c.in.read(b, deadline)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	return c.out.write(b)
+}
+
+func (c *conn) Close() error {
+	c.out.close()
+	c.in.close()
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// -------------------------------------------------------------
+
+type listener struct {
+	addr simAddr
+	net  *Network
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []net.Conn
+	closed  bool
+}
+
+func (l *listener) deliver(c net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		c.Close()
+		return
+	}
+
+	l.pending = append(l.pending, c)
+	l.cond.Broadcast()
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.pending) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+
+	c := l.pending[0]
+	l.pending = l.pending[1:]
+
+	return c, nil
+}
+
+func (l *listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	pending := l.pending
+	l.pending = nil
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	for _, c := range pending {
+		c.Close()
+	}
+
+	l.net.unlisten(l)
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// -------------------------------------------------------------
+
+// transport is one node's view of the simulated network. It remembers the
+// node's host so that peers see connections coming from it.
+type transport struct {
+	net  *Network
+	host string
+}
+
+func (t *transport) Listen(addr string) (net.Listener, error) {
+	return t.net.listen(addr)
+}
+
+func (t *transport) Dial(addr string) (net.Conn, error) {
+	return t.net.dial(t.host, addr)
+}
@@ -0,0 +1,593 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+)
+
+// An SPV client keeps block headers instead of blocks. It loads a bloom
+// filter built from the wallet's keys onto its peers, downloads every
+// block as a merkleblock, checks each header's proof of work and linkage,
+// and keeps the wallet transactions the partial merkle trees prove to be
+// in those blocks. Balances are worked out from those alone.
+const (
+	SPV_PATH                = "../tmp/spv_%d.dat"
+	SPV_FALSE_POSITIVE_RATE = 0.0001
+	SPV_SYNC_INTERVAL       = 30 * time.Second
+	SPV_REQUEST_TIMEOUT     = 20 * time.Second
+)
+
+// ProvenTx is a transaction shown by a merkle proof to be in a block.
+type ProvenTx struct {
+	Tx        blockchain.Transaction
+	BlockHash []byte
+	Height    int
+}
+
+type spvState struct {
+	Headers []VerifiedHeader
+	Txs     []ProvenTx
+}
+
+type SPVClient struct {
+	wire
+
+	Config  Config
+	Address string
+
+	clock Clock
+
+	mu            sync.Mutex
+	peers         []string
+	headers       *headerChain
+	txs           map[string]ProvenTx
+	watch         map[string]bool
+	filter        *BloomFilter
+	queue         [][]byte
+	inflight      []byte
+	inflightSince time.Time
+	listener      net.Listener
+
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSPVClient starts from the genesis block paying genesisAddress, the
+// only block it takes on trust, and watches for transactions paying or
+// spent by the given public key hashes.
+func NewSPVClient(cfg Config, genesisAddress string, watch [][]byte) (*SPVClient, error) {
+
+	address, err := cfg.AdvertisedAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = RealClock
+	}
+
+	if cfg.Genesis == "" {
+		cfg.Genesis = blockchain.GENESIS_DATA
+	}
+
+	w, err := newWire(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := blockchain.Genesis(blockchain.CoinbaseTX(genesisAddress, cfg.Genesis))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SPVClient{
+		wire:    w,
+		Config:  cfg,
+		Address: address,
+		clock:   cfg.Clock,
+		headers: newHeaderChain(VerifiedHeader{headerOf(genesis), genesis.HashTransactions()}),
+		txs:     make(map[string]ProvenTx),
+		watch:   make(map[string]bool),
+		filter:  NewBloomFilter(len(watch)*10+10, SPV_FALSE_POSITIVE_RATE, newLockedRand(cfg.RandSeed).Uint32(), BLOOM_UPDATE_ALL),
+		quit:    make(chan struct{}),
+	}
+
+	for _, pkh := range watch {
+		c.watch[hex.EncodeToString(pkh)] = true
+		c.filter.Add(pkh)
+	}
+
+	for _, tx := range genesis.Transactions {
+		if c.filter.MatchTx(tx) {
+			c.txs[hex.EncodeToString(tx.ID)] = ProvenTx{*tx, genesis.Hash, 0}
+		}
+	}
+
+	for _, seed := range cfg.SeedNodes {
+		if seed != address {
+			c.peers = append(c.peers, seed)
+		}
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Tip returns the hash and height of the best header.
+func (c *SPVClient) Tip() ([]byte, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]byte(nil), c.headers.tip.Hash...), c.headers.tip.Height
+}
+
+// OnBestChain reports whether the header with the given hash is on the
+// best header chain, for TxProof.VerifyInChain.
+func (c *SPVClient) OnBestChain(hash []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.headers.onBestChain(hash)
+}
+
+func (c *SPVClient) Peers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.peers...)
+}
+
+// Watch starts tracking another public key hash. Only blocks downloaded
+// from now on are searched for it.
+func (c *SPVClient) Watch(pubKeyHash []byte) {
+	c.mu.Lock()
+	c.watch[hex.EncodeToString(pubKeyHash)] = true
+	c.mu.Unlock()
+
+	c.filter.Add(pubKeyHash)
+
+	for _, peer := range c.Peers() {
+		c.sendFilterAdd(peer, pubKeyHash)
+	}
+}
+
+// Transaction returns a wallet transaction if it is proven to be in a
+// block on the best chain.
+func (c *SPVClient) Transaction(id []byte) (ProvenTx, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ptx, ok := c.txs[hex.EncodeToString(id)]
+	if !ok || !c.headers.onBestChain(ptx.BlockHash) {
+		return ProvenTx{}, false
+	}
+
+	return ptx, true
+}
+
+// UnspentOutputs lists the outputs locked to pubKeyHash that no proven
+// transaction on the best chain spends.
+func (c *SPVClient) UnspentOutputs(pubKeyHash []byte) []blockchain.TxOutput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	spent := make(map[string]bool)
+	var confirmed []ProvenTx
+
+	for _, ptx := range c.txs {
+		if !c.headers.onBestChain(ptx.BlockHash) {
+			continue
+		}
+		confirmed = append(confirmed, ptx)
+
+		if ptx.Tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range ptx.Tx.Inputs {
+			spent[hex.EncodeToString(Outpoint(in.ID, in.Out))] = true
+		}
+	}
+
+	var unspent []blockchain.TxOutput
+
+	for _, ptx := range confirmed {
+		for i, out := range ptx.Tx.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) && !spent[hex.EncodeToString(Outpoint(ptx.Tx.ID, i))] {
+				unspent = append(unspent, out)
+			}
+		}
+	}
+
+	return unspent
+}
+
+func (c *SPVClient) Balance(pubKeyHash []byte) int {
+	balance := 0
+	for _, out := range c.UnspentOutputs(pubKeyHash) {
+		balance += out.Value
+	}
+	return balance
+}
+
+// -------------------------------------------------------------
+
+func (c *SPVClient) load() error {
+
+	if c.Config.HeadersFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.Config.HeadersFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state spvState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return fmt.Errorf("failed to decode SPV state %s: %w", c.Config.HeadersFile, err)
+	}
+
+	// Everything is checked again, the file is no more trusted than a peer
+	for _, h := range state.Headers {
+		if err := c.headers.add(h); err != nil {
+			return fmt.Errorf("bad header in %s: %w", c.Config.HeadersFile, err)
+		}
+	}
+
+	for _, ptx := range state.Txs {
+		if c.headers.has(ptx.BlockHash) {
+			c.txs[hex.EncodeToString(ptx.Tx.ID)] = ptx
+		}
+	}
+
+	return nil
+}
+
+// save writes the state out. Callers must hold mu.
+func (c *SPVClient) save() {
+
+	if c.Config.HeadersFile == "" {
+		return
+	}
+
+	state := spvState{Headers: c.headers.headers()}
+	for _, ptx := range c.txs {
+		state.Txs = append(state.Txs, ptx)
+	}
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(state); err != nil {
+		fmt.Printf("Failed to encode SPV state: %s\n", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.Config.HeadersFile), os.ModePerm); err != nil {
+		fmt.Printf("Failed to save SPV state: %s\n", err)
+		return
+	}
+
+	tmp := c.Config.HeadersFile + ".tmp"
+	if err := os.WriteFile(tmp, buff.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to save SPV state: %s\n", err)
+		return
+	}
+
+	if err := os.Rename(tmp, c.Config.HeadersFile); err != nil {
+		fmt.Printf("Failed to save SPV state: %s\n", err)
+	}
+}
+
+// -------------------------------------------------------------
+
+func (c *SPVClient) send(addr, command string, data interface{}) {
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		fmt.Printf("%s is not available: %s\n", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	request := append(CmdToBytes(command), GobEncode(data)...)
+	if _, err := io.Copy(conn, bytes.NewReader(request)); err != nil {
+		fmt.Printf("Failed to send to %s: %s\n", addr, err)
+	}
+}
+
+func (c *SPVClient) sendVersion(addr string) {
+	_, height := c.Tip()
+	c.send(addr, VERSION, Version{version, height, c.Address, false, true, c.Config.Genesis})
+}
+
+func (c *SPVClient) sendFilterAdd(addr string, data []byte) {
+	c.send(addr, FILTER_ADD, FilterAdd{c.Address, data})
+}
+
+// -------------------------------------------------------------
+
+func (c *SPVClient) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	req, _, err := c.readRequest(conn)
+	if err != nil {
+		fmt.Printf("Failed to read from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := c.handleRequest(req); err != nil {
+		fmt.Printf("Error handling message from %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// handleRequest answers the few messages an SPV client cares about. Full
+// nodes also send it gossip it has no use for, which is dropped.
+func (c *SPVClient) handleRequest(req []byte) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("message handler failed: %v", r)
+		}
+	}()
+
+	if len(req) < commandLength {
+		return fmt.Errorf("truncated message")
+	}
+
+	payload := bytes.NewReader(req[commandLength:])
+
+	switch BytesToCmd(req[:commandLength]) {
+	case INV:
+		var inv Inv
+		if err := gob.NewDecoder(payload).Decode(&inv); err != nil {
+			return err
+		}
+		c.handleInv(inv)
+
+	case MERKLE_BLOCK:
+		var mb MerkleBlock
+		if err := gob.NewDecoder(payload).Decode(&mb); err != nil {
+			return err
+		}
+		return c.handleMerkleBlock(mb)
+
+	case PING:
+		var ping Ping
+		if err := gob.NewDecoder(payload).Decode(&ping); err != nil {
+			return err
+		}
+		c.send(ping.AddrFrom, PONG, Pong{c.Address, ping.Nonce})
+
+	case VERSION:
+		var ver Version
+		if err := gob.NewDecoder(payload).Decode(&ver); err != nil {
+			return err
+		}
+		c.handleVersion(ver)
+	}
+
+	return nil
+}
+
+func (c *SPVClient) handleVersion(ver Version) {
+	if ver.Light || ver.Genesis != c.Config.Genesis {
+		return
+	}
+
+	c.mu.Lock()
+	known := false
+	for _, peer := range c.peers {
+		known = known || peer == ver.AddrFrom
+	}
+	if !known {
+		c.peers = append(c.peers, ver.AddrFrom)
+	}
+	height := c.headers.tip.Height
+	c.mu.Unlock()
+
+	if !known {
+		c.send(ver.AddrFrom, FILTER_LOAD, c.filter.FilterLoad(c.Address))
+	}
+
+	if ver.BestHeight > height {
+		c.send(ver.AddrFrom, GET_BLOCKS, GetBlocks{c.Address})
+	}
+}
+
+// handleInv queues the announced blocks we lack, oldest first. Loose
+// transactions are ignored: only confirmed, proven ones count.
+func (c *SPVClient) handleInv(inv Inv) {
+	if inv.Type != BLOCK {
+		return
+	}
+
+	c.mu.Lock()
+	for i := len(inv.Items) - 1; i >= 0; i-- {
+		if !c.headers.has(inv.Items[i]) {
+			c.queue = append(c.queue, inv.Items[i])
+		}
+	}
+	c.mu.Unlock()
+
+	c.requestNext(inv.AddrFrom)
+}
+
+func (c *SPVClient) handleMerkleBlock(mb MerkleBlock) error {
+
+	root, txs, err := mb.verify()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+
+	if bytes.Equal(c.inflight, mb.Header.Hash) {
+		c.inflight = nil
+	}
+
+	err = c.headers.add(VerifiedHeader{mb.Header, root})
+
+	if errors.Is(err, blockchain.ErrOrphanBlock) {
+		// We missed blocks somewhere, start over from what we have
+		c.queue = nil
+		c.mu.Unlock()
+
+		c.send(mb.AddrFrom, GET_BLOCKS, GetBlocks{c.Address})
+		return nil
+	}
+
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	for _, tx := range txs {
+		c.txs[hex.EncodeToString(tx.ID)] = ProvenTx{tx, mb.Header.Hash, mb.Header.Height}
+	}
+
+	c.save()
+	c.mu.Unlock()
+
+	fmt.Printf("Verified header %x at height %d with %d wallet transactions\n", mb.Header.Hash, mb.Header.Height, len(txs))
+
+	c.requestNext(mb.AddrFrom)
+
+	return nil
+}
+
+// requestNext asks peer for the next queued block, one at a time so that
+// headers arrive parent first.
+func (c *SPVClient) requestNext(peer string) {
+	c.mu.Lock()
+
+	if c.inflight != nil {
+		c.mu.Unlock()
+		return
+	}
+
+	for len(c.queue) > 0 && c.headers.has(c.queue[0]) {
+		c.queue = c.queue[1:]
+	}
+
+	if len(c.queue) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	next := c.queue[0]
+	c.queue = c.queue[1:]
+	c.inflight = next
+	c.inflightSince = c.clock.Now()
+
+	c.mu.Unlock()
+
+	c.send(peer, GET_DATA, GetData{c.Address, FILTERED_BLOCK, next})
+}
+
+// syncLoop periodically re-announces our height, which makes peers that
+// are ahead answer with theirs and so starts another sync. Downloads that
+// never came back are given up on.
+func (c *SPVClient) syncLoop() {
+	ticker := c.clock.NewTicker(SPV_SYNC_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+			c.mu.Lock()
+			stalled := c.inflight != nil && c.clock.Now().Sub(c.inflightSince) > SPV_REQUEST_TIMEOUT
+			if stalled {
+				c.inflight = nil
+				c.queue = nil
+			}
+			c.mu.Unlock()
+
+			for _, peer := range c.Peers() {
+				// A peer that dropped us also dropped our filter
+				if stalled {
+					c.send(peer, FILTER_LOAD, c.filter.FilterLoad(c.Address))
+				}
+				c.sendVersion(peer)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// -------------------------------------------------------------
+
+func (c *SPVClient) Start() {
+
+	ln, err := c.transport.Listen(c.Config.ListenAddr())
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+
+	if err := c.Run(ln); err != nil {
+		log.Panic(err)
+	}
+}
+
+// Run loads our filter onto the seeds, starts syncing and serves ln until
+// Stop is called.
+func (c *SPVClient) Run(ln net.Listener) error {
+
+	c.mu.Lock()
+	c.listener = ln
+	c.mu.Unlock()
+
+	for _, peer := range c.Peers() {
+		c.send(peer, FILTER_LOAD, c.filter.FilterLoad(c.Address))
+		c.sendVersion(peer)
+	}
+
+	go c.syncLoop()
+
+	fmt.Printf("SPV client listening @: %s (advertised as %s)\n", c.Config.ListenAddr(), c.Address)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-c.quit:
+				return nil
+			default:
+				return err
+			}
+		}
+		go c.handleConnection(conn)
+	}
+}
+
+func (c *SPVClient) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.quit)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.listener != nil {
+			c.listener.Close()
+		}
+	})
+}
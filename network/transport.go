@@ -0,0 +1,25 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Transport is how a node reaches its peers. Production nodes talk TCP;
+// the simulator plugs in an in-memory network instead.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(protocol, addr)
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout(protocol, addr, dialTimeout)
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// MAX_MESSAGE_SIZE bounds what a peer can make us buffer for a single
+	// message, far above any block we would accept
+	MAX_MESSAGE_SIZE = 32 << 20
+
+	// MESSAGE_READ_TIMEOUT is how long a peer gets to send a whole
+	// message, handshake included
+	MESSAGE_READ_TIMEOUT = 30 * time.Second
+)
+
+// wire is how a peer moves messages: the transport underneath, who it is
+// on the secure transport and whom it lets in. Full nodes and SPV clients
+// both embed one.
+type wire struct {
+	transport Transport
+	identity  ed25519.PrivateKey
+	allowed   map[string]bool
+	encrypt   bool
+}
+
+// newWire loads the identity cfg points at and fills in the transport
+// defaults. An allowlist switches cfg over to encryption, since identities
+// can only be checked over the secure transport.
+func newWire(cfg *Config) (wire, error) {
+
+	if cfg.Transport == nil {
+		cfg.Transport = TCPTransport{}
+	}
+
+	identity, err := LoadIdentity(cfg.IdentityFile)
+	if err != nil {
+		return wire{}, err
+	}
+
+	allowed := make(map[string]bool)
+	for _, id := range cfg.AllowedPeers {
+		allowed[id] = true
+	}
+
+	if len(allowed) > 0 {
+		cfg.Encrypt = true
+	}
+
+	return wire{cfg.Transport, identity, allowed, cfg.Encrypt}, nil
+}
+
+// Identity is the ID peers know us by on the secure transport.
+func (w *wire) Identity() string {
+	return IdentityID(w.identity.Public().(ed25519.PublicKey))
+}
+
+// dial opens a connection to addr, over the secure transport when we are
+// configured for it.
+func (w *wire) dial(addr string) (net.Conn, error) {
+
+	conn, err := w.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !w.encrypt {
+		return conn, nil
+	}
+
+	sc, err := ClientHandshake(conn, w.identity, w.allowed)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("secure handshake with %s: %w", addr, err)
+	}
+
+	return sc, nil
+}
+
+// MsgSource is what the connection a message came in on says about its
+// sender, as opposed to the AddrFrom the sender fills in itself.
+type MsgSource struct {
+	RemoteAddr string // the connection's remote address, from an ephemeral port
+	Identity   string // the sender's identity on the secure transport, empty on plaintext
+}
+
+// readRequest reads a whole message off an incoming connection. A leading
+// SECURE_MAGIC byte, which can never start a command, selects the secure
+// transport; anything else is plaintext and only accepted when we do not
+// require encryption. Messages over MAX_MESSAGE_SIZE, or that take longer
+// than MESSAGE_READ_TIMEOUT, are refused.
+func (w *wire) readRequest(conn net.Conn) ([]byte, MsgSource, error) {
+
+	src := MsgSource{RemoteAddr: conn.RemoteAddr().String()}
+
+	deadline := time.Now().Add(MESSAGE_READ_TIMEOUT)
+	conn.SetReadDeadline(deadline)
+
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, src, err
+	}
+
+	if first[0] != SECURE_MAGIC {
+		if w.encrypt {
+			return nil, src, fmt.Errorf("plaintext connection refused")
+		}
+
+		rest, err := readMessage(conn, MAX_MESSAGE_SIZE-1)
+		return append(first[:], rest...), src, err
+	}
+
+	sc, err := ServerHandshake(conn, w.identity, w.allowed)
+	if err != nil {
+		return nil, src, fmt.Errorf("secure handshake: %w", err)
+	}
+
+	src.Identity = IdentityID(sc.RemoteIdentity())
+
+	// The handshake clears its own deadline
+	conn.SetReadDeadline(deadline)
+
+	req, err := readMessage(sc, MAX_MESSAGE_SIZE)
+	return req, src, err
+}
+
+// readMessage reads r to the end, failing once it has more than max bytes.
+func readMessage(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("message larger than %d bytes", max)
+	}
+
+	return data, nil
+}
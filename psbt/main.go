@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/i101dev/blockchain-Tensor/blockchain"
+	"github.com/i101dev/blockchain-Tensor/types"
+	"github.com/i101dev/blockchain-Tensor/wallet"
+)
+
+// psbt moves partially signed transactions between a node and signers
+// that never see the chain, so keys can stay on a machine that is never
+// online. Only create and broadcast talk to a node:
+//
+//	psbt create -node URL -from ADDR -to ADDR -amount N > unsigned.psbt
+//	psbt sign -wallet FILE -address ADDR @unsigned.psbt > signed.psbt   (offline)
+//	psbt combine @signed-1.psbt @signed-2.psbt > combined.psbt
+//	psbt finalize @combined.psbt > final.psbt
+//	psbt broadcast -node URL @final.psbt
+//
+// A PSBT argument is the base64 text itself, @FILE to read it from a file,
+// or left out to read standard input, so the steps can be piped together.
+// decode shows what a PSBT spends and pays, and who has signed it, which
+// a signer should check before signing.
+
+func init() {
+	log.SetPrefix("PSBT: ")
+}
+
+const usage = `usage: psbt <command> [flags] [psbt...]
+
+commands:
+  create     ask a node for a PSBT spending from an address
+  decode     show what a PSBT spends, pays and who signed it
+  sign       sign with keys from a wallet file, offline
+  combine    merge the signatures of copies signed separately
+  finalize   turn enough signatures into unlocking scripts
+  broadcast  finalize and send to a node
+`
+
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m metadataFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("metadata %q is not KEY=VALUE", value)
+	}
+	m[key] = val
+	return nil
+}
+
+// readPSBT reads a PSBT argument, see above.
+func readPSBT(arg string) (*blockchain.PSBT, error) {
+
+	var data []byte
+	var err error
+
+	switch {
+	case arg == "" || arg == "-":
+		data, err = io.ReadAll(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		data, err = os.ReadFile(arg[1:])
+	default:
+		data = []byte(arg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return blockchain.ParsePSBT(strings.TrimSpace(string(data)))
+}
+
+func psbtArgs(fs *flag.FlagSet) []string {
+	if fs.NArg() == 0 {
+		return []string{""}
+	}
+	return fs.Args()
+}
+
+// post sends body to a node's HTTP API and decodes its JSON reply into res.
+func post(node, path string, body interface{}, res interface{}) error {
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(node+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, bytes.TrimSpace(data))
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+func printJSON(v interface{}) {
+	m, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(m))
+}
+
+// -------------------------------------------------------------
+
+func create(args []string) {
+
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	node := fs.String("node", "http://localhost:5000", "HTTP API of a node")
+	from := fs.String("from", "", "Key, multisig or P2SH address to spend from")
+	to := fs.String("to", "", "Address to pay")
+	amount := fs.Int("amount", 0, "Amount to pay")
+	notBefore := fs.Int64("not-before", 0, "Lock the payment until this height or Unix time, key addresses only")
+	redeemScript := fs.String("redeem-script", "", "Hex redeem script, for P2SH addresses")
+	lockTime := fs.Int64("lock-time", 0, "Transaction lock time, multisig only")
+	sigHash := fs.String("sighash", "ALL", "Hash type to sign with, such as ALL or SINGLE|ANYONECANPAY")
+	metadata := metadataFlag{}
+	fs.Var(metadata, "meta", "KEY=VALUE to carry along, may be repeated")
+	fs.Parse(args)
+
+	var res struct {
+		PSBT string `json:"psbt"`
+	}
+
+	err := post(*node, "/psbt/create", types.PSBTCreateReq{
+		From:         *from,
+		To:           *to,
+		Amount:       *amount,
+		NotBefore:    *notBefore,
+		RedeemScript: *redeemScript,
+		LockTime:     *lockTime,
+		SigHash:      *sigHash,
+		Metadata:     metadata,
+	}, &res)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(res.PSBT)
+}
+
+func decode(args []string) {
+
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Parse(args)
+
+	for _, arg := range psbtArgs(fs) {
+		p, err := readPSBT(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(p)
+	}
+}
+
+func sign(args []string) {
+
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	walletPath := fs.String("wallet", "../tmp/wallets.data", "Wallet file holding the keys")
+	address := fs.String("address", "", "Account to sign with, every account in the wallet if empty")
+	fs.Parse(args)
+
+	w := wallet.Wallet{Accounts: make(map[string]*wallet.Account)}
+	if err := w.LoadFileFrom(*walletPath); err != nil {
+		log.Fatal(err)
+	}
+
+	var accounts []*wallet.Account
+	if *address != "" {
+		account, ok := w.Accounts[*address]
+		if !ok {
+			log.Fatalf("%s is not in %s", *address, *walletPath)
+		}
+		accounts = append(accounts, account)
+	} else {
+		for _, account := range w.Accounts {
+			accounts = append(accounts, account)
+		}
+	}
+
+	p, err := readPSBT(psbtArgs(fs)[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signed := 0
+	for _, account := range accounts {
+		n, err := p.Sign(account.PrivateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		signed += n
+	}
+
+	if signed == 0 {
+		log.Fatal("none of the inputs are for these keys")
+	}
+
+	log.Printf("added %d signatures", signed)
+	fmt.Println(p)
+}
+
+func combine(args []string) {
+
+	fs := flag.NewFlagSet("combine", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		log.Fatal("combine needs at least two PSBTs")
+	}
+
+	var combined *blockchain.PSBT
+
+	for _, arg := range fs.Args() {
+		p, err := readPSBT(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if combined == nil {
+			combined = p
+		} else if err := combined.Combine(p); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println(combined)
+}
+
+func finalize(args []string) {
+
+	fs := flag.NewFlagSet("finalize", flag.ExitOnError)
+	fs.Parse(args)
+
+	p, err := readPSBT(psbtArgs(fs)[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	complete, err := p.Finalize()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if complete {
+		tx, err := p.Extract()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Checked against the outputs the PSBT says it spends; the node
+		// checks again against the chain
+		if !tx.Verify(p.PrevTXs()) {
+			log.Fatal("the finished transaction does not verify")
+		}
+
+		log.Printf("complete, transaction %x: %s", tx.ID, hex.EncodeToString(tx.Serialize()))
+	} else {
+		log.Print("not every input has enough signatures yet")
+	}
+
+	fmt.Println(p)
+}
+
+func broadcast(args []string) {
+
+	fs := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	node := fs.String("node", "http://localhost:5000", "HTTP API of a node")
+	fs.Parse(args)
+
+	p, err := readPSBT(psbtArgs(fs)[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var res struct {
+		ID string `json:"id"`
+	}
+
+	if err := post(*node, "/psbt/broadcast", types.PSBTReq{PSBT: p.String()}, &res); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(res.ID)
+}
+
+func main() {
+
+	commands := map[string]func([]string){
+		"create":    create,
+		"decode":    decode,
+		"sign":      sign,
+		"combine":   combine,
+		"finalize":  finalize,
+		"broadcast": broadcast,
+	}
+
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands[os.Args[1]](os.Args[2:])
+}
@@ -1,12 +1,98 @@
 package types
 
-type AddBlockReq struct {
-	Data *string `json:"data"`
+type NewTxnReq struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    int    `json:"amount"`
+	MineNow   bool   `json:"minenow"`
+	NotBefore int64  `json:"not_before"` // height or Unix time, 0 for none
 }
 
-type NewTxnReq struct {
+type AddBanReq struct {
+	Host     string `json:"host"`
+	Duration int64  `json:"duration"` // seconds, 0 for the node's default
+	Reason   string `json:"reason"`
+}
+
+type RemoveBanReq struct {
+	Host string `json:"host"`
+}
+
+type MultisigCreateReq struct {
+	Required int      `json:"required"`
+	PubKeys  []string `json:"pubkeys"` // hex
+	P2SH     bool     `json:"p2sh"`    // pay to the script's hash instead
+}
+
+type MultisigSpendReq struct {
+	From         string `json:"from"` // multisig or P2SH address
+	To           string `json:"to"`
+	Amount       int    `json:"amount"`
+	RedeemScript string `json:"redeem_script"` // hex, for P2SH addresses
+	LockTime     int64  `json:"lock_time"`     // height or Unix time, 0 for none
+}
+
+type MultisigSignReq struct {
+	Transaction string `json:"transaction"` // hex, as returned by /multisig/spend
+	Address     string `json:"address"`     // wallet account to sign with
+	SigHash     string `json:"sighash"`     // such as "ALL" or "SINGLE|ANYONECANPAY", ALL if empty
+}
+
+type MultisigSendReq struct {
+	Transaction string `json:"transaction"`
+}
+
+type HTLCCreateReq struct {
+	SecretHash string `json:"secret_hash"` // hex SHA-256 of the secret
+	Recipient  string `json:"recipient"`   // address that can claim with the secret
+	Sender     string `json:"sender"`      // address that can refund after lock_time
+	LockTime   int64  `json:"lock_time"`   // height or Unix time
+}
+
+type HTLCSpendReq struct {
+	RedeemScript string `json:"redeem_script"` // hex, as returned by /htlc/create
+	TxID         string `json:"txid"`          // the transaction that funded the contract
+	Secret       string `json:"secret"`        // hex, claims only
+	To           string `json:"to"`            // defaults to the recipient or sender
+	MineNow      bool   `json:"minenow"`
+}
+
+type AnchorReq struct {
 	From    string `json:"from"`
-	To      string `json:"to"`
-	Amount  int    `json:"amount"`
+	Data    string `json:"data"` // hex, such as a document's SHA-256
 	MineNow bool   `json:"minenow"`
 }
+
+type SignTxnReq struct {
+	Transaction string `json:"transaction"` // hex
+	Address     string `json:"address"`     // wallet account to sign with
+	SigHash     string `json:"sighash"`     // such as "ALL" or "SINGLE|ANYONECANPAY", ALL if empty
+}
+
+type SendTxnReq struct {
+	Transaction string `json:"transaction"`
+}
+
+type PSBTCreateReq struct {
+	From         string            `json:"from"` // key, multisig or P2SH address
+	To           string            `json:"to"`
+	Amount       int               `json:"amount"`
+	NotBefore    int64             `json:"not_before"`    // locks the payment, key addresses only
+	RedeemScript string            `json:"redeem_script"` // hex, for P2SH addresses
+	LockTime     int64             `json:"lock_time"`     // multisig only
+	SigHash      string            `json:"sighash"`       // ALL if empty
+	Metadata     map[string]string `json:"metadata"`
+}
+
+type PSBTSignReq struct {
+	PSBT    string `json:"psbt"`    // base64
+	Address string `json:"address"` // wallet account to sign with
+}
+
+type PSBTCombineReq struct {
+	PSBTs []string `json:"psbts"`
+}
+
+type PSBTReq struct {
+	PSBT string `json:"psbt"`
+}
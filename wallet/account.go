@@ -6,9 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
 
 	"github.com/i101dev/blockchain-Tensor/util"
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -16,6 +20,23 @@ import (
 const (
 	checksumLength = 4
 	version        = byte(0x00)
+
+	// PubKeyHashVersion marks ordinary addresses, whose payload is the
+	// HASH160 of a public key.
+	PubKeyHashVersion = version
+
+	// MultisigVersion marks addresses that carry a whole M-of-N locking
+	// script instead of a public key hash.
+	MultisigVersion = byte(0x32)
+
+	// ScriptHashVersion marks pay-to-script-hash addresses, whose payload
+	// is the HASH160 of a redeem script.
+	ScriptHashVersion = byte(0x05)
+)
+
+var (
+	ErrBadAddress   = errors.New("invalid address")
+	ErrBadPublicKey = errors.New("invalid public key")
 )
 
 // -----------------------------------------------------------------------
@@ -39,17 +60,41 @@ func (w Account) Address() []byte {
 }
 
 func PubKeyHashToAddr(pubKeyHash []byte) string {
+	return EncodeAddress(version, pubKeyHash)
+}
 
-	versionedHash := append([]byte{version}, pubKeyHash...)
-	checkSum := CheckSum(versionedHash)
+// EncodeAddress is Base58Check: version, payload and a four byte checksum.
+func EncodeAddress(version byte, payload []byte) string {
 
-	fullHash := append(versionedHash, checkSum...)
-	address := util.Base58Encode(fullHash)
+	versionedPayload := append([]byte{version}, payload...)
+	checkSum := CheckSum(versionedPayload)
+
+	fullPayload := append(versionedPayload, checkSum...)
+	address := util.Base58Encode(fullPayload)
 
 	return string(address)
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+// DecodeAddress checks an address's checksum and splits it into its
+// version and payload.
+func DecodeAddress(address string) (byte, []byte, error) {
+
+	fullPayload, err := base58.Decode(address)
+	if err != nil || len(fullPayload) < 1+checksumLength {
+		return 0, nil, ErrBadAddress
+	}
+
+	versionedPayload := fullPayload[:len(fullPayload)-checksumLength]
+	if !bytes.Equal(CheckSum(versionedPayload), fullPayload[len(versionedPayload):]) {
+		return 0, nil, ErrBadAddress
+	}
+
+	return versionedPayload[0], versionedPayload[1:], nil
+}
+
+// NewKeyPair makes a key and encodes its public half compressed, or
+// uncompressed if asked to.
+func NewKeyPair(compressed bool) (ecdsa.PrivateKey, []byte) {
 
 	curve := elliptic.P256()
 
@@ -58,19 +103,127 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Fatal(err)
 	}
 
-	public := append(private.X.Bytes(), private.Y.Bytes()...)
+	if !compressed {
+		return *private, UncompressedPublicKeyBytes(&private.PublicKey)
+	}
+
+	return *private, PublicKeyBytes(&private.PublicKey)
+}
+
+// Public keys in addresses and scripts are SEC1 encoded, as in Bitcoin:
+//
+//	compressed    0x02 or 0x03 (Y even or odd), X          33 bytes
+//	uncompressed  0x04, X, Y                               65 bytes
+//
+// with X and Y 32 bytes each. Accounts made before SEC1 have the legacy
+// form, X and Y without a prefix, 64 bytes; it is still accepted so that
+// what was paid to them stays spendable. Before keys were fixed length
+// the legacy form dropped leading zero bytes of X and Y, and those shorter
+// keys are accepted too. The forms of one key hash to different
+// addresses, so a key is used in the form its account was made with.
+
+// PublicKeyBytes is the compressed form new accounts use.
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	key := make([]byte, 33)
+	key[0] = 0x02 + byte(pub.Y.Bit(0))
+	pub.X.FillBytes(key[1:])
+	return key
+}
+
+func UncompressedPublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	key := make([]byte, 65)
+	key[0] = 0x04
+	pub.X.FillBytes(key[1:33])
+	pub.Y.FillBytes(key[33:])
+	return key
+}
+
+// LegacyPublicKeyBytes is the form keys had before SEC1.
+func LegacyPublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	key := make([]byte, 64)
+	pub.X.FillBytes(key[:32])
+	pub.Y.FillBytes(key[32:])
+	return key
+}
+
+// PublicKeyEncodings is every form of a key, compressed first, for finding
+// the one an output or script uses.
+func PublicKeyEncodings(pub *ecdsa.PublicKey) [][]byte {
+	encodings := [][]byte{PublicKeyBytes(pub), UncompressedPublicKeyBytes(pub), LegacyPublicKeyBytes(pub)}
+
+	if short := append(pub.X.Bytes(), pub.Y.Bytes()...); len(short) < 64 {
+		encodings = append(encodings, short)
+	}
+
+	return encodings
+}
+
+// ParsePublicKey reads a key in any of the forms, which has to be a point
+// on the curve.
+func ParsePublicKey(pubKey []byte) (*ecdsa.PublicKey, error) {
 
-	return *private, public
+	curve := elliptic.P256()
+	var x, y *big.Int
+
+	switch {
+	case len(pubKey) == 33 && (pubKey[0] == 0x02 || pubKey[0] == 0x03):
+		// Also checks the point is on the curve
+		x, y = elliptic.UnmarshalCompressed(curve, pubKey)
+
+	case len(pubKey) == 65 && pubKey[0] == 0x04:
+		x, y = new(big.Int).SetBytes(pubKey[1:33]), new(big.Int).SetBytes(pubKey[33:])
+		if !curve.IsOnCurve(x, y) {
+			x = nil
+		}
+
+	case len(pubKey) == 64:
+		x, y = new(big.Int).SetBytes(pubKey[:32]), new(big.Int).SetBytes(pubKey[32:])
+		if !curve.IsOnCurve(x, y) {
+			x = nil
+		}
+
+	case len(pubKey) > 33 && len(pubKey) < 64:
+		x, y = parseShortKey(curve, pubKey)
+
+	default:
+		return nil, fmt.Errorf("%w: %d bytes is not a SEC1 or legacy encoding", ErrBadPublicKey, len(pubKey))
+	}
+
+	if x == nil {
+		return nil, fmt.Errorf("%w: not on the curve", ErrBadPublicKey)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
 }
 
+// MakeAccount makes an account with a compressed key.
 func MakeAccount() *Account {
-	private, public := NewKeyPair()
+	return makeAccount(true)
+}
+
+func makeAccount(compressed bool) *Account {
+	private, public := NewKeyPair(compressed)
 	return &Account{
 		PrivateKey: private,
 		PublicKey:  public,
 	}
 }
 
+// parseShortKey reads a legacy key from before keys were fixed length,
+// where either of X and Y could be short. The key does not say where X
+// ends, so every split is tried; only the right one is a point on the
+// curve. Those keys were read split in half, which missed the point when
+// X and Y were short by different amounts.
+func parseShortKey(curve elliptic.Curve, pubKey []byte) (*big.Int, *big.Int) {
+	for xLen := len(pubKey) - 32; xLen <= 32; xLen++ {
+		x, y := new(big.Int).SetBytes(pubKey[:xLen]), new(big.Int).SetBytes(pubKey[xLen:])
+		if curve.IsOnCurve(x, y) {
+			return x, y
+		}
+	}
+	return nil, nil
+}
+
 func PublicKeyHash(pubKey []byte) []byte {
 
 	pubHash := sha256.Sum256(pubKey)
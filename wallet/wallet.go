@@ -45,8 +45,16 @@ func (w Wallet) GetAccount(address string) Account {
 }
 
 func (w *Wallet) AddAccount() string {
+	return w.addAccount(MakeAccount())
+}
+
+// AddUncompressedAccount is AddAccount with the key in uncompressed form,
+// for other software that only takes that.
+func (w *Wallet) AddUncompressedAccount() string {
+	return w.addAccount(makeAccount(false))
+}
 
-	account := MakeAccount()
+func (w *Wallet) addAccount(account *Account) string {
 
 	// addr := fmt.Sprintf("%s", account.Address())
 	addr := string(account.Address())
@@ -68,14 +76,20 @@ func (w *Wallet) GetAllAddresses() []string {
 }
 
 func (w *Wallet) LoadFile() error {
+	return w.LoadFileFrom(walletFile)
+}
 
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+// LoadFileFrom loads a wallet file kept somewhere else, such as on a
+// signing machine without a node.
+func (w *Wallet) LoadFileFrom(path string) error {
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return err
 	}
 
 	var wallet Wallet
 
-	fileContent, err := os.ReadFile(walletFile)
+	fileContent, err := os.ReadFile(path)
 	util.Handle(err, "LoadFile 1")
 
 	gob.Register(elliptic.P256())
@@ -89,6 +103,10 @@ func (w *Wallet) LoadFile() error {
 }
 
 func (w *Wallet) SaveFile() {
+	w.SaveFileTo(walletFile)
+}
+
+func (w *Wallet) SaveFileTo(path string) {
 	var content bytes.Buffer
 	gob.Register(elliptic.P256())
 
@@ -96,7 +114,7 @@ func (w *Wallet) SaveFile() {
 	err := encoder.Encode(w)
 	util.Handle(err, "SaveFile 1")
 
-	err = os.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.WriteFile(path, content.Bytes(), 0644)
 	util.Handle(err, "SaveFile 2")
 }
 